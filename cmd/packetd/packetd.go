@@ -9,7 +9,6 @@ import (
 	"os/exec"
 	"os/signal"
 	"os/user"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -24,12 +23,15 @@ import (
 	"github.com/untangle/packetd/plugins/certsniff"
 	"github.com/untangle/packetd/plugins/classify"
 	"github.com/untangle/packetd/plugins/dns"
+	"github.com/untangle/packetd/plugins/encdns"
 	"github.com/untangle/packetd/plugins/example"
 	"github.com/untangle/packetd/plugins/geoip"
 	"github.com/untangle/packetd/plugins/reporter"
 	"github.com/untangle/packetd/plugins/revdns"
+	"github.com/untangle/packetd/plugins/sinkhole"
 	"github.com/untangle/packetd/plugins/sni"
 	"github.com/untangle/packetd/plugins/stats"
+	"github.com/untangle/packetd/services/category"
 	"github.com/untangle/packetd/services/certcache"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
@@ -38,14 +40,13 @@ import (
 	"github.com/untangle/packetd/services/overseer"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/restd"
+	"github.com/untangle/packetd/services/rules"
 	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/watchdog"
 )
 
-const rulesScript = "packetd_rules"
-
 var localFlag bool
 var cpuCount = getConcurrencyFactor()
-var queueRange = getQueueRange()
 var conntrackIntervalSeconds = 10
 
 func main() {
@@ -240,6 +241,9 @@ func startServices() {
 	dict.Startup()
 	restd.Startup()
 	certcache.Startup()
+	category.Startup()
+	rules.Startup()
+	watchdog.Startup()
 	overseer.Startup()
 }
 
@@ -248,6 +252,9 @@ func stopServices() {
 	c := make(chan bool)
 	go func() {
 		overseer.Shutdown()
+		watchdog.Shutdown()
+		rules.Shutdown()
+		category.Shutdown()
 		certcache.Shutdown()
 		restd.Shutdown()
 		dict.Shutdown()
@@ -280,7 +287,9 @@ func startPlugins() {
 		certfetch.PluginStartup,
 		certsniff.PluginStartup,
 		dns.PluginStartup,
+		encdns.PluginStartup,
 		revdns.PluginStartup,
+		sinkhole.PluginStartup,
 		sni.PluginStartup,
 		stats.PluginStartup,
 		reporter.PluginStartup}
@@ -306,7 +315,9 @@ func stopPlugins() {
 		certfetch.PluginShutdown,
 		certsniff.PluginShutdown,
 		dns.PluginShutdown,
+		encdns.PluginShutdown,
 		revdns.PluginShutdown,
+		sinkhole.PluginShutdown,
 		sni.PluginShutdown,
 		stats.PluginShutdown,
 		reporter.PluginShutdown}
@@ -347,41 +358,17 @@ func handleSignals() {
 
 // insert the netfilter queue rules for packetd
 func insertRules() {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		logger.Err("Error determining directory: %s\n", err.Error())
-		return
-	}
-	home, ok := os.LookupEnv("PACKETD_HOME")
-	if ok && home != "" {
-		dir = home
-	}
-	output, err := exec.Command(dir+"/"+rulesScript, queueRange).CombinedOutput()
+	err := rules.InsertRules(2000, uint16(cpuCount))
 	if err != nil {
-		logger.Warn("Error running %v: %v\n", rulesScript, err.Error())
+		logger.Err("Failed to insert rules: %s\n", err.Error())
 		kernel.SetShutdownFlag()
-	} else {
-		for _, line := range strings.Split(string(output), "\n") {
-			if line != "" {
-				logger.Info("%s\n", line)
-			}
-		}
 	}
 }
 
 // remove the netfilter queue rules for packetd
 func removeRules() {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		logger.Err("Error determining directory: %s\n", err.Error())
-		return
-	}
-	home, ok := os.LookupEnv("PACKETD_HOME")
-	if ok && home != "" {
-		dir = home
-	}
 	logger.Info("Removing netfilter rules...\n")
-	err = exec.Command(dir+"/"+rulesScript, "-r", queueRange).Run()
+	err := rules.RemoveRules()
 	if err != nil {
 		logger.Err("Failed to remove rules: %s\n", err.Error())
 	}
@@ -439,13 +426,6 @@ func getProcStats() (string, error) {
 	return interesting, nil
 }
 
-// getQueueRange gets the nfqueue specification
-func getQueueRange() string {
-	str := "2000"
-	str = str + "-" + strconv.Itoa(2000+cpuCount)
-	return str
-}
-
 // load all packetd requirements
 func loadRequirements() {
 	err := exec.Command("modprobe", "nf_conntrack").Run()
@@ -1,5 +1,7 @@
 module github.com/untangle/packetd
 
+go 1.18
+
 require (
 	github.com/GehirnInc/crypt v0.0.0-20190301055215-6c0105aabd46
 	github.com/c9s/goprocinfo v0.0.0-20190309065803-0b2ad9ac246b
@@ -8,8 +10,34 @@ require (
 	github.com/gin-gonic/contrib v0.0.0-20190302003538-54ff787f7c73
 	github.com/gin-gonic/gin v1.3.1-0.20190321071206-1d462bbe3713
 	github.com/google/gopacket v1.1.16
+	github.com/google/nftables v0.0.0-20220808154552-2eca00135732
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/oschwald/geoip2-golang v1.2.1
+	golang.org/x/net v0.1.0
+	golang.org/x/sys v0.1.0
+)
+
+require (
+	github.com/BurntSushi/toml v0.4.1 // indirect
+	github.com/gin-contrib/sse v0.0.0-20190301062529-5545eab6dad3 // indirect
+	github.com/golang/protobuf v1.3.0 // indirect
+	github.com/google/go-cmp v0.5.6 // indirect
+	github.com/gorilla/context v1.1.1 // indirect
+	github.com/gorilla/securecookie v1.1.1 // indirect
+	github.com/gorilla/sessions v1.1.3 // indirect
+	github.com/josharian/native v0.0.0-20200817173448-b6b71def0850 // indirect
+	github.com/json-iterator/go v1.1.5 // indirect
+	github.com/mattn/go-isatty v0.0.6 // indirect
+	github.com/mdlayher/netlink v1.4.2 // indirect
+	github.com/mdlayher/socket v0.0.0-20211102153432-57e3fa563ecb // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/oschwald/maxminddb-golang v1.3.0 // indirect
-	golang.org/x/net v0.0.0-20190320064053-1272bf9dcd53
+	github.com/ugorji/go/codec v0.0.0-20190204201341-e444a5086c43 // indirect
+	golang.org/x/mod v0.5.1 // indirect
+	golang.org/x/tools v0.1.8 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+	honnef.co/go/tools v0.2.2 // indirect
 )
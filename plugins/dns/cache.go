@@ -0,0 +1,311 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// The address cache maps the addresses in DNS responses to the names the client
+// queried. Each address keeps up to cacheMaxNames names with the most recently
+// seen first, and each name expires when the TTL from the response runs out.
+// The cache holds at most cacheMaxAddresses addresses, evicting the least
+// recently updated address when it is full.
+
+const cacheMaxAddresses = 65536
+const cacheMaxNames = 8
+
+// the TTL is clamped so names are kept long enough for the client to connect
+// but not forever when a server returns a huge TTL
+const cacheMinTTL = 30
+const cacheMaxTTL = 86400
+
+// the longest CNAME chain we will follow
+const cacheMaxChain = 16
+
+// AddressHolder is used to cache the DNS names for an IP address
+type AddressHolder struct {
+	CreationTime time.Time
+	Address      net.IP
+	Names        []*NameHolder
+	element      *list.Element
+}
+
+// NameHolder is a name for an address and when it expires
+type NameHolder struct {
+	Name       string
+	ExpireTime time.Time
+	LastSeen   time.Time
+}
+
+// CacheStats holds the address cache statistics
+type CacheStats struct {
+	Addresses int    `json:"addresses"`
+	Names     int    `json:"names"`
+	Lookups   uint64 `json:"lookups"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Inserts   uint64 `json:"inserts"`
+	Expired   uint64 `json:"expired"`
+	Evicted   uint64 `json:"evicted"`
+}
+
+// cacheAnswer is an address from a response and the name it belongs to
+type cacheAnswer struct {
+	address net.IP
+	name    string
+	ttl     uint32
+}
+
+var addressTable map[string]*AddressHolder
+var addressList *list.List
+var addressMutex sync.Mutex
+var cacheStats CacheStats
+var publishedStats CacheStats
+
+// resetCache creates an empty address cache
+func resetCache() {
+	addressMutex.Lock()
+	addressTable = make(map[string]*AddressHolder)
+	addressList = list.New()
+	cacheStats = CacheStats{}
+	publishedStats = CacheStats{}
+	addressMutex.Unlock()
+}
+
+// FindAddress fetches the most recently seen name for the argumented address
+func FindAddress(finder net.IP) string {
+	names := FindAddressNames(finder)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// FindAddressNames fetches all the names for the argumented address
+// with the most recently seen first
+func FindAddressNames(finder net.IP) []string {
+	var names []string
+	nowtime := time.Now()
+
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+
+	cacheStats.Lookups++
+	holder := addressTable[finder.String()]
+	if holder != nil {
+		for _, item := range holder.Names {
+			if item.ExpireTime.After(nowtime) {
+				names = append(names, item.Name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		cacheStats.Misses++
+	} else {
+		cacheStats.Hits++
+	}
+	return names
+}
+
+// GetCacheStats returns the address cache statistics
+func GetCacheStats() CacheStats {
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+
+	stats := cacheStats
+	stats.Addresses = len(addressTable)
+	for _, holder := range addressTable {
+		stats.Names += len(holder.Names)
+	}
+	return stats
+}
+
+// insertAddress adds an address and name to the cache or refreshes the name
+// if the address already has it
+func insertAddress(finder net.IP, name string, ttl uint32) {
+	if ttl < cacheMinTTL {
+		ttl = cacheMinTTL
+	}
+	if ttl > cacheMaxTTL {
+		ttl = cacheMaxTTL
+	}
+	nowtime := time.Now()
+	expire := nowtime.Add(time.Second * time.Duration(ttl))
+	key := finder.String()
+
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+
+	cacheStats.Inserts++
+	holder := addressTable[key]
+	if holder == nil {
+		holder = new(AddressHolder)
+		holder.CreationTime = nowtime
+		holder.Address = make(net.IP, len(finder))
+		copy(holder.Address, finder)
+		holder.element = addressList.PushFront(holder)
+		addressTable[key] = holder
+	} else {
+		addressList.MoveToFront(holder.element)
+	}
+
+	// move the name to the front of the list
+	entry := &NameHolder{Name: name}
+	for i, item := range holder.Names {
+		if item.Name == name {
+			entry = item
+			holder.Names = append(holder.Names[:i], holder.Names[i+1:]...)
+			break
+		}
+	}
+	entry.ExpireTime = expire
+	entry.LastSeen = nowtime
+	holder.Names = append([]*NameHolder{entry}, holder.Names...)
+	if len(holder.Names) > cacheMaxNames {
+		holder.Names = holder.Names[:cacheMaxNames]
+	}
+
+	// evict the least recently updated addresses when the cache is full
+	for len(addressTable) > cacheMaxAddresses {
+		oldest := addressList.Back().Value.(*AddressHolder)
+		removeHolder(oldest)
+		cacheStats.Evicted++
+	}
+}
+
+// removeAddress removes an address from the cache
+func removeAddress(finder net.IP) {
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+
+	holder := addressTable[finder.String()]
+	if holder != nil {
+		removeHolder(holder)
+	}
+}
+
+// removeHolder removes an address holder from the table and list
+// You must hold the addressMutex to call this function
+func removeHolder(holder *AddressHolder) {
+	addressList.Remove(holder.element)
+	delete(addressTable, holder.Address.String())
+}
+
+// cleanAddressTable removes the expired names and the addresses that have no names left
+func cleanAddressTable(nowtime time.Time) {
+	var counter int
+
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+
+	for _, holder := range addressTable {
+		names := holder.Names[:0]
+		for _, item := range holder.Names {
+			if item.ExpireTime.After(nowtime) {
+				names = append(names, item)
+				continue
+			}
+			logger.Debug("DNS Removing ADDR:%s NAME:%s from table\n", holder.Address.String(), item.Name)
+			cacheStats.Expired++
+		}
+		holder.Names = names
+		if len(names) == 0 {
+			removeHolder(holder)
+			counter++
+		}
+	}
+
+	logger.Debug("DNS REMOVED:%d REMAINING:%d\n", counter, len(addressTable))
+}
+
+// publishCacheStats adds the changes in the cache statistics since the last call to the overseer
+// counters and sets the address and name counters to the current size of the cache
+func publishCacheStats() {
+	current := GetCacheStats()
+	addressMutex.Lock()
+	last := publishedStats
+	publishedStats = current
+	addressMutex.Unlock()
+
+	overseer.SetCounter("dns_cache_addresses", uint64(current.Addresses))
+	overseer.SetCounter("dns_cache_names", uint64(current.Names))
+	overseer.AddCounter("dns_cache_lookups", current.Lookups-last.Lookups)
+	overseer.AddCounter("dns_cache_inserts", current.Inserts-last.Inserts)
+	overseer.AddCounter("dns_cache_hits", current.Hits-last.Hits)
+	overseer.AddCounter("dns_cache_misses", current.Misses-last.Misses)
+	overseer.AddCounter("dns_cache_expired", current.Expired-last.Expired)
+	overseer.AddCounter("dns_cache_evicted", current.Evicted-last.Evicted)
+}
+
+// resolveAnswers returns the addresses in the answers along with the name the
+// client asked for. The CNAME chain from each queried name is followed to find
+// its addresses and the TTL is the lowest in the chain. Addresses that are not
+// part of a chain from a queried name belong to the name in the record.
+func resolveAnswers(qnames []string, answers []layers.DNSResourceRecord) []cacheAnswer {
+	var result []cacheAnswer
+
+	// the CNAME targets and TTLs by owner name
+	cnames := make(map[string]layers.DNSResourceRecord)
+	for _, val := range answers {
+		if val.Type == layers.DNSTypeCNAME {
+			cnames[canonicalName(string(val.Name))] = val
+		}
+	}
+
+	// the queried name and lowest TTL for every name in each chain
+	type chainLink struct {
+		qname string
+		ttl   uint32
+	}
+	chains := make(map[string]chainLink)
+	for _, qname := range qnames {
+		name := canonicalName(qname)
+		ttl := uint32(cacheMaxTTL)
+		for i := 0; i < cacheMaxChain; i++ {
+			if _, found := chains[name]; found {
+				break
+			}
+			chains[name] = chainLink{qname: strings.TrimSuffix(qname, "."), ttl: ttl}
+			record, found := cnames[name]
+			if !found {
+				break
+			}
+			if record.TTL < ttl {
+				ttl = record.TTL
+			}
+			name = canonicalName(string(record.CNAME))
+		}
+	}
+
+	for _, val := range answers {
+		if (val.Type != layers.DNSTypeA) && (val.Type != layers.DNSTypeAAAA) {
+			continue
+		}
+		owner := string(val.Name)
+		link, found := chains[canonicalName(owner)]
+		if !found {
+			result = append(result, cacheAnswer{address: val.IP, name: strings.TrimSuffix(owner, "."), ttl: val.TTL})
+			continue
+		}
+		ttl := val.TTL
+		if link.ttl < ttl {
+			ttl = link.ttl
+		}
+		result = append(result, cacheAnswer{address: val.IP, name: link.qname, ttl: ttl})
+	}
+
+	return result
+}
+
+// canonicalName returns the name in lower case without a trailing dot
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
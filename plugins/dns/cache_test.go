@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+func TestResolveAnswers(t *testing.T) {
+	answers := []layers.DNSResourceRecord{
+		{Name: []byte("www.example.com"), Type: layers.DNSTypeCNAME, TTL: 3600, CNAME: []byte("www.example.com.cdn.net")},
+		{Name: []byte("www.example.com.cdn.net"), Type: layers.DNSTypeCNAME, TTL: 120, CNAME: []byte("edge1.cdn.net")},
+		{Name: []byte("edge1.cdn.net"), Type: layers.DNSTypeA, TTL: 300, IP: net.ParseIP("192.0.2.1")},
+		{Name: []byte("EDGE1.cdn.net."), Type: layers.DNSTypeA, TTL: 20, IP: net.ParseIP("192.0.2.2")},
+		{Name: []byte("other.net"), Type: layers.DNSTypeA, TTL: 60, IP: net.ParseIP("192.0.2.3")},
+	}
+
+	result := resolveAnswers([]string{"www.example.com"}, answers)
+	if len(result) != 3 {
+		t.Fatalf("resolved %d answers: %v", len(result), result)
+	}
+	expected := []cacheAnswer{
+		{net.ParseIP("192.0.2.1"), "www.example.com", 120},
+		{net.ParseIP("192.0.2.2"), "www.example.com", 20},
+		{net.ParseIP("192.0.2.3"), "other.net", 60},
+	}
+	for i, answer := range expected {
+		if !result[i].address.Equal(answer.address) || result[i].name != answer.name || result[i].ttl != answer.ttl {
+			t.Errorf("answer %d = %v expected %v", i, result[i], answer)
+		}
+	}
+
+	// a CNAME loop must not hang
+	loop := []layers.DNSResourceRecord{
+		{Name: []byte("a.test"), Type: layers.DNSTypeCNAME, TTL: 60, CNAME: []byte("b.test")},
+		{Name: []byte("b.test"), Type: layers.DNSTypeCNAME, TTL: 60, CNAME: []byte("a.test")},
+	}
+	if result := resolveAnswers([]string{"a.test"}, loop); len(result) != 0 {
+		t.Errorf("loop resolved %v", result)
+	}
+}
+
+func TestAddressCache(t *testing.T) {
+	resetCache()
+	address := net.ParseIP("192.0.2.1")
+
+	insertAddress(address, "one.example.com", 300)
+	insertAddress(address, "two.example.com", 0)
+	insertAddress(address, "one.example.com", 300)
+
+	names := FindAddressNames(address)
+	if len(names) != 2 || names[0] != "one.example.com" || names[1] != "two.example.com" {
+		t.Errorf("names %v", names)
+	}
+	if FindAddress(net.ParseIP("192.0.2.99")) != "" {
+		t.Error("found unknown address")
+	}
+
+	// the zero TTL is raised to the minimum and the cleaner honors it
+	cleanAddressTable(time.Now())
+	if len(FindAddressNames(address)) != 2 {
+		t.Error("unexpired names removed")
+	}
+	cleanAddressTable(time.Now().Add((cacheMinTTL + 1) * time.Second))
+	if names := FindAddressNames(address); len(names) != 1 || names[0] != "one.example.com" {
+		t.Errorf("names after expiry %v", names)
+	}
+	cleanAddressTable(time.Now().Add(301 * time.Second))
+	if len(addressTable) != 0 || addressList.Len() != 0 {
+		t.Error("address with no names not removed")
+	}
+
+	for i := 0; i < cacheMaxNames+2; i++ {
+		insertAddress(address, string(rune('a'+i))+".example.com", 300)
+	}
+	if names := FindAddressNames(address); len(names) != cacheMaxNames || names[0] != string(rune('a'+cacheMaxNames+1))+".example.com" {
+		t.Errorf("names not bounded %v", names)
+	}
+
+	stats := GetCacheStats()
+	if stats.Addresses != 1 || stats.Names != cacheMaxNames || stats.Hits != 4 || stats.Misses != 1 || stats.Expired != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	overseer.Startup()
+	publishCacheStats()
+	FindAddress(address)
+	publishCacheStats()
+	if overseer.GetCounter("dns_cache_addresses") != 1 || overseer.GetCounter("dns_cache_names") != cacheMaxNames {
+		t.Errorf("cache size counters %d %d", overseer.GetCounter("dns_cache_addresses"), overseer.GetCounter("dns_cache_names"))
+	}
+	if overseer.GetCounter("dns_cache_lookups") != stats.Lookups+1 || overseer.GetCounter("dns_cache_inserts") != stats.Inserts {
+		t.Errorf("lookup counters %d %d", overseer.GetCounter("dns_cache_lookups"), overseer.GetCounter("dns_cache_inserts"))
+	}
+}
+
+func TestAddressCacheEviction(t *testing.T) {
+	resetCache()
+
+	first := net.IPv4(10, 0, 0, 0)
+	insertAddress(first, "first.example.com", 300)
+	for i := 1; i <= cacheMaxAddresses; i++ {
+		insertAddress(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), "example.com", 300)
+	}
+
+	if len(addressTable) != cacheMaxAddresses || addressList.Len() != cacheMaxAddresses {
+		t.Errorf("cache size %d %d", len(addressTable), addressList.Len())
+	}
+	if FindAddress(first) != "" {
+		t.Error("oldest address not evicted")
+	}
+	if GetCacheStats().Evicted != 1 {
+		t.Errorf("evicted %d", GetCacheStats().Evicted)
+	}
+}
@@ -1,37 +1,27 @@
 package dns
 
 import (
-	"net"
-	"sync"
 	"time"
 
 	"github.com/google/gopacket/layers"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/domain"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "dns"
-
-// AddressHolder is used to cache DNS names and IP addresses
-type AddressHolder struct {
-	CreationTime time.Time
-	ExpireTime   time.Time
-	Address      net.IP
-	Name         string
-}
+const dnsPort = 53
 
 var shutdownChannel = make(chan bool)
-var addressTable map[string]*AddressHolder
-var addressMutex sync.Mutex
 
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	addressTable = make(map[string]*AddressHolder)
+	resetCache()
 	go cleanupTask()
 	dispatch.InsertNfqueueSubscription(pluginName, dispatch.DNSPriority, PluginNfqueueHandler)
 }
@@ -52,7 +42,8 @@ func PluginShutdown() {
 }
 
 // PluginNfqueueHandler is called to handle nfqueue packet data. We only
-// look at DNS packets, extracting the QNAME and putting it in the session table.
+// look at DNS packets over UDP and TCP, logging each query and response and
+// putting the addresses from the response in the address table.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	var result dispatch.NfqueueResult
 	result.SessionRelease = true
@@ -67,21 +58,31 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		var clientHint string
 		var serverHint string
 
+		batch := dict.NewSessionBatch(mess.Session.GetConntrackID())
 		clientHint = FindAddress(mess.MsgTuple.ClientAddress)
 		if len(clientHint) > 0 {
 			logger.Debug("Setting client_dns_hint name:%s addr:%v ctid:%d\n", clientHint, mess.MsgTuple.ClientAddress, ctid)
-			dict.AddSessionEntry(mess.Session.GetConntrackID(), "client_dns_hint", clientHint)
+			batch.Add("client_dns_hint", clientHint)
 			mess.Session.PutAttachment("client_dns_hint", clientHint)
 		}
 
 		serverHint = FindAddress(mess.MsgTuple.ServerAddress)
 		if len(serverHint) > 0 {
 			logger.Debug("Setting server_dns_hint name:%s addr:%v ctid:%d\n", serverHint, mess.MsgTuple.ServerAddress, ctid)
-			dict.AddSessionEntry(mess.Session.GetConntrackID(), "server_dns_hint", serverHint)
+			batch.Add("server_dns_hint", serverHint)
 			mess.Session.PutAttachment("server_dns_hint", serverHint)
 		}
+		batch.Commit()
 
 		logEvent(mess.Session, clientHint, serverHint)
+		if len(serverHint) > 0 {
+			domain.UpdateSession(mess.Session, domain.SourceDNSHint, serverHint)
+		}
+	}
+
+	// DNS over TCP needs the messages collected from the stream
+	if mess.TCPLayer != nil {
+		return handleStream(mess, ctid)
 	}
 
 	// get the DNS layer
@@ -91,119 +92,117 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	}
 
 	dns := dnsLayer.(*layers.DNS)
-	logger.Trace("DNS LAYER ID:%d QR:%v OC:%d QD:%d AN:%d NS:%d AR:%d ctid:%d\n", dns.ID, dns.QR, dns.OpCode, dns.QDCount, dns.ANCount, dns.NSCount, dns.ARCount, ctid)
-
-	// The QR flag will be false for a query, true for a response
-	if dns.QR == false {
-		// make sure there is at least one question record
-		if dns.QDCount < 1 {
-			return result
-		}
+	isQuery, remaining := handleMessage(mess.Session, dns, ctid)
 
-		// use the first question record
-		query := dns.Questions[0]
+	// turn off the release flag for a query so we get the response and keep
+	// the session until all the queries have a response
+	if isQuery || remaining != 0 {
+		result.SessionRelease = false
+	}
 
-		// ignore requests for other than A and AAAA records
-		if (query.Type != layers.DNSTypeA) && (query.Type != layers.DNSTypeAAAA) {
-			return result
-		}
+	// use the channel to return our result
+	return result
+}
 
-		logger.Debug("DNS QUERY DETECTED NAME:%s TYPE:%d CLASS:%d ctid:%d\n", query.Name, query.Type, query.Class, ctid)
+// handleStream handles the packets of a DNS over TCP session. The session is
+// released once a response has answered every query or we are unable to follow
+// the stream. Sessions that are not on the DNS port are released immediately.
+func handleStream(mess dispatch.NfqueueMessage, ctid uint32) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
 
-		// save the qname in the session attachments and turn off release flag so we get the response
-		mess.Session.PutAttachment("dns_query", string(query.Name))
-		result.SessionRelease = false
-	} else {
-		qname := mess.Session.GetAttachment("dns_query")
+	if mess.MsgTuple.ServerPort != dnsPort && mess.MsgTuple.ClientPort != dnsPort {
+		return result
+	}
 
-		// make sure we have the query name
-		if qname == nil {
-			return result
-		}
+	messages, ok := addTCPPacket(mess)
+	if !ok || mess.Session.GetPacketCount() > maxStreamPackets {
+		logger.Debug("DNS giving up on TCP stream ctid:%d\n", ctid)
+		mess.Session.DeleteAttachment("dns_tcp_stream")
+		return result
+	}
 
-		// make sure there is at least one answer record
-		if dns.ANCount < 1 {
-			return result
+	result.SessionRelease = false
+	for _, data := range messages {
+		dns, err := decodeMessage(data)
+		if err != nil {
+			logger.Debug("DNS failed to decode TCP message: %v ctid:%d\n", err, ctid)
+			continue
 		}
-
-		for _, val := range dns.Answers {
-			if (val.Type != layers.DNSTypeA) && (val.Type != layers.DNSTypeAAAA) {
-				continue
-			}
-			logger.Debug("DNS REPLY DETECTED NAME:%s TTL:%d IP:%v ctid:%d\n", qname, val.TTL, val.IP, ctid)
-			insertAddress(val.IP, qname.(string), val.TTL)
+		isQuery, remaining := handleMessage(mess.Session, dns, ctid)
+		if !isQuery && remaining == 0 {
+			result.SessionRelease = true
 		}
 	}
 
-	// use the channel to return our result
+	if result.SessionRelease {
+		mess.Session.DeleteAttachment("dns_tcp_stream")
+	}
 	return result
 }
 
-// FindAddress fetches the cached name for the argumented address.
-func FindAddress(finder net.IP) string {
-	addressMutex.Lock()
-	entry := addressTable[finder.String()]
-	addressMutex.Unlock()
-	if entry != nil {
-		return entry.Name
-	}
-	return ""
-}
+// handleMessage logs a DNS query or response and puts the addresses from a
+// response in the address table. It returns true for a query, and for a
+// response the number of queries on the session still waiting for a response.
+func handleMessage(session *dispatch.Session, dns *layers.DNS, ctid uint32) (bool, int) {
+	logger.Trace("DNS LAYER ID:%d QR:%v OC:%d TC:%v QD:%d AN:%d NS:%d AR:%d ctid:%d\n", dns.ID, dns.QR, dns.OpCode, dns.TC, dns.QDCount, dns.ANCount, dns.NSCount, dns.ARCount, ctid)
 
-// insertAddress adds an address and name to the cache
-func insertAddress(finder net.IP, name string, ttl uint32) {
-	holder := new(AddressHolder)
-	holder.CreationTime = time.Now()
-	holder.ExpireTime = time.Now()
-	holder.ExpireTime.Add(time.Second * time.Duration(ttl))
-	holder.Address = make(net.IP, len(finder))
-	copy(holder.Address, finder)
-	holder.Name = name
-	addressMutex.Lock()
-	if addressTable[finder.String()] != nil {
-		delete(addressTable, finder.String())
-	}
-	addressTable[finder.String()] = holder
-	addressMutex.Unlock()
-}
+	// The QR flag will be false for a query, true for a response
+	if dns.QR == false {
+		// make sure there is at least one question record
+		if dns.QDCount < 1 {
+			return false, 0
+		}
 
-// removeAddress removes an address from the cache
-func removeAddress(finder net.IP) {
-	addressMutex.Lock()
-	delete(addressTable, finder.String())
-	addressMutex.Unlock()
-}
+		// use the first question record
+		query := dns.Questions[0]
 
-// cleanAddressTable cleans the address table by removing stale entries
-func cleanAddressTable() {
-	var counter int
-	nowtime := time.Now()
+		logger.Debug("DNS QUERY DETECTED NAME:%s TYPE:%d CLASS:%d ctid:%d\n", query.Name, query.Type, query.Class, ctid)
 
-	addressMutex.Lock()
-	defer addressMutex.Unlock()
+		// save the query so we can match the response
+		addPendingQuery(session, dns)
+		return true, 0
+	}
 
-	for key, val := range addressTable {
-		if val.ExpireTime.Unix() < nowtime.Unix() {
-			logger.Debug("DNS Leaving ADDR:%s in table\n", key)
-			continue
-		}
-		logger.Debug("DNS Removing ADDR:%s NAME:%s from table\n", val.Address.String(), val.Name)
-		delete(addressTable, val.Address.String())
-		counter++
+	query, remaining := takePendingQuery(session, dns.ID)
+	logDNSEvent(session, query, dns, time.Now())
+
+	// the response has the questions but use the query name if it does not
+	var qnames []string
+	for _, question := range dns.Questions {
+		qnames = append(qnames, string(question.Name))
+	}
+	if len(qnames) == 0 && query != nil {
+		qnames = append(qnames, query.name)
 	}
 
-	logger.Debug("DNS REMOVED:%d REMAINING:%d\n", counter, len(addressTable))
+	for _, answer := range resolveAnswers(qnames, dns.Answers) {
+		logger.Debug("DNS REPLY DETECTED NAME:%s TTL:%d IP:%v ctid:%d\n", answer.name, answer.ttl, answer.address, ctid)
+		insertAddress(answer.address, answer.name, answer.ttl)
+	}
+
+	return false, remaining
 }
 
 // periodic task to clean the address table
+// the pending queries are checked more often so unanswered queries are logged
+// and removed soon after they time out
 func cleanupTask() {
+	cleanTicker := time.NewTicker(60 * time.Second)
+	pendingTicker := time.NewTicker(dnsQueryTimeout)
+	defer cleanTicker.Stop()
+	defer pendingTicker.Stop()
+
 	for {
 		select {
 		case <-shutdownChannel:
 			shutdownChannel <- true
 			return
-		case <-time.After(60 * time.Second):
-			cleanAddressTable()
+		case <-pendingTicker.C:
+			expirePendingQueries(time.Now())
+		case <-cleanTicker.C:
+			cleanAddressTable(time.Now())
+			publishCacheStats()
 		}
 	}
 }
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// EDNS0 (RFC 6891) adds an OPT pseudo record to the additional section. The
+// class holds the largest UDP payload the sender can handle and the TTL holds
+// the upper eight bits of the response code along with the version and flags.
+// The decoder does not know the OPT type but leaves the class and TTL alone.
+
+const dnsTypeOPT = layers.DNSType(41)
+const ednsFlagDO = 0x8000
+
+// ednsInfo holds the EDNS0 values from the OPT record of a message
+type ednsInfo struct {
+	present  bool
+	udpSize  uint16
+	rcode    uint8
+	version  uint8
+	dnssecOK bool
+}
+
+// findEDNS returns the EDNS0 values from the message
+func findEDNS(dns *layers.DNS) ednsInfo {
+	var info ednsInfo
+
+	for _, val := range dns.Additionals {
+		if val.Type != dnsTypeOPT {
+			continue
+		}
+		info.present = true
+		info.udpSize = uint16(val.Class)
+		info.rcode = uint8(val.TTL >> 24)
+		info.version = uint8(val.TTL >> 16)
+		info.dnssecOK = (val.TTL & ednsFlagDO) != 0
+		break
+	}
+
+	return info
+}
+
+// responseCode returns the full response code of the message including
+// the upper bits from the OPT record
+func responseCode(dns *layers.DNS) int {
+	info := findEDNS(dns)
+	return int(info.rcode)<<4 | int(dns.ResponseCode)
+}
+
+// decodeMessage decodes a DNS message that did not come from the packet decoder
+func decodeMessage(data []byte) (*layers.DNS, error) {
+	dns := new(layers.DNS)
+	err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		return nil, err
+	}
+	return dns, nil
+}
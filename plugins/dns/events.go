@@ -0,0 +1,203 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// Every DNS query is logged to the dns_events table along with the response.
+// Queries are held in the pending table until the response with the same ID
+// arrives on the session. Queries that never get a response are logged as
+// unanswered by the cleanup task once they are older than dnsQueryTimeout.
+// The table is limited per session and in total so a client flooding queries
+// that never get answered can not grow it without bound. Queries over the limit
+// are not tracked and their responses are logged without the query.
+
+// dnsQueryTimeout is how long we wait for a response before a query is unanswered
+const dnsQueryTimeout = 10 * time.Second
+
+// maxPendingPerSession is the most queries we track for a single session
+const maxPendingPerSession = 256
+
+// maxPendingQueries is the most queries we track for all sessions
+const maxPendingQueries = 16384
+
+// pendingKey identifies a query by the session and the DNS message ID
+type pendingKey struct {
+	sessionID uint64
+	id        uint16
+}
+
+// pendingQuery is a query that is waiting for the response
+type pendingQuery struct {
+	created time.Time
+	session *dispatch.Session
+	name    string
+	qtype   layers.DNSType
+	udpSize uint16
+}
+
+var pendingTable = make(map[pendingKey]*pendingQuery)
+var pendingCount = make(map[uint64]int)
+var pendingMutex sync.Mutex
+
+// the standard names for the response codes
+var rcodeNames = map[int]string{
+	int(layers.DNSResponseCodeNoErr):    "NOERROR",
+	int(layers.DNSResponseCodeFormErr):  "FORMERR",
+	int(layers.DNSResponseCodeServFail): "SERVFAIL",
+	int(layers.DNSResponseCodeNXDomain): "NXDOMAIN",
+	int(layers.DNSResponseCodeNotImp):   "NOTIMP",
+	int(layers.DNSResponseCodeRefused):  "REFUSED",
+	int(layers.DNSResponseCodeBadVers):  "BADVERS",
+}
+
+// addPendingQuery adds a query to the pending table
+func addPendingQuery(session *dispatch.Session, dns *layers.DNS) {
+	query := &pendingQuery{
+		created: time.Now(),
+		session: session,
+		name:    string(dns.Questions[0].Name),
+		qtype:   dns.Questions[0].Type,
+		udpSize: findEDNS(dns).udpSize,
+	}
+	key := pendingKey{sessionID: session.GetSessionID(), id: dns.ID}
+
+	pendingMutex.Lock()
+	if pendingTable[key] == nil {
+		if pendingCount[key.sessionID] >= maxPendingPerSession || len(pendingTable) >= maxPendingQueries {
+			pendingMutex.Unlock()
+			dropped := overseer.AddCounter("dns_pending_dropped", 1)
+			if dropped == 1 || dropped%1000 == 0 {
+				logger.Warn("DNS pending query limit reached, %d queries not tracked\n", dropped)
+			}
+			return
+		}
+		pendingCount[key.sessionID]++
+	}
+	pendingTable[key] = query
+	pendingMutex.Unlock()
+}
+
+// takePendingQuery removes and returns the query for a response along with
+// the number of queries still waiting for a response on the session
+func takePendingQuery(session *dispatch.Session, id uint16) (*pendingQuery, int) {
+	key := pendingKey{sessionID: session.GetSessionID(), id: id}
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	query := pendingTable[key]
+	if query != nil {
+		removePending(key)
+	}
+	return query, pendingCount[key.sessionID]
+}
+
+// removePending removes a query from the pending table
+// You must hold the pendingMutex to call this function
+func removePending(key pendingKey) {
+	delete(pendingTable, key)
+	pendingCount[key.sessionID]--
+	if pendingCount[key.sessionID] <= 0 {
+		delete(pendingCount, key.sessionID)
+	}
+}
+
+// expirePendingQueries logs and removes the queries that have not had a response
+func expirePendingQueries(now time.Time) {
+	var expired []*pendingQuery
+
+	pendingMutex.Lock()
+	for key, query := range pendingTable {
+		if now.Sub(query.created) < dnsQueryTimeout {
+			continue
+		}
+		expired = append(expired, query)
+		removePending(key)
+	}
+	pendingMutex.Unlock()
+
+	for _, query := range expired {
+		logDNSEvent(query.session, query, nil, now)
+	}
+	if len(expired) != 0 {
+		logger.Debug("DNS logged %d unanswered queries\n", len(expired))
+	}
+}
+
+// logDNSEvent logs a dns_event for a query and response
+// The query is nil if we missed it and the response is nil if there was none
+func logDNSEvent(session *dispatch.Session, query *pendingQuery, response *layers.DNS, now time.Time) {
+	tuple := session.GetClientSideTuple()
+	columns := map[string]interface{}{
+		"time_stamp":       now,
+		"session_id":       session.GetSessionID(),
+		"ip_protocol":      tuple.Protocol,
+		"client_address":   tuple.ClientAddress.String(),
+		"client_port":      tuple.ClientPort,
+		"resolver_address": tuple.ServerAddress.String(),
+		"resolver_port":    tuple.ServerPort,
+	}
+
+	if query != nil {
+		columns["time_stamp"] = query.created
+		columns["qname"] = query.name
+		columns["qtype"] = query.qtype.String()
+		if query.udpSize != 0 {
+			columns["edns_udp_size"] = query.udpSize
+		}
+	} else if len(response.Questions) > 0 {
+		columns["qname"] = string(response.Questions[0].Name)
+		columns["qtype"] = response.Questions[0].Type.String()
+	}
+
+	if response != nil {
+		columns["query_id"] = response.ID
+		columns["rcode"] = rcodeName(responseCode(response))
+		columns["truncated"] = response.TC
+		columns["answer_count"] = len(response.Answers)
+		columns["answers"] = answersString(response.Answers)
+		if query != nil {
+			columns["latency"] = float64(now.Sub(query.created)) / float64(time.Millisecond)
+		}
+	}
+
+	reports.LogEvent(reports.CreateEvent("dns_event", "dns_events", 1, columns, nil))
+}
+
+// rcodeName returns the standard name of a response code
+func rcodeName(rcode int) string {
+	name, ok := rcodeNames[rcode]
+	if ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// answersString returns the type, value and TTL of the A, AAAA and CNAME
+// answers separated by "|" and the type and TTL of any other answers
+func answersString(answers []layers.DNSResourceRecord) string {
+	var list []string
+
+	for _, val := range answers {
+		switch val.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			list = append(list, val.Type.String()+" "+val.IP.String()+" "+strconv.FormatUint(uint64(val.TTL), 10))
+		case layers.DNSTypeCNAME:
+			list = append(list, val.Type.String()+" "+string(val.CNAME)+" "+strconv.FormatUint(uint64(val.TTL), 10))
+		default:
+			list = append(list, val.Type.String()+" "+strconv.FormatUint(uint64(val.TTL), 10))
+		}
+	}
+
+	return strings.Join(list, "|")
+}
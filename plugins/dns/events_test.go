@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+func TestAnswersString(t *testing.T) {
+	answers := []layers.DNSResourceRecord{
+		{Type: layers.DNSTypeCNAME, TTL: 60, CNAME: []byte("www.example.com.edgekey.net")},
+		{Type: layers.DNSTypeA, TTL: 300, IP: net.ParseIP("93.184.216.34")},
+		{Type: layers.DNSTypeAAAA, TTL: 300, IP: net.ParseIP("2606:2800:220:1::248")},
+		{Type: layers.DNSTypeTXT, TTL: 10},
+	}
+
+	expected := "CNAME www.example.com.edgekey.net 60|A 93.184.216.34 300|AAAA 2606:2800:220:1::248 300|TXT 10"
+	if str := answersString(answers); str != expected {
+		t.Errorf("answersString = %q", str)
+	}
+	if str := answersString(nil); str != "" {
+		t.Errorf("answersString(nil) = %q", str)
+	}
+}
+
+func TestRcodeName(t *testing.T) {
+	if rcodeName(int(layers.DNSResponseCodeNXDomain)) != "NXDOMAIN" || rcodeName(int(layers.DNSResponseCodeNoErr)) != "NOERROR" {
+		t.Error("wrong standard rcode name")
+	}
+	if rcodeName(16) != "BADVERS" {
+		t.Errorf("rcodeName(16) = %s", rcodeName(16))
+	}
+	if rcodeName(23) != "RCODE23" {
+		t.Errorf("rcodeName(23) = %s", rcodeName(23))
+	}
+}
+
+func TestPendingQueries(t *testing.T) {
+	session := new(dispatch.Session)
+	session.SetSessionID(1234)
+	query := &layers.DNS{ID: 1, Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA}}}
+	addPendingQuery(session, query)
+	query.ID = 2
+	addPendingQuery(session, query)
+
+	pending, remaining := takePendingQuery(session, 1)
+	if pending == nil || pending.name != "example.com" || remaining != 1 {
+		t.Fatalf("first response: %v %d", pending, remaining)
+	}
+	if pending, _ = takePendingQuery(session, 1); pending != nil {
+		t.Error("query answered twice")
+	}
+
+	expirePendingQueries(time.Now())
+	if len(pendingTable) != 1 {
+		t.Error("recent query expired")
+	}
+	expirePendingQueries(time.Now().Add(dnsQueryTimeout))
+	if len(pendingTable) != 0 || len(pendingCount) != 0 {
+		t.Errorf("unanswered query not expired: %v %v", pendingTable, pendingCount)
+	}
+}
+
+func TestPendingLimits(t *testing.T) {
+	overseer.Startup()
+	defer func() {
+		pendingTable = make(map[pendingKey]*pendingQuery)
+		pendingCount = make(map[uint64]int)
+	}()
+
+	session := new(dispatch.Session)
+	session.SetSessionID(1)
+	query := &layers.DNS{Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA}}}
+	for i := 0; i < maxPendingPerSession+10; i++ {
+		query.ID = uint16(i)
+		addPendingQuery(session, query)
+	}
+	if pendingCount[1] != maxPendingPerSession || len(pendingTable) != maxPendingPerSession {
+		t.Fatalf("session limit not applied: %d %d", pendingCount[1], len(pendingTable))
+	}
+	if dropped := overseer.GetCounter("dns_pending_dropped"); dropped != 10 {
+		t.Errorf("dropped counter = %d", dropped)
+	}
+
+	// a query that is already pending can still be replaced
+	query.ID = 0
+	addPendingQuery(session, query)
+	if pendingCount[1] != maxPendingPerSession {
+		t.Errorf("replaced query counted twice: %d", pendingCount[1])
+	}
+
+	for id := uint64(2); len(pendingTable) < maxPendingQueries+10; id++ {
+		other := new(dispatch.Session)
+		other.SetSessionID(id)
+		addPendingQuery(other, query)
+		if id > maxPendingQueries*2 {
+			break
+		}
+	}
+	if len(pendingTable) != maxPendingQueries {
+		t.Errorf("total limit not applied: %d", len(pendingTable))
+	}
+}
+
+func TestEDNS(t *testing.T) {
+	// a response with an OPT record advertising 1232 bytes, DO set and
+	// the upper bits of the BADVERS response code
+	data := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 1,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1,
+		0, 0, 41, 0x04, 0xd0, 1, 0, 0x80, 0, 0, 0,
+	}
+
+	dns, err := decodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := findEDNS(dns)
+	if !info.present || info.udpSize != 1232 || !info.dnssecOK || info.version != 0 {
+		t.Errorf("edns %+v", info)
+	}
+	if rcodeName(responseCode(dns)) != "BADVERS" {
+		t.Errorf("response code %d", responseCode(dns))
+	}
+
+	if _, err := decodeMessage(data[:20]); err == nil {
+		t.Error("decoded a short message")
+	}
+}
@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// DNS over TCP puts a two byte length in front of every message and a message
+// can span many segments, or a segment can hold many messages. We collect the
+// payload of each direction in order using the TCP sequence number and split
+// the messages out as soon as they are complete. Segments that arrive early are
+// held until the missing data arrives, and we give up on the stream if too many
+// are waiting since we will never be able to find the message boundaries again.
+
+const maxStreamSegments = 32 // out of order segments held per direction
+const maxStreamPackets = 512 // packets inspected before we give up on the session
+
+// streamCollector reassembles the messages in one direction of a TCP session
+type streamCollector struct {
+	started bool
+	failed  bool
+	next    uint32
+	buffer  []byte
+	pending map[uint32][]byte
+}
+
+// streamPair holds the collectors for both directions of a TCP session
+type streamPair struct {
+	locker sync.Mutex
+	client streamCollector
+	server streamCollector
+}
+
+// addTCPPacket adds the payload of a TCP packet to the collector for the
+// direction of the packet and returns any messages that are now complete
+func addTCPPacket(mess dispatch.NfqueueMessage) ([][]byte, bool) {
+	pair, found := mess.Session.GetAttachment("dns_tcp_stream").(*streamPair)
+	if !found {
+		pair = new(streamPair)
+		mess.Session.PutAttachment("dns_tcp_stream", pair)
+	}
+
+	pair.locker.Lock()
+	defer pair.locker.Unlock()
+
+	collector := &pair.server
+	if mess.ClientToServer {
+		collector = &pair.client
+	}
+
+	if mess.TCPLayer.SYN {
+		collector.start(mess.TCPLayer.Seq + 1)
+		return nil, true
+	}
+
+	messages := collector.addSegment(mess.TCPLayer.Seq, mess.Payload)
+	return messages, !collector.failed
+}
+
+// start sets the sequence number of the first byte of the stream
+func (ME *streamCollector) start(seq uint32) {
+	ME.started = true
+	ME.next = seq
+}
+
+// addSegment adds a segment to the stream and returns the complete messages
+func (ME *streamCollector) addSegment(seq uint32, payload []byte) [][]byte {
+	if ME.failed || len(payload) == 0 {
+		return nil
+	}
+
+	// if we missed the SYN the stream starts with the first data we see
+	if !ME.started {
+		ME.start(seq)
+	}
+
+	if ME.pending == nil {
+		ME.pending = make(map[uint32][]byte)
+	}
+	if len(ME.pending) >= maxStreamSegments {
+		logger.Debug("DNS TCP stream has too many missing segments\n")
+		ME.failed = true
+		ME.buffer = nil
+		ME.pending = nil
+		return nil
+	}
+
+	// the payload belongs to the packet so we keep a copy
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	if len(ME.pending[seq]) < len(data) {
+		ME.pending[seq] = data
+	}
+
+	// move every segment that starts at or before the next sequence number to
+	// the buffer, trimming the data we already have from retransmissions
+	for progress := true; progress; {
+		progress = false
+		for spot, data := range ME.pending {
+			offset := int32(spot - ME.next)
+			if offset > 0 {
+				continue
+			}
+			delete(ME.pending, spot)
+			progress = true
+			if int(-offset) >= len(data) {
+				continue
+			}
+			ME.buffer = append(ME.buffer, data[-offset:]...)
+			ME.next += uint32(len(data) + int(offset))
+		}
+	}
+
+	return ME.extractMessages()
+}
+
+// extractMessages removes and returns the complete messages in the buffer
+func (ME *streamCollector) extractMessages() [][]byte {
+	var messages [][]byte
+
+	for len(ME.buffer) >= 2 {
+		size := int(binary.BigEndian.Uint16(ME.buffer))
+		if len(ME.buffer) < size+2 {
+			break
+		}
+		if size != 0 {
+			messages = append(messages, ME.buffer[2:size+2])
+		}
+		ME.buffer = ME.buffer[size+2:]
+	}
+
+	// start a new buffer when empty so the old one can be collected
+	if len(ME.buffer) == 0 {
+		ME.buffer = nil
+	}
+
+	return messages
+}
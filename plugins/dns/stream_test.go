@@ -0,0 +1,70 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frame puts the two byte length in front of each message
+func frame(messages ...[]byte) []byte {
+	var buffer bytes.Buffer
+	for _, message := range messages {
+		binary.Write(&buffer, binary.BigEndian, uint16(len(message)))
+		buffer.Write(message)
+	}
+	return buffer.Bytes()
+}
+
+func TestStreamFraming(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, 3000)
+	second := []byte("second")
+	third := []byte("third")
+	stream := frame(first, second, third)
+
+	var collector streamCollector
+	collector.start(0xfffffff0)
+	seq := uint32(0xfffffff0)
+
+	// the first message spans three segments with a sequence number wrap
+	if messages := collector.addSegment(seq, stream[:1000]); len(messages) != 0 {
+		t.Fatalf("partial message returned %d", len(messages))
+	}
+	if messages := collector.addSegment(seq+1000, stream[1000:2000]); len(messages) != 0 {
+		t.Fatalf("partial message returned %d", len(messages))
+	}
+
+	// the rest of the stream arrives before the missing segment and
+	// the missing segment is a retransmission overlapping older data
+	end := 3002 + 8 + 4
+	if messages := collector.addSegment(seq+uint32(end), stream[end:]); len(messages) != 0 {
+		t.Fatalf("early segment returned %d", len(messages))
+	}
+	messages := collector.addSegment(seq+500, stream[500:end])
+	if len(messages) != 3 || !bytes.Equal(messages[0], first) || !bytes.Equal(messages[1], second) || !bytes.Equal(messages[2], third) {
+		t.Fatalf("messages %d", len(messages))
+	}
+	if len(collector.buffer) != 0 || len(collector.pending) != 0 || collector.next != seq+uint32(len(stream)) {
+		t.Errorf("stream not consumed: %d %d %d", len(collector.buffer), len(collector.pending), collector.next)
+	}
+
+	// a duplicate segment is ignored
+	if messages := collector.addSegment(seq, stream[:1000]); len(messages) != 0 {
+		t.Errorf("duplicate returned %d", len(messages))
+	}
+}
+
+func TestStreamMissingSegment(t *testing.T) {
+	var collector streamCollector
+	collector.addSegment(100, frame([]byte("query")))
+
+	for i := 0; i <= maxStreamSegments; i++ {
+		collector.addSegment(uint32(1000+i*10), []byte("0123456789"))
+	}
+	if !collector.failed || collector.pending != nil {
+		t.Error("stream with a missing segment not abandoned")
+	}
+	if messages := collector.addSegment(107, []byte("data")); messages != nil {
+		t.Error("abandoned stream returned messages")
+	}
+}
@@ -0,0 +1,186 @@
+package encdns
+
+import (
+	"bufio"
+	_ "embed" // for the default resolver list
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// Clients using encrypted DNS never send a query the dns plugin can see so
+// the sessions they create have no DNS hints. We flag the sessions that carry
+// encrypted DNS so they can be seen and blocked. DNS over TLS and DNS over QUIC
+// use port 853 with TCP and UDP. DNS over HTTPS is normal HTTPS so we match the
+// SNI found by the sni plugin against a list of known resolvers. The resolver
+// list built into the plugin is extended by a local file read at startup.
+
+const pluginName = "encdns"
+const maxPacketCount = 8 // packets to wait for the SNI before giving up
+
+// The encrypted_dns values for each protocol
+const (
+	ProtocolDoT = "DoT"
+	ProtocolDoQ = "DoQ"
+	ProtocolDoH = "DoH"
+)
+
+const encryptedDNSPort = 853
+const httpsPort = 443
+const protoTCP = 6
+const protoUDP = 17
+
+// localResolverFile holds additional DoH resolvers, one name per line
+var localResolverFile = "/etc/config/doh-resolvers.txt"
+
+//go:embed doh-resolvers.txt
+var defaultResolvers string
+
+var resolverTable map[string]bool
+var resolverLock sync.RWMutex
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadResolvers()
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.EncryptedDNSPriority, PluginNfqueueHandler)
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. Sessions to
+// port 853 are flagged right away. For HTTPS sessions we wait for the sni
+// plugin to attach the ssl_sni and check it against the resolver list.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	// Session is over
+	if mess.Packet == nil {
+		return result
+	}
+
+	tuple := mess.Session.GetClientSideTuple()
+	if tuple.ServerPort != encryptedDNSPort && !(tuple.ServerPort == httpsPort && tuple.Protocol == protoTCP) {
+		return result
+	}
+
+	sslSni, _ := mess.Session.GetAttachment("ssl_sni").(string)
+	protocol := classify(tuple.Protocol, tuple.ServerPort, sslSni)
+	if protocol != "" {
+		logger.Debug("Detected encrypted DNS protocol:%s sni:%s ctid:%d\n", protocol, sslSni, ctid)
+		mess.Session.PutAttachment("encrypted_dns", protocol)
+		dict.AddSessionEntry(ctid, "encrypted_dns", protocol)
+		logEvent(mess.Session, protocol)
+		return result
+	}
+
+	// keep HTTPS sessions until the sni plugin has had a chance to find the SNI
+	if tuple.ServerPort == httpsPort && sslSni == "" && mess.Session.GetPacketCount() < maxPacketCount {
+		result.SessionRelease = false
+	}
+
+	return result
+}
+
+// classify returns the encrypted DNS protocol of a session or an empty string
+func classify(protocol uint8, serverPort uint16, sslSni string) string {
+	switch {
+	case serverPort == encryptedDNSPort && protocol == protoTCP:
+		return ProtocolDoT
+	case serverPort == encryptedDNSPort && protocol == protoUDP:
+		return ProtocolDoQ
+	case serverPort == httpsPort && protocol == protoTCP && IsResolver(sslSni):
+		return ProtocolDoH
+	}
+	return ""
+}
+
+// IsResolver returns true if the name or any of its parent domains is a known DoH resolver
+func IsResolver(name string) bool {
+	name = normalize(name)
+	if name == "" {
+		return false
+	}
+
+	resolverLock.RLock()
+	defer resolverLock.RUnlock()
+
+	for {
+		if resolverTable[name] {
+			return true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// loadResolvers loads the default resolver list and the local resolver file
+func loadResolvers() {
+	table := make(map[string]bool)
+	parseResolvers(strings.NewReader(defaultResolvers), table)
+
+	file, err := os.Open(localResolverFile)
+	if err == nil {
+		parseResolvers(file, table)
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		logger.Warn("Failed to load DoH resolvers from %s: %v\n", localResolverFile, err)
+	}
+
+	resolverLock.Lock()
+	resolverTable = table
+	resolverLock.Unlock()
+	logger.Info("Loaded %d DoH resolvers\n", len(table))
+}
+
+// parseResolvers adds the names in a resolver list to the table
+// Blank lines and lines starting with # are ignored
+func parseResolvers(reader io.Reader, table map[string]bool) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		name := normalize(text)
+		if name != "" {
+			table[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warn("Failed to read DoH resolvers: %v\n", err)
+	}
+}
+
+// normalize returns the name in lower case without a trailing dot or a leading wildcard
+func normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimSuffix(name, ".")
+	name = strings.TrimPrefix(name, "*.")
+	return name
+}
+
+// logEvent logs an update event that updates the encrypted_dns column
+func logEvent(session *dispatch.Session, protocol string) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+
+	modifiedColumns := make(map[string]interface{})
+	modifiedColumns["encrypted_dns"] = protocol
+
+	reports.LogEvent(reports.CreateEvent("session_encrypted_dns", "sessions", 2, columns, modifiedColumns))
+}
@@ -0,0 +1,42 @@
+package encdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	saved := localResolverFile
+	localResolverFile = filepath.Join(t.TempDir(), "doh-resolvers.txt")
+	defer func() { localResolverFile = saved }()
+
+	err := os.WriteFile(localResolverFile, []byte("# local resolvers\n\nDoH.Example.NET.\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadResolvers()
+
+	tests := []struct {
+		protocol uint8
+		port     uint16
+		sni      string
+		expected string
+	}{
+		{protoTCP, 853, "", ProtocolDoT},
+		{protoUDP, 853, "", ProtocolDoQ},
+		{protoTCP, 443, "dns.google", ProtocolDoH},
+		{protoTCP, 443, "Mozilla.Cloudflare-DNS.com.", ProtocolDoH},
+		{protoTCP, 443, "doh.example.net", ProtocolDoH},
+		{protoTCP, 443, "www.google.com", ""},
+		{protoTCP, 443, "google", ""},
+		{protoTCP, 443, "", ""},
+		{protoUDP, 443, "dns.google", ""},
+		{protoTCP, 8443, "dns.google", ""},
+	}
+	for _, test := range tests {
+		if result := classify(test.protocol, test.port, test.sni); result != test.expected {
+			t.Errorf("classify(%d, %d, %s) = %q expected %q", test.protocol, test.port, test.sni, result, test.expected)
+		}
+	}
+}
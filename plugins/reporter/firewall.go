@@ -0,0 +1,89 @@
+package reporter
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// firewallPrefix is the rule that logged a packet as encoded in the NFLOG prefix.
+// The prefix is either a JSON object with the fields below or the compact form
+// table:chain:ruleId:action for rules where the JSON would not fit in the 63
+// characters the kernel allows for the prefix.
+type firewallPrefix struct {
+	Table  string `json:"table"`
+	Chain  string `json:"chain"`
+	RuleID *int   `json:"ruleId"`
+	Action string `json:"action"`
+}
+
+// parsePrefix parses the rule details from an NFLOG prefix
+// Any fields that can not be found are left empty
+func parsePrefix(prefix string) firewallPrefix {
+	var result firewallPrefix
+
+	prefix = strings.TrimSpace(prefix)
+	if strings.HasPrefix(prefix, "{") {
+		if json.Unmarshal([]byte(prefix), &result) != nil {
+			return firewallPrefix{}
+		}
+	} else {
+		fields := strings.Split(prefix, ":")
+		if len(fields) != 4 {
+			return result
+		}
+		result.Table = fields[0]
+		result.Chain = fields[1]
+		if ruleID, err := strconv.Atoi(fields[2]); err == nil {
+			result.RuleID = &ruleID
+		}
+		result.Action = fields[3]
+	}
+
+	result.Action = strings.ToUpper(result.Action)
+	return result
+}
+
+// logFirewallEvent logs a firewall_events entry for an NFLOG event
+func logFirewallEvent(netlogger *dispatch.NetloggerMessage) {
+	rule := parsePrefix(netlogger.Prefix)
+
+	columns := map[string]interface{}{
+		"time_stamp":       time.Now(),
+		"prefix":           netlogger.Prefix,
+		"ip_version":       netlogger.Version,
+		"ip_protocol":      netlogger.Protocol,
+		"src_address":      netlogger.SrcAddress,
+		"dst_address":      netlogger.DstAddress,
+		"src_interface_id": netlogger.SrcInterface,
+		"dst_interface_id": netlogger.DstInterface,
+		"mark":             netlogger.Mark,
+	}
+	if rule.Table != "" {
+		columns["rule_table"] = rule.Table
+	}
+	if rule.Chain != "" {
+		columns["rule_chain"] = rule.Chain
+	}
+	if rule.RuleID != nil {
+		columns["rule_id"] = *rule.RuleID
+	}
+	if rule.Action != "" {
+		columns["action"] = rule.Action
+	}
+
+	// ports for TCP, UDP and SCTP and the type for ICMP and ICMPv6
+	switch netlogger.Protocol {
+	case 6, 17, 132:
+		columns["src_port"] = netlogger.SrcPort
+		columns["dst_port"] = netlogger.DstPort
+	case 1, 58:
+		columns["icmp_type"] = netlogger.IcmpType
+	}
+
+	reports.LogEvent(reports.CreateEvent("firewall_event", "firewall_events", 1, columns, nil))
+}
@@ -0,0 +1,31 @@
+package reporter
+
+import "testing"
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		table  string
+		chain  string
+		ruleID int
+		action string
+	}{
+		{`{"type":"rule","table":"filter","chain":"filter-rules-new","ruleId":12,"action":"reject","policy":0}`, "filter", "filter-rules-new", 12, "REJECT"},
+		{"filter:forward:7:DROP", "filter", "forward", 7, "DROP"},
+		{"filter:forward:x:drop", "filter", "forward", -1, "DROP"},
+		{"some other prefix", "", "", -1, ""},
+		{`{"ruleId":`, "", "", -1, ""},
+		{"", "", "", -1, ""},
+	}
+
+	for _, test := range tests {
+		rule := parsePrefix(test.prefix)
+		ruleID := -1
+		if rule.RuleID != nil {
+			ruleID = *rule.RuleID
+		}
+		if rule.Table != test.table || rule.Chain != test.chain || ruleID != test.ruleID || rule.Action != test.action {
+			t.Errorf("parsePrefix(%q) = %+v rule %d", test.prefix, rule, ruleID)
+		}
+	}
+}
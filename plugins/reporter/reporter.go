@@ -20,6 +20,7 @@ func PluginStartup() {
 	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ReporterPriority, PluginNfqueueHandler)
 	dispatch.InsertConntrackSubscription(pluginName, 1, PluginConntrackHandler)
 	dispatch.InsertNetloggerSubscription(pluginName, 1, PluginNetloggerHandler)
+	dispatch.InsertOutcomeSubscription(pluginName, PluginOutcomeHandler)
 }
 
 // PluginShutdown stops the reporter
@@ -48,21 +49,8 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 
 	// this is the first packet so source interface = client interface
 	// we don't know the server interface information yet - nfqueue is prerouting
-	var localAddress net.IP
-	var remoteAddress net.IP
-
-	// if client is on LAN (type 2)
-	if session.GetClientInterfaceType() == 2 {
-		localAddress = session.GetClientSideTuple().ClientAddress
-		// the server may not actually be on a WAN, but we consider it remote if the client is on a LAN
-		remoteAddress = session.GetClientSideTuple().ServerAddress
-	} else {
-		remoteAddress = session.GetClientSideTuple().ClientAddress
-		// the server could in theory be on another WAN (WAN1 -> WAN2 traffic) but it is very unlikely so we consider
-		// the local address to be the server
-		localAddress = session.GetClientSideTuple().ServerAddress
-	}
 	clientSideTuple := session.GetClientSideTuple()
+	localAddress, remoteAddress := localRemoteAddress(session.GetClientInterfaceType(), clientSideTuple)
 	columns := map[string]interface{}{
 		"time_stamp":            time.Now(),
 		"session_id":            session.GetSessionID(),
@@ -75,15 +63,18 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		"server_address":        clientSideTuple.ServerAddress.String(),
 		"client_port":           clientSideTuple.ClientPort,
 		"server_port":           clientSideTuple.ServerPort,
+		"bypassed":              false,
 	}
 	reports.LogEvent(reports.CreateEvent("session_new", "sessions", 1, columns, nil))
+	batch := dict.NewSessionBatch(session.GetConntrackID())
 	for k, v := range columns {
 		session.PutAttachment(k, v)
 		if k == "time_stamp" {
 			continue
 		}
-		dict.AddSessionEntry(session.GetConntrackID(), k, v)
+		batch.Add(k, v)
 	}
+	batch.Commit()
 	return result
 }
 
@@ -113,15 +104,18 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 				"server_interface_type": session.GetServerInterfaceType(),
 			}
 			reports.LogEvent(reports.CreateEvent("session_nat", "sessions", 2, columns, modifiedColumns))
+			batch := dict.NewSessionBatch(session.GetConntrackID())
 			for k, v := range modifiedColumns {
 				session.PutAttachment(k, v)
-				dict.AddSessionEntry(session.GetConntrackID(), k, v)
+				batch.Add(k, v)
 			}
+			batch.Commit()
 
 		} else {
 			// We should not receive a new conntrack event for something that is not in the session table
-			// However it happens on local outbound sessions, we should handle these diffently
-			// FIXME log session_new event (bypassed sessions in NGFW)
+			// However it happens on local outbound sessions and sessions bypassed before the nfqueue
+			// so we log the session from the conntrack entry alone
+			logBypassedSession(entry)
 		}
 	}
 
@@ -130,25 +124,87 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 			doAccounting(entry, session.GetSessionID(), entry.ConntrackID)
 		} else {
 			// Still account for unknown session data
-			doAccounting(entry, 0, entry.ConntrackID)
+			// The session ID is zero if we missed the NEW event
+			doAccounting(entry, entry.SessionID, entry.ConntrackID)
 		}
 	}
 }
 
+// logBypassedSession logs a session_new event for a conntrack entry that never
+// reached the nfqueue. The interfaces come from the connmark and the NAT tuple
+// is already known from the conntrack entry.
+func logBypassedSession(entry *dispatch.Conntrack) {
+	clientSideTuple := entry.ClientSideTuple
+	serverSideTuple := entry.ServerSideTuple
+	clientInterfaceType := uint8((entry.ConnMark & 0x03000000) >> 24)
+	localAddress, remoteAddress := localRemoteAddress(clientInterfaceType, clientSideTuple)
+
+	columns := map[string]interface{}{
+		"time_stamp":            time.Now(),
+		"session_id":            entry.SessionID,
+		"ip_protocol":           clientSideTuple.Protocol,
+		"client_interface_id":   uint8(entry.ConnMark & 0x000000FF),
+		"client_interface_type": clientInterfaceType,
+		"server_interface_id":   uint8((entry.ConnMark & 0x0000FF00) >> 8),
+		"server_interface_type": uint8((entry.ConnMark & 0x0C000000) >> 26),
+		"local_address":         localAddress.String(),
+		"remote_address":        remoteAddress.String(),
+		"client_address":        clientSideTuple.ClientAddress.String(),
+		"server_address":        clientSideTuple.ServerAddress.String(),
+		"client_port":           clientSideTuple.ClientPort,
+		"server_port":           clientSideTuple.ServerPort,
+		"client_address_new":    serverSideTuple.ClientAddress.String(),
+		"server_address_new":    serverSideTuple.ServerAddress.String(),
+		"client_port_new":       serverSideTuple.ClientPort,
+		"server_port_new":       serverSideTuple.ServerPort,
+		"bypassed":              true,
+		"outcome":               dispatch.OutcomeBypassed,
+	}
+	logger.Trace("Logging bypassed session %d %v\n", entry.SessionID, clientSideTuple)
+	reports.LogEvent(reports.CreateEvent("session_new", "sessions", 1, columns, nil))
+}
+
+// localRemoteAddress returns the local and remote address of a session
+// based on the type of the client interface
+func localRemoteAddress(clientInterfaceType uint8, clientSideTuple dispatch.Tuple) (net.IP, net.IP) {
+	// if client is on LAN (type 2)
+	if clientInterfaceType == 2 {
+		// the server may not actually be on a WAN, but we consider it remote if the client is on a LAN
+		return clientSideTuple.ClientAddress, clientSideTuple.ServerAddress
+	}
+	// the server could in theory be on another WAN (WAN1 -> WAN2 traffic) but it is very unlikely so we consider
+	// the local address to be the server
+	return clientSideTuple.ServerAddress, clientSideTuple.ClientAddress
+}
+
+// PluginOutcomeHandler receives the outcome of each session
+// Logs a session_outcome event
+func PluginOutcomeHandler(session *dispatch.Session, outcome string) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		"outcome": outcome,
+	}
+	reports.LogEvent(reports.CreateEvent("session_outcome", "sessions", 2, columns, modifiedColumns))
+}
+
 // PluginNetloggerHandler receives NFLOG events
+// Logs a firewall_event event
 func PluginNetloggerHandler(netlogger *dispatch.NetloggerMessage) {
-	// FIXME
-	// IMPLEMENT ME
+	logFirewallEvent(netlogger)
 }
 
 // doAccounting does the session_minutes accounting
 func doAccounting(entry *dispatch.Conntrack, sessionID uint64, ctid uint32) {
-	dict.AddSessionEntry(ctid, "byte_rate", uint32(entry.TotalByteRate))
-	dict.AddSessionEntry(ctid, "client_byte_rate", uint32(entry.ClientByteRate))
-	dict.AddSessionEntry(ctid, "server_byte_rate", uint32(entry.ServerByteRate))
-	dict.AddSessionEntry(ctid, "packet_rate", uint32(entry.TotalPacketRate))
-	dict.AddSessionEntry(ctid, "client_packet_rate", uint32(entry.ClientPacketRate))
-	dict.AddSessionEntry(ctid, "server_packet_rate", uint32(entry.ServerPacketRate))
+	dict.NewSessionBatch(ctid).
+		Add("byte_rate", uint32(entry.TotalByteRate)).
+		Add("client_byte_rate", uint32(entry.ClientByteRate)).
+		Add("server_byte_rate", uint32(entry.ServerByteRate)).
+		Add("packet_rate", uint32(entry.TotalPacketRate)).
+		Add("client_packet_rate", uint32(entry.ClientPacketRate)).
+		Add("server_packet_rate", uint32(entry.ServerPacketRate)).
+		Commit()
 
 	if entry.TotalByteRate != 0 && entry.ClientByteRate != 0 && entry.ServerByteRate != 0 && entry.TotalPacketRate != 0 && entry.ClientPacketRate != 0 && entry.ServerPacketRate != 0 {
 		columns := map[string]interface{}{
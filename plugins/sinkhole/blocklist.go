@@ -0,0 +1,156 @@
+package sinkhole
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// A blocklist holds the blocked names from hosts files, domain lists and the
+// settings. A hosts file line is an address followed by one or more names and
+// a domain list line is a single name. A name blocks only itself unless it is
+// written as a wildcard like *.example.com which blocks every subdomain.
+
+// hostsNames are the local names found in hosts files that are never blocked
+var hostsNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// blocklist maps the blocked names and wildcard suffixes to the list they came from
+type blocklist struct {
+	exact  map[string]string
+	suffix map[string]string
+}
+
+// newBlocklist creates an empty blocklist
+func newBlocklist() *blocklist {
+	return &blocklist{
+		exact:  make(map[string]string),
+		suffix: make(map[string]string),
+	}
+}
+
+// size returns the number of entries in the blocklist
+func (list *blocklist) size() int {
+	return len(list.exact) + len(list.suffix)
+}
+
+// add adds a name or wildcard to the blocklist and returns false if it is not valid
+func (list *blocklist) add(entry string, source string) bool {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	entry = strings.TrimSuffix(entry, ".")
+
+	wildcard := false
+	if strings.HasPrefix(entry, "*.") {
+		wildcard = true
+		entry = entry[2:]
+	}
+
+	if !validName(entry) {
+		return false
+	}
+
+	if wildcard {
+		list.suffix[entry] = source
+	} else {
+		list.exact[entry] = source
+	}
+	return true
+}
+
+// parse adds the entries from a hosts file or domain list and returns the number added
+// Everything after a # is a comment
+func (list *blocklist) parse(reader io.Reader, source string) int {
+	var total int
+	scanner := bufio.NewScanner(reader)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if spot := strings.IndexByte(text, '#'); spot >= 0 {
+			text = text[:spot]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// hosts file lines start with an address
+		names := fields
+		if net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		} else if len(fields) != 1 {
+			logger.Debug("Ignoring invalid blocklist line %s:%d\n", source, line)
+			continue
+		}
+
+		for _, name := range names {
+			if hostsNames[strings.ToLower(name)] {
+				continue
+			}
+			if list.add(name, source) {
+				total++
+			} else {
+				logger.Debug("Ignoring invalid blocklist name %s in %s:%d\n", name, source, line)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.Warn("Failed to read blocklist %s: %v\n", source, err)
+	}
+	return total
+}
+
+// match returns the list that blocks the name and true, or false if the name is not blocked
+func (list *blocklist) match(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "", false
+	}
+
+	if source, found := list.exact[name]; found {
+		return source, true
+	}
+
+	for {
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return "", false
+		}
+		name = name[dot+1:]
+		if source, found := list.suffix[name]; found {
+			return source, true
+		}
+	}
+}
+
+// validName returns true if the name looks like a domain name
+func validName(name string) bool {
+	if name == "" || len(name) > 253 || name[0] == '.' || strings.Contains(name, "..") {
+		return false
+	}
+	for _, char := range name {
+		switch {
+		case char >= 'a' && char <= 'z':
+		case char >= '0' && char <= '9':
+		case char == '-' || char == '.' || char == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
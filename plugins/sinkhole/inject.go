@@ -0,0 +1,174 @@
+package sinkhole
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// The forged response is sent to the client from the address and port the
+// query was sent to using a raw socket so it looks like it came from the
+// resolver. Locally generated sessions are never queued so we do not see it.
+
+// socketLock protects the raw sockets
+var socketLock sync.Mutex
+var socket4 = -1
+var socket6 = -1
+
+// openSockets opens the raw sockets used to send the forged responses
+func openSockets() error {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	var err error
+	if socket4 < 0 {
+		socket4, err = unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+		if err != nil {
+			socket4 = -1
+			return err
+		}
+	}
+	if socket6 < 0 {
+		socket6, err = unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_RAW)
+		if err != nil {
+			socket6 = -1
+			return err
+		}
+		err = unix.SetsockoptInt(socket6, unix.IPPROTO_IPV6, unix.IPV6_HDRINCL, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSockets closes the raw sockets
+func closeSockets() {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	if socket4 >= 0 {
+		unix.Close(socket4)
+		socket4 = -1
+	}
+	if socket6 >= 0 {
+		unix.Close(socket6)
+		socket6 = -1
+	}
+}
+
+// buildResponse creates the forged response for a blocked query
+func buildResponse(query *layers.DNS, config Config) *layers.DNS {
+	response := &layers.DNS{
+		ID:        query.ID,
+		QR:        true,
+		OpCode:    query.OpCode,
+		RD:        query.RD,
+		RA:        true,
+		Questions: query.Questions,
+	}
+
+	if config.Action != actionSinkhole {
+		response.ResponseCode = layers.DNSResponseCodeNXDomain
+		return response
+	}
+
+	// answer the address queries with the sinkhole addresses and leave
+	// every other query without an answer so the name has no data
+	response.ResponseCode = layers.DNSResponseCodeNoErr
+	for _, question := range query.Questions {
+		var address net.IP
+		switch question.Type {
+		case layers.DNSTypeA:
+			address = net.ParseIP(config.SinkholeAddress).To4()
+		case layers.DNSTypeAAAA:
+			address = net.ParseIP(config.SinkholeAddress6)
+			if address.To4() != nil {
+				address = nil
+			}
+		}
+		if address == nil {
+			continue
+		}
+		response.Answers = append(response.Answers, layers.DNSResourceRecord{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: layers.DNSClassIN,
+			TTL:   config.TTL,
+			IP:    address,
+		})
+	}
+
+	return response
+}
+
+// buildPacket creates the IP and UDP packet that carries the response from the
+// server to the client using the reversed addresses and ports of the query
+func buildPacket(ip4 *layers.IPv4, ip6 *layers.IPv6, udp *layers.UDP, response *layers.DNS) ([]byte, error) {
+	var network gopacket.NetworkLayer
+	var ipLayer gopacket.SerializableLayer
+
+	reply := &layers.UDP{SrcPort: udp.DstPort, DstPort: udp.SrcPort}
+
+	switch {
+	case ip4 != nil:
+		layer := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    ip4.DstIP,
+			DstIP:    ip4.SrcIP,
+		}
+		network, ipLayer = layer, layer
+	case ip6 != nil:
+		layer := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      ip6.DstIP,
+			DstIP:      ip6.SrcIP,
+		}
+		network, ipLayer = layer, layer
+	default:
+		return nil, errors.New("query has no IP layer")
+	}
+
+	err := reply.SetNetworkLayerForChecksum(network)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err = gopacket.SerializeLayers(buffer, options, ipLayer, reply, response)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// sendPacket sends a packet built by buildPacket to the client
+func sendPacket(data []byte, client net.IP) error {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	if address := client.To4(); address != nil {
+		if socket4 < 0 {
+			return errors.New("IPv4 raw socket is not open")
+		}
+		var sockaddr unix.SockaddrInet4
+		copy(sockaddr.Addr[:], address)
+		return unix.Sendto(socket4, data, 0, &sockaddr)
+	}
+
+	if socket6 < 0 {
+		return errors.New("IPv6 raw socket is not open")
+	}
+	var sockaddr unix.SockaddrInet6
+	copy(sockaddr.Addr[:], client.To16())
+	return unix.Sendto(socket6, data, 0, &sockaddr)
+}
@@ -0,0 +1,295 @@
+package sinkhole
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rules"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The sinkhole blocks names for the whole network at the gateway. DNS queries
+// over UDP for a name on one of the blocklists are dropped and we send the
+// client a forged response from the resolver that says the name does not exist
+// or points it at the sinkhole addresses. Every blocked query is logged to the
+// sinkhole_events table. The settings and the blocklist files are checked for
+// changes every minute.
+
+const pluginName = "sinkhole"
+const checkInterval = 60
+const dnsPort = 53
+
+// The actions for a blocked query
+const actionNXDomain = "nxdomain"
+const actionSinkhole = "sinkhole"
+
+// SettingsPath is the location of the sinkhole configuration in the settings
+var SettingsPath = []string{"packetd", "dnsSinkhole"}
+
+// Config holds the sinkhole configuration
+type Config struct {
+	Enabled bool   `json:"enabled"`
+	Action  string `json:"action"`
+	// SinkholeAddress and SinkholeAddress6 answer A and AAAA queries for the sinkhole action
+	SinkholeAddress  string `json:"sinkholeAddress"`
+	SinkholeAddress6 string `json:"sinkholeAddress6"`
+	// TTL is the time to live of the sinkhole answers
+	TTL uint32 `json:"ttl"`
+	// Blocklists are hosts files or domain lists
+	Blocklists []string `json:"blocklists"`
+	// Domains are names and wildcards blocked in addition to the blocklists
+	Domains []string `json:"domains"`
+}
+
+// fileStamp identifies the version of a blocklist file
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+var shutdownChannel = make(chan bool)
+var sinkholeLock sync.RWMutex
+var activeConfig Config
+var activeList = newBlocklist()
+
+// the settings and file versions of the loaded blocklist
+var loadedSettings string
+var loadedFiles map[string]fileStamp
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	err := openSockets()
+	if err != nil {
+		logger.Warn("Failed to open raw sockets, blocked queries will be dropped without a response: %v\n", err)
+	}
+	checkConfig()
+	go reloadTask()
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.SinkholePriority, PluginNfqueueHandler)
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of reloadTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown reloadTask\n")
+	}
+
+	closeSockets()
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. We look at
+// the DNS queries on UDP sessions and drop the queries for blocked names after
+// sending the forged response. Forwarders and stub resolvers often send every
+// query over the same socket so while the sinkhole is enabled we keep DNS
+// sessions for their whole lifetime and the rules keep queueing them past the
+// deep session limit. While it is disabled every session is released. Sessions
+// released before the sinkhole is enabled are checked once the client opens a
+// new socket.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	// Session is over
+	if mess.Packet == nil || mess.UDPLayer == nil {
+		return result
+	}
+
+	sinkholeLock.RLock()
+	config := activeConfig
+	list := activeList
+	sinkholeLock.RUnlock()
+
+	if !config.Enabled || list.size() == 0 {
+		return result
+	}
+
+	// only DNS sessions are kept
+	tuple := mess.Session.GetClientSideTuple()
+	if tuple.ServerPort != dnsPort {
+		return result
+	}
+	result.SessionRelease = false
+
+	dnsLayer := mess.Packet.Layer(layers.LayerTypeDNS)
+	if dnsLayer == nil {
+		return result
+	}
+
+	dns := dnsLayer.(*layers.DNS)
+	if dns.QR || dns.OpCode != layers.DNSOpCodeQuery || len(dns.Questions) == 0 {
+		return result
+	}
+
+	question := dns.Questions[0]
+	source, blocked := list.match(string(question.Name))
+	if !blocked {
+		return result
+	}
+
+	logger.Debug("DNS sinkhole blocked NAME:%s TYPE:%d LIST:%s ctid:%d\n", question.Name, question.Type, source, ctid)
+	result.PacketDrop = true
+
+	response := buildResponse(dns, config)
+	data, err := buildPacket(mess.IP4Layer, mess.IP6Layer, mess.UDPLayer, response)
+	if err == nil {
+		err = sendPacket(data, mess.MsgTuple.ClientAddress)
+	}
+	if err != nil {
+		logger.Warn("Failed to send DNS sinkhole response for %s: %v\n", question.Name, err)
+	}
+
+	logEvent(mess, question, config.Action, source)
+	return result
+}
+
+// defaultConfig returns the configuration used when nothing is in settings
+func defaultConfig() Config {
+	return Config{
+		Enabled: false,
+		Action:  actionNXDomain,
+		TTL:     60,
+	}
+}
+
+// getConfig returns the sinkhole config from settings merged with the defaults
+func getConfig() Config {
+	config := defaultConfig()
+
+	value, err := settings.GetSettings(SettingsPath)
+	if err != nil || value == nil {
+		return config
+	}
+
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		logger.Warn("Invalid DNS sinkhole settings: %v\n", err)
+		return defaultConfig()
+	}
+	if config.Action != actionNXDomain && config.Action != actionSinkhole {
+		logger.Warn("Invalid DNS sinkhole action: %s\n", config.Action)
+		config.Action = actionNXDomain
+	}
+
+	return config
+}
+
+// checkConfig loads the configuration and reloads the blocklist
+// if the settings or any of the blocklist files have changed
+func checkConfig() {
+	config := getConfig()
+	data, _ := json.Marshal(config)
+
+	files := make(map[string]fileStamp)
+	for _, filename := range config.Blocklists {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		files[filename] = fileStamp{modified: info.ModTime(), size: info.Size()}
+	}
+
+	if string(data) == loadedSettings && sameFiles(files, loadedFiles) {
+		return
+	}
+
+	list := loadBlocklist(config)
+
+	sinkholeLock.Lock()
+	activeConfig = config
+	activeList = list
+	sinkholeLock.Unlock()
+
+	loadedSettings = string(data)
+	loadedFiles = files
+	logger.Info("Loaded %d DNS sinkhole entries enabled:%v action:%s\n", list.size(), config.Enabled, config.Action)
+
+	err := rules.SetDeepDNS(config.Enabled && list.size() != 0)
+	if err != nil {
+		logger.Warn("Failed to update the DNS queue rules: %v\n", err)
+	}
+}
+
+// loadBlocklist creates the blocklist from the files and domains in the config
+func loadBlocklist(config Config) *blocklist {
+	list := newBlocklist()
+
+	for _, filename := range config.Blocklists {
+		file, err := os.Open(filename)
+		if err != nil {
+			logger.Warn("Failed to load DNS blocklist %s: %v\n", filename, err)
+			continue
+		}
+		total := list.parse(file, filename)
+		file.Close()
+		logger.Debug("Loaded %d names from DNS blocklist %s\n", total, filename)
+	}
+
+	for _, name := range config.Domains {
+		if !list.add(name, "settings") {
+			logger.Warn("Ignoring invalid DNS sinkhole domain: %s\n", name)
+		}
+	}
+
+	return list
+}
+
+// sameFiles returns true if the file versions are the same
+func sameFiles(one map[string]fileStamp, two map[string]fileStamp) bool {
+	if len(one) != len(two) {
+		return false
+	}
+	for filename, stamp := range one {
+		other, found := two[filename]
+		if !found || !other.modified.Equal(stamp.modified) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// periodic task to reload the configuration and blocklists when they change
+func reloadTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(checkInterval * time.Second):
+			checkConfig()
+		}
+	}
+}
+
+// logEvent logs a sinkhole_event for a blocked query
+func logEvent(mess dispatch.NfqueueMessage, question layers.DNSQuestion, action string, source string) {
+	columns := map[string]interface{}{
+		"time_stamp":       time.Now(),
+		"session_id":       mess.Session.GetSessionID(),
+		"client_address":   mess.MsgTuple.ClientAddress.String(),
+		"client_port":      mess.MsgTuple.ClientPort,
+		"resolver_address": mess.MsgTuple.ServerAddress.String(),
+		"resolver_port":    mess.MsgTuple.ServerPort,
+		"qname":            string(question.Name),
+		"qtype":            question.Type.String(),
+		"action":           action,
+		"blocklist":        source,
+	}
+
+	reports.LogEvent(reports.CreateEvent("sinkhole_event", "sinkhole_events", 1, columns, nil))
+}
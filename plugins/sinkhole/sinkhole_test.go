@@ -0,0 +1,183 @@
+package sinkhole
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dispatch"
+)
+
+const testHosts = `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+::1 ip6-localhost
+0.0.0.0 0.0.0.0
+`
+
+const testDomains = `# domain list
+Telemetry.Example.NET.
+*.doubleclick.test
+not a valid line
+bad/name.test
+`
+
+func TestBlocklist(t *testing.T) {
+	list := newBlocklist()
+	if total := list.parse(strings.NewReader(testHosts), "hosts"); total != 2 {
+		t.Errorf("parsed %d hosts entries", total)
+	}
+	if total := list.parse(strings.NewReader(testDomains), "domains"); total != 2 {
+		t.Errorf("parsed %d domain entries", total)
+	}
+	list.add("blocked.example.org", "settings")
+
+	tests := map[string]string{
+		"ads.example.com":          "hosts",
+		"ADS.example.com.":         "hosts",
+		"tracker.example.com":      "hosts",
+		"telemetry.example.net":    "domains",
+		"ad.doubleclick.test":      "domains",
+		"a.b.doubleclick.test":     "domains",
+		"blocked.example.org":      "settings",
+		"doubleclick.test":         "",
+		"www.ads.example.com":      "",
+		"example.com":              "",
+		"localhost":                "",
+		"sub.blocked.example.org.": "",
+	}
+	for name, expected := range tests {
+		source, blocked := list.match(name)
+		if source != expected || blocked != (expected != "") {
+			t.Errorf("match(%s) = %q %v expected %q", name, source, blocked, expected)
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	query := &layers.DNS{
+		ID:     0x1234,
+		RD:     true,
+		OpCode: layers.DNSOpCodeQuery,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("ads.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+	ip4 := &layers.IPv4{SrcIP: net.ParseIP("192.168.1.10").To4(), DstIP: net.ParseIP("8.8.8.8").To4()}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+
+	config := defaultConfig()
+	data, err := buildPacket(ip4, nil, udp, buildResponse(query, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	if packet.ErrorLayer() != nil {
+		t.Fatal(packet.ErrorLayer().Error())
+	}
+	reply := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	replyUDP := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !reply.SrcIP.Equal(ip4.DstIP) || !reply.DstIP.Equal(ip4.SrcIP) || replyUDP.SrcPort != 53 || replyUDP.DstPort != 40000 {
+		t.Errorf("response not reversed: %v:%d -> %v:%d", reply.SrcIP, replyUDP.SrcPort, reply.DstIP, replyUDP.DstPort)
+	}
+	dns := packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if dns.ID != 0x1234 || !dns.QR || !dns.RD || dns.ResponseCode != layers.DNSResponseCodeNXDomain || len(dns.Answers) != 0 {
+		t.Errorf("NXDOMAIN response %+v", dns)
+	}
+
+	config.Action = actionSinkhole
+	config.SinkholeAddress = "192.168.1.1"
+	ip6 := &layers.IPv6{SrcIP: net.ParseIP("fd00::10"), DstIP: net.ParseIP("fd00::1")}
+	data, err = buildPacket(nil, ip6, udp, buildResponse(query, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+	dns = packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if dns.ResponseCode != layers.DNSResponseCodeNoErr || len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("192.168.1.1")) || dns.Answers[0].TTL != 60 {
+		t.Errorf("sinkhole response %+v", dns)
+	}
+
+	// there is no IPv6 sinkhole address so AAAA queries have no answer
+	query.Questions[0].Type = layers.DNSTypeAAAA
+	response := buildResponse(query, config)
+	if response.ResponseCode != layers.DNSResponseCodeNoErr || len(response.Answers) != 0 {
+		t.Errorf("AAAA response %+v", response)
+	}
+}
+
+// dnsMessage builds an nfqueue message for a DNS packet on the session
+func dnsMessage(t *testing.T, session *dispatch.Session, dns *layers.DNS, clientToServer bool) dispatch.NfqueueMessage {
+	client := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("192.168.1.10").To4(), DstIP: net.ParseIP("8.8.8.8").To4()}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	if !clientToServer {
+		client.SrcIP, client.DstIP = client.DstIP, client.SrcIP
+		udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+	}
+	udp.SetNetworkLayerForChecksum(client)
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, client, udp, dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+
+	var mess dispatch.NfqueueMessage
+	mess.Session = session
+	mess.Packet = packet
+	mess.ClientToServer = clientToServer
+	mess.IP4Layer = packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	mess.UDPLayer = packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	mess.MsgTuple = dispatch.Tuple{Protocol: 17, ClientAddress: mess.IP4Layer.SrcIP, ClientPort: uint16(mess.UDPLayer.SrcPort), ServerAddress: mess.IP4Layer.DstIP, ServerPort: uint16(mess.UDPLayer.DstPort)}
+	return mess
+}
+
+func TestReusedSession(t *testing.T) {
+	list := newBlocklist()
+	list.add("ads.example.com", "settings")
+	config := defaultConfig()
+	config.Enabled = true
+
+	sinkholeLock.Lock()
+	activeConfig = config
+	activeList = list
+	sinkholeLock.Unlock()
+
+	session := new(dispatch.Session)
+	session.SetClientSideTuple(dispatch.Tuple{Protocol: 17, ClientAddress: net.ParseIP("192.168.1.10"), ClientPort: 40000, ServerAddress: net.ParseIP("8.8.8.8"), ServerPort: 53})
+
+	query := func(id uint16, name string) *layers.DNS {
+		return &layers.DNS{ID: id, RD: true, Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+	}
+
+	// an allowed query and its response
+	result := PluginNfqueueHandler(dnsMessage(t, session, query(1, "www.example.com"), true), 1, true)
+	if result.PacketDrop || result.SessionRelease {
+		t.Fatalf("allowed query result %+v", result)
+	}
+	response := query(1, "www.example.com")
+	response.QR = true
+	response.Answers = []layers.DNSResourceRecord{{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP("192.0.2.1").To4()}}
+	result = PluginNfqueueHandler(dnsMessage(t, session, response, false), 1, false)
+	if result.PacketDrop || result.SessionRelease {
+		t.Fatalf("response result %+v", result)
+	}
+
+	// a blocked query on the same session must still be dropped
+	result = PluginNfqueueHandler(dnsMessage(t, session, query(2, "ads.example.com"), true), 1, false)
+	if !result.PacketDrop || result.SessionRelease {
+		t.Errorf("blocked query result %+v", result)
+	}
+
+	// sessions are released while the sinkhole is disabled
+	sinkholeLock.Lock()
+	activeConfig.Enabled = false
+	sinkholeLock.Unlock()
+	result = PluginNfqueueHandler(dnsMessage(t, session, query(3, "ads.example.com"), true), 1, false)
+	if result.PacketDrop || !result.SessionRelease {
+		t.Errorf("disabled result %+v", result)
+	}
+}
@@ -3,6 +3,7 @@ package sni
 import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/domain"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/reports"
 )
@@ -51,7 +52,9 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	if hostname != "" {
 		logger.Debug("Extracted SNI %s ctid:%d\n", hostname, ctid)
 		dict.AddSessionEntry(ctid, "ssl_sni", hostname)
+		mess.Session.PutAttachment("ssl_sni", hostname)
 		logEvent(mess.Session, hostname)
+		domain.UpdateSession(mess.Session, domain.SourceSNI, hostname)
 		result.SessionRelease = true
 		return result
 	}
@@ -0,0 +1,245 @@
+// Package category assigns a category to domain names. The categories come from
+// a local database file with one "domain,category" entry per line along with
+// admin overrides from settings. A domain matches an entry for itself or any of
+// its parent domains and the most specific entry wins. Overrides are checked
+// before the database. The database file is reloaded whenever it changes.
+package category
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const checkInterval = 60
+
+// OverrideSettingsPath is the location of the admin overrides in the settings
+var OverrideSettingsPath = []string{"packetd", "domainCategories"}
+
+// Override is an admin assigned category for a domain and its subdomains
+type Override struct {
+	Domain   string `json:"domain"`
+	Category string `json:"category"`
+}
+
+// databaseFiles are the possible locations of the category database in order of preference
+var databaseFiles = []string{
+	"/etc/config/domain-categories.csv",
+	"/usr/share/untangle/domain-categories.csv",
+}
+
+var shutdownChannel = make(chan bool)
+var categoryLock sync.RWMutex
+var database map[string]string
+var overrides map[string]string
+
+// the file and modification time of the loaded database
+var databaseFile string
+var databaseTime time.Time
+var databaseSize int64
+
+// Startup loads the category database and overrides and starts the reload task
+func Startup() {
+	checkDatabase()
+	LoadOverrides()
+	go reloadTask()
+}
+
+// Shutdown stops the reload task
+func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown category reloadTask\n")
+	}
+}
+
+// Lookup returns the category for the domain or an empty string if not known
+func Lookup(domain string) string {
+	domain = normalize(domain)
+	if domain == "" {
+		return ""
+	}
+
+	categoryLock.RLock()
+	defer categoryLock.RUnlock()
+
+	category := lookupSuffix(overrides, domain)
+	if category == "" {
+		category = lookupSuffix(database, domain)
+	}
+	return category
+}
+
+// LoadOverrides loads the admin overrides from settings
+// It is called at startup and whenever the settings change
+func LoadOverrides() {
+	list, err := GetOverrides()
+	if err != nil {
+		logger.Warn("Failed to load domain category overrides: %v\n", err)
+		return
+	}
+
+	table := make(map[string]string)
+	for _, item := range list {
+		domain := normalize(item.Domain)
+		category := strings.TrimSpace(item.Category)
+		if domain == "" || category == "" {
+			logger.Warn("Ignoring invalid domain category override: %v\n", item)
+			continue
+		}
+		table[domain] = category
+	}
+
+	categoryLock.Lock()
+	overrides = table
+	categoryLock.Unlock()
+	logger.Info("Loaded %d domain category overrides\n", len(table))
+}
+
+// GetOverrides returns the admin overrides from settings
+func GetOverrides() ([]Override, error) {
+	var list []Override
+
+	value, err := settings.GetSettings(OverrideSettingsPath)
+	if err != nil || value == nil {
+		// no overrides configured is not an error
+		return list, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, errors.New("Invalid domain category overrides in settings")
+	}
+
+	return list, nil
+}
+
+// lookupSuffix returns the category of the most specific entry in
+// the table that matches the domain or any of its parent domains
+func lookupSuffix(table map[string]string, domain string) string {
+	for {
+		if category, ok := table[domain]; ok {
+			return category
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return ""
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// normalize returns the domain in lower case without a trailing dot
+// or a leading wildcard
+func normalize(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimSuffix(domain, ".")
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.TrimPrefix(domain, ".")
+	return domain
+}
+
+// checkDatabase loads the category database if the file has changed since it was last loaded
+func checkDatabase() {
+	for _, filename := range databaseFiles {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if filename == databaseFile && info.ModTime().Equal(databaseTime) && info.Size() == databaseSize {
+			return
+		}
+		err = loadDatabase(filename)
+		if err != nil {
+			logger.Warn("Failed to load category database %s: %v\n", filename, err)
+			continue
+		}
+		databaseFile = filename
+		databaseTime = info.ModTime()
+		databaseSize = info.Size()
+		return
+	}
+
+	if databaseFile != "" {
+		logger.Info("Category database %s removed\n", databaseFile)
+		categoryLock.Lock()
+		database = nil
+		categoryLock.Unlock()
+		databaseFile = ""
+	}
+}
+
+// loadDatabase loads the category database from the file
+func loadDatabase(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	table, err := parseDatabase(file)
+	if err != nil {
+		return err
+	}
+
+	categoryLock.Lock()
+	database = table
+	categoryLock.Unlock()
+	logger.Info("Loaded %d domain categories from %s\n", len(table), filename)
+	return nil
+}
+
+// parseDatabase parses the domain,category lines of a category database
+// Blank lines and lines starting with # are ignored
+func parseDatabase(reader io.Reader) (map[string]string, error) {
+	table := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(text, ",", 2)
+		if len(fields) != 2 {
+			logger.Debug("Ignoring invalid category database line %d: %s\n", line, text)
+			continue
+		}
+		domain := normalize(fields[0])
+		category := strings.TrimSpace(fields[1])
+		if domain == "" || category == "" {
+			logger.Debug("Ignoring invalid category database line %d: %s\n", line, text)
+			continue
+		}
+		table[domain] = category
+	}
+
+	return table, scanner.Err()
+}
+
+// periodic task to reload the category database when it changes
+func reloadTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(checkInterval * time.Second):
+			checkDatabase()
+		}
+	}
+}
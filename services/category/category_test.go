@@ -0,0 +1,82 @@
+package category
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDatabase = `# test categories
+example.com, Example Sites
+ads.example.com,Advertising
+*.social.test,Social Networking
+invalid line
+,Missing Domain
+`
+
+func TestLookup(t *testing.T) {
+	table, err := parseDatabase(strings.NewReader(testDatabase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 3 {
+		t.Fatalf("parsed %d entries: %v", len(table), table)
+	}
+
+	categoryLock.Lock()
+	database = table
+	overrides = map[string]string{"news.example.com": "News", "ads.example.com": "Allowed Ads"}
+	categoryLock.Unlock()
+
+	tests := map[string]string{
+		"example.com":           "Example Sites",
+		"WWW.Example.com.":      "Example Sites",
+		"cdn.ads.example.com":   "Allowed Ads",
+		"news.example.com":      "News",
+		"www.social.test":       "Social Networking",
+		"social.test":           "Social Networking",
+		"example.org":           "",
+		"com":                   "",
+		"notexample.com":        "",
+		"deep.www.social.test.": "Social Networking",
+	}
+	for domain, expected := range tests {
+		if category := Lookup(domain); category != expected {
+			t.Errorf("Lookup(%s) = %q expected %q", domain, category, expected)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "domain-categories.csv")
+	saved := databaseFiles
+	databaseFiles = []string{filename}
+	defer func() { databaseFiles = saved }()
+
+	err := os.WriteFile(filename, []byte("example.com,First\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase()
+	if Lookup("www.example.com") != "First" {
+		t.Fatal("database not loaded")
+	}
+
+	err = os.WriteFile(filename, []byte("example.com,Second\nexample.net,Second\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filename, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	checkDatabase()
+	if Lookup("www.example.com") != "Second" {
+		t.Error("database not reloaded")
+	}
+
+	os.Remove(filename)
+	checkDatabase()
+	if Lookup("www.example.com") != "" {
+		t.Error("removed database still used")
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/domain"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/reports"
 )
@@ -52,62 +53,65 @@ func AttachCertificateToSession(session *dispatch.Session, certificate x509.Cert
 
 	session.PutAttachment("certificate", certificate)
 
-	setSessionEntry(session, "certificate_subject_cn", certificate.Subject.CommonName, ctid)
-	setSessionEntry(session, "certificate_subject_sn", certificate.Subject.SerialNumber, ctid)
-	setSessionList(session, "certificate_subject_c", certificate.Subject.Country, ctid)
-	setSessionList(session, "certificate_subject_o", certificate.Subject.Organization, ctid)
-	setSessionList(session, "certificate_subject_ou", certificate.Subject.OrganizationalUnit, ctid)
-	setSessionList(session, "certificate_subject_l", certificate.Subject.Locality, ctid)
-	setSessionList(session, "certificate_subject_p", certificate.Subject.Province, ctid)
-	setSessionList(session, "certificate_subject_sa", certificate.Subject.StreetAddress, ctid)
-	setSessionList(session, "certificate_subject_pc", certificate.Subject.PostalCode, ctid)
-	setSessionList(session, "certificate_subject_san", certificate.DNSNames, ctid)
-
-	setSessionEntry(session, "certificate_issuer_cn", certificate.Issuer.CommonName, ctid)
-	setSessionEntry(session, "certificate_issuer_sn", certificate.Issuer.SerialNumber, ctid)
-	setSessionList(session, "certificate_issuer_c", certificate.Issuer.Country, ctid)
-	setSessionList(session, "certificate_issuer_o", certificate.Issuer.Organization, ctid)
-	setSessionList(session, "certificate_issuer_ou", certificate.Issuer.OrganizationalUnit, ctid)
-	setSessionList(session, "certificate_issuer_l", certificate.Issuer.Locality, ctid)
-	setSessionList(session, "certificate_issuer_p", certificate.Issuer.Province, ctid)
-	setSessionList(session, "certificate_issuer_sa", certificate.Issuer.StreetAddress, ctid)
-	setSessionList(session, "certificate_issuer_pc", certificate.Issuer.PostalCode, ctid)
+	batch := dict.NewSessionBatch(ctid)
+
+	setSessionEntry(session, "certificate_subject_cn", certificate.Subject.CommonName, batch)
+	setSessionEntry(session, "certificate_subject_sn", certificate.Subject.SerialNumber, batch)
+	setSessionList(session, "certificate_subject_c", certificate.Subject.Country, batch)
+	setSessionList(session, "certificate_subject_o", certificate.Subject.Organization, batch)
+	setSessionList(session, "certificate_subject_ou", certificate.Subject.OrganizationalUnit, batch)
+	setSessionList(session, "certificate_subject_l", certificate.Subject.Locality, batch)
+	setSessionList(session, "certificate_subject_p", certificate.Subject.Province, batch)
+	setSessionList(session, "certificate_subject_sa", certificate.Subject.StreetAddress, batch)
+	setSessionList(session, "certificate_subject_pc", certificate.Subject.PostalCode, batch)
+	setSessionList(session, "certificate_subject_san", certificate.DNSNames, batch)
+
+	setSessionEntry(session, "certificate_issuer_cn", certificate.Issuer.CommonName, batch)
+	setSessionEntry(session, "certificate_issuer_sn", certificate.Issuer.SerialNumber, batch)
+	setSessionList(session, "certificate_issuer_c", certificate.Issuer.Country, batch)
+	setSessionList(session, "certificate_issuer_o", certificate.Issuer.Organization, batch)
+	setSessionList(session, "certificate_issuer_ou", certificate.Issuer.OrganizationalUnit, batch)
+	setSessionList(session, "certificate_issuer_l", certificate.Issuer.Locality, batch)
+	setSessionList(session, "certificate_issuer_p", certificate.Issuer.Province, batch)
+	setSessionList(session, "certificate_issuer_sa", certificate.Issuer.StreetAddress, batch)
+	setSessionList(session, "certificate_issuer_pc", certificate.Issuer.PostalCode, batch)
+	batch.Commit()
 
 	logEvent(session)
+	if cn, ok := session.GetAttachment("certificate_subject_cn").(string); ok {
+		domain.UpdateSession(session, domain.SourceCertificate, cn)
+	}
 }
 
-// setSessionEntry sets the session attachment and dict entry for the specified field to the specified value
-func setSessionEntry(session *dispatch.Session, field string, value string, ctid uint32) {
+// setSessionEntry sets the session attachment and adds the dict entry for the specified field to the batch
+func setSessionEntry(session *dispatch.Session, field string, value string, batch *dict.Batch) {
 	if len(value) == 0 {
 		return
 	}
 
 	output := strings.Replace(value, ",", "-", -1)
-	dict.AddSessionEntry(ctid, field, output)
+	batch.Add(field, output)
 	session.PutAttachment(field, output)
 }
 
-// setSessionEntry sets the session attachment and dict entry for the specified field to the specified value
-// the value is a list of strings that will be joined into a single string using "|"
-func setSessionList(session *dispatch.Session, field string, value []string, ctid uint32) {
-	if len(value) == 0 {
-		return
-	}
-
-	var buffer string
+// setSessionList sets the session attachment and adds the dict entry for the specified field to the batch
+// The dict entry is a string list, which the kernel module stores as the items joined
+// with "|" like the attachment used for the reports
+func setSessionList(session *dispatch.Session, field string, value []string, batch *dict.Batch) {
+	var list []string
 
-	for index, item := range value {
-		if index != 0 {
-			buffer += "|"
+	for _, item := range value {
+		if len(item) != 0 {
+			list = append(list, item)
 		}
-		buffer += item
 	}
 
-	if len(buffer) == 0 {
+	if len(list) == 0 {
 		return
 	}
 
-	setSessionEntry(session, field, buffer, ctid)
+	batch.Add(field, list)
+	session.PutAttachment(field, strings.Join(list, "|"))
 }
 
 // FindCertificate fetches the cached certificate for the argumented address.
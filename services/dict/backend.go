@@ -0,0 +1,83 @@
+package dict
+
+import (
+	"os"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Backend is the storage for the dictionary tables
+// The kernel backend uses the nft_dict module through /proc/net/dict so the
+// values can be matched in nftables rules. The memory backend keeps everything
+// in process for systems without the module and for testing.
+type Backend interface {
+	// Name returns the name of the backend for logging and status
+	Name() string
+	// Write sets the field to the value in the dictionary for the key in the table
+	Write(table string, key interface{}, field string, value interface{}) error
+	// WriteBatch sets several fields in the dictionary for the key in the table
+	WriteBatch(table string, key interface{}, fields []Field) error
+	// Delete removes the dictionary for the key from the table
+	Delete(table string, key interface{}) error
+	// Dictionary returns all of the entries in the dictionary for the key
+	Dictionary(table string, key interface{}) ([]Entry, error)
+	// Table returns all of the entries in the table
+	Table(table string) ([]Entry, error)
+	// All returns all of the entries in all of the tables
+	All() ([]Entry, error)
+}
+
+var backend Backend
+var backendMutex sync.RWMutex
+
+// SetBackend replaces the active backend
+// This is mostly useful for testing with a fresh memory backend
+func SetBackend(b Backend) {
+	setBackend(b)
+}
+
+// NewMemoryBackend returns an empty in-memory backend
+func NewMemoryBackend() Backend {
+	return newMemoryBackend()
+}
+
+// GetBackendName returns the name of the active backend
+func GetBackendName() string {
+	return getBackend().Name()
+}
+
+// setBackend sets the active backend
+func setBackend(b Backend) {
+	backendMutex.Lock()
+	backend = b
+	backendMutex.Unlock()
+	logger.Info("Using %s dict backend\n", b.Name())
+}
+
+// getBackend returns the active backend, selecting one if Startup has not been called
+func getBackend() Backend {
+	backendMutex.RLock()
+	b := backend
+	backendMutex.RUnlock()
+	if b != nil {
+		return b
+	}
+
+	backendMutex.Lock()
+	defer backendMutex.Unlock()
+	if backend == nil {
+		backend = selectBackend()
+	}
+	return backend
+}
+
+// selectBackend returns the kernel backend if the nft_dict module is loaded
+// and the memory backend if it is not
+func selectBackend() Backend {
+	if _, err := os.Stat(pathBase); err != nil {
+		logger.Notice("%s not available, dict entries will be stored in memory\n", pathBase)
+		return newMemoryBackend()
+	}
+	return newProcBackend(pathBase)
+}
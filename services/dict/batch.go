@@ -0,0 +1,103 @@
+package dict
+
+import (
+	"net"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Field is a single field and value for a batch write
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Batch collects several field/value pairs for one dictionary so they can be
+// written together. Use this instead of several AddEntry calls for the same key.
+// The kernel backend still writes each field separately and only shares the open
+// and close of the proc node between them.
+type Batch struct {
+	table  string
+	key    interface{}
+	fields []Field
+	ttl    time.Duration
+}
+
+// NewBatch creates an empty batch for the supplied key in the supplied table
+func NewBatch(table string, key interface{}) *Batch {
+	return &Batch{table: table, key: key}
+}
+
+// NewSessionBatch creates an empty batch for the supplied int key in the session table
+// This is a convenience wrapper for NewBatch
+func NewSessionBatch(key uint32) *Batch {
+	return NewBatch("sessions", key)
+}
+
+// NewHostBatch creates an empty batch for the supplied ip key in the host table
+// This is a convenience wrapper for NewBatch
+func NewHostBatch(key net.IP) *Batch {
+	return NewBatch("host", key)
+}
+
+// NewUserBatch creates an empty batch for the supplied string key in the user table
+// This is a convenience wrapper for NewBatch
+func NewUserBatch(key string) *Batch {
+	return NewBatch("user", key)
+}
+
+// NewDeviceBatch creates an empty batch for the supplied mac key in the device table
+// This is a convenience wrapper for NewBatch
+func NewDeviceBatch(key net.HardwareAddr) *Batch {
+	return NewBatch("device", key)
+}
+
+// Add adds a field/value pair to the batch
+// Values are converted the same way as AddEntry and empty strings are ignored
+func (b *Batch) Add(field string, value interface{}) *Batch {
+	value, ok := normalizeValue(value)
+	if !ok {
+		return b
+	}
+	b.fields = append(b.fields, Field{Name: field, Value: value})
+	return b
+}
+
+// SetTTL sets the time the dictionary will be kept after the batch is
+// committed if it is not written or touched again
+func (b *Batch) SetTTL(ttl time.Duration) *Batch {
+	b.ttl = ttl
+	return b
+}
+
+// Len returns the number of fields in the batch
+func (b *Batch) Len() int {
+	return len(b.fields)
+}
+
+// Commit writes all of the fields in the batch and empties it
+func (b *Batch) Commit() error {
+	if len(b.fields) == 0 {
+		return nil
+	}
+
+	if logger.IsDebugEnabled() {
+		for _, item := range b.fields {
+			logger.Debug("SET table: %s[%v] | %s = %v\n", b.table, b.key, item.Name, item.Value)
+		}
+	}
+
+	err := getBackend().WriteBatch(b.table, b.key, b.fields)
+	if err == nil {
+		track(b.table, b.key, b.ttl)
+		for _, item := range b.fields {
+			link(b.table, b.key, item.Name, item.Value)
+		}
+	} else {
+		logger.Warn("Batch: Failed to write %d fields for %s%s\n", len(b.fields), generateTable(b.table), generateKey(b.key))
+	}
+
+	b.fields = nil
+	return err
+}
@@ -1,39 +1,50 @@
 package dict
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"net"
-	"os"
 	"os/exec"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/untangle/packetd/services/logger"
 )
 
-const pathBase string = "/proc/net/dict"
+// listSeparator separates the items in list values
+const listSeparator = "|"
 
-var readMutex = &sync.Mutex{}
 var disabled = false
+var listReplacer = strings.NewReplacer(",", "-", listSeparator, "-")
 
 // Startup dict service
 func Startup() {
+	go janitorTask()
+
 	if disabled {
+		setBackend(newMemoryBackend())
 		return
 	}
 
 	// Load the dict module
 	exec.Command("modprobe", "nft_dict").Run()
+
+	setBackend(selectBackend())
 }
 
 // Shutdown dict service
 func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown dict janitorTask\n")
+	}
 }
 
-// Disable disable dict writing
+// Disable disable dict writing to the kernel
+// The in-memory backend is used instead
 func Disable() {
 	disabled = true
 }
@@ -106,45 +117,35 @@ func parseKey(arg string) interface{} {
 // Given a string known to contain a value token
 // return the typed value
 func parseValue(arg string) interface{} {
-	var value interface{}
-
-	if strings.Contains(arg, "string: ") {
-		slices := strings.SplitN(arg, " ", 2)
-		if len(slices) < 2 {
+	slices := strings.SplitN(arg, ": ", 2)
+	if len(slices) < 2 {
+		if strings.HasPrefix(arg, "string:") {
 			return ""
 		}
-		return slices[1]
-	} else if strings.Contains(arg, "int: ") {
-		var temp uint32
-		fmt.Sscanf(arg, "int: %d", &temp)
-		value = temp
-	} else if strings.Contains(arg, "int64: ") {
-		var temp uint64
-		fmt.Sscanf(arg, "int64: %d", &temp)
-		value = temp
-	} else if strings.Contains(arg, "mac: ") {
-		var temp string
-		fmt.Sscanf(arg, "mac: %s", &temp)
-		tempmac, _ := net.ParseMAC(temp)
-		value = tempmac
-	} else if strings.Contains(arg, "ip: ") {
-		var temp string
-		fmt.Sscanf(arg, "ip: %s", &temp)
-		tempip := net.ParseIP(temp)
-		value = tempip
-	} else if strings.Contains(arg, "ip6: ") {
-		var temp string
-		fmt.Sscanf(arg, "ip6: %s", &temp)
-		tempip := net.ParseIP(temp)
-		value = tempip
-	} else if strings.Contains(arg, "bool: ") {
-		var temp string
-		fmt.Sscanf(arg, "bool: %s", &temp)
-		tempbool, _ := strconv.ParseBool(temp)
-		value = tempbool
+		return nil
 	}
+	token, data := slices[0], slices[1]
 
-	return value
+	switch token {
+	case "string":
+		return data
+	case "int":
+		temp, _ := strconv.ParseUint(strings.TrimSpace(data), 10, 32)
+		return uint32(temp)
+	case "int64":
+		temp, _ := strconv.ParseUint(strings.TrimSpace(data), 10, 64)
+		return temp
+	case "mac":
+		tempmac, _ := net.ParseMAC(strings.TrimSpace(data))
+		return tempmac
+	case "ip", "ip6":
+		return net.ParseIP(strings.TrimSpace(data))
+	case "bool":
+		tempbool, _ := strconv.ParseBool(strings.TrimSpace(data))
+		return tempbool
+	}
+
+	return nil
 }
 
 // Parse an entry from a line of output from /proc/net/dict/*
@@ -216,12 +217,22 @@ func formatValue(value interface{}) string {
 		return fmt.Sprintf("Value: %d", value.(uint32))
 	case uint64:
 		return fmt.Sprintf("Value: %d", value.(uint64))
+	case int32:
+		return fmt.Sprintf("Value: %d", value.(int32))
+	case int64:
+		return fmt.Sprintf("Value: %d", value.(int64))
+	case float64:
+		return fmt.Sprintf("Value: %s", strconv.FormatFloat(value.(float64), 'g', -1, 64))
 	case net.HardwareAddr:
 		return fmt.Sprintf("Value: %s", value.(net.HardwareAddr).String())
 	case net.IP:
 		return fmt.Sprintf("Value: %s", value.(net.IP).String())
 	case bool:
 		return fmt.Sprintf("Value: %s", strconv.FormatBool(value.(bool)))
+	case []string:
+		return fmt.Sprintf("Value: %s", joinStringList(value.([]string)))
+	case []net.IP:
+		return fmt.Sprintf("Value: %s", joinIPList(value.([]net.IP)))
 	}
 
 	return ""
@@ -282,6 +293,108 @@ func (p Entry) GetInt64() (uint64, error) {
 	}
 }
 
+// GetSignedInt gets an entry's signed integer value
+// Given a dictionary Entry, return the entry's value field
+// as a signed 32bit integer.  If the entry's value is not a signed
+// 32bit integer, return an error. Values read from the kernel module are strings
+// and are parsed.
+func (p Entry) GetSignedInt() (int32, error) {
+
+	switch p.Value.(type) {
+	case int32:
+		return p.Value.(int32), nil
+	case string:
+		value, err := strconv.ParseInt(p.Value.(string), 10, 32)
+		if err == nil {
+			return int32(value), nil
+		}
+	}
+
+	return 0, fmt.Errorf("GetSignedInt: Requested value is not a signed integer")
+}
+
+// GetSignedInt64 gets an entry's signed 64 bit integer value
+// Given a dictionary Entry, return the entry's value field
+// as a signed 64bit integer.  If the entry's value is not a signed
+// 64bit integer, return an error. Values read from the kernel module are strings
+// and are parsed.
+func (p Entry) GetSignedInt64() (int64, error) {
+
+	switch p.Value.(type) {
+	case int64:
+		return p.Value.(int64), nil
+	case string:
+		value, err := strconv.ParseInt(p.Value.(string), 10, 64)
+		if err == nil {
+			return value, nil
+		}
+	}
+
+	return 0, fmt.Errorf("GetSignedInt64: Requested value is not a signed 64 bit integer")
+}
+
+// GetFloat gets an entry's floating point value
+// Given a dictionary Entry, return the entry's value field
+// as a float64.  If the entry's value is not a float,
+// return an error. Values read from the kernel module are strings
+// and are parsed.
+func (p Entry) GetFloat() (float64, error) {
+
+	switch p.Value.(type) {
+	case float64:
+		return p.Value.(float64), nil
+	case string:
+		value, err := strconv.ParseFloat(p.Value.(string), 64)
+		if err == nil {
+			return value, nil
+		}
+	}
+
+	return 0, fmt.Errorf("GetFloat: Requested value is not a float")
+}
+
+// GetStringList gets an entry's string list value
+// Given a dictionary Entry, return the entry's value field
+// as a list of strings.  If the entry's value is not a string list,
+// return an error. Values read from the kernel module are strings
+// and are parsed.
+func (p Entry) GetStringList() ([]string, error) {
+
+	switch p.Value.(type) {
+	case []string:
+		return p.Value.([]string), nil
+	case string:
+		return strings.Split(p.Value.(string), listSeparator), nil
+	default:
+		return nil, fmt.Errorf("GetStringList: Requested value is not a string list")
+	}
+}
+
+// GetIPList gets an entry's IP list value
+// Given a dictionary Entry, return the entry's value field
+// as a list of IP addresses.  If the entry's value is not an IP list,
+// return an error. Values read from the kernel module are strings
+// and are parsed.
+func (p Entry) GetIPList() ([]net.IP, error) {
+
+	switch p.Value.(type) {
+	case []net.IP:
+		return p.Value.([]net.IP), nil
+	case string:
+		var list []net.IP
+		for _, item := range strings.Split(p.Value.(string), listSeparator) {
+			address := net.ParseIP(item)
+			if address == nil {
+				return nil, fmt.Errorf("GetIPList: Requested value is not an IP list")
+			}
+			list = append(list, address)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("GetIPList: Requested value is not an IP list")
+	}
+}
+
 // GetMac gets an entry's mac value
 // Given a dictionary Entry, return the entry's value field
 // as a MAC address.  If the entry's value is not a MAC address,
@@ -326,54 +439,6 @@ func (p Entry) GetBool() (bool, error) {
 	}
 }
 
-// writeEntry writes out a set string to the dict proc write node
-// This function will return an error if it is unable to open
-// or write to /proc/net/dict/write
-func writeEntry(setstr string) error {
-	file, err := os.OpenFile(pathBase+"/write", os.O_WRONLY, 0660)
-
-	if err != nil {
-		logger.Warn("writeEntry: Failed to open %s\n", pathBase+"/write")
-		return err
-	}
-
-	defer file.Close()
-
-	_, err = file.WriteString(setstr)
-	if err != nil {
-		logger.Warn("writeEntry: Failed to write %s\n", setstr)
-		return (err)
-	}
-
-	file.Sync()
-
-	return err
-}
-
-// deleteEntry writes out a string to the dict proc delete node
-// This function will return an error if it is unable to open
-// or write to /proc/net/dict/delete
-func deleteEntry(setstr string) error {
-	file, err := os.OpenFile(pathBase+"/delete", os.O_WRONLY, 0660)
-
-	if err != nil {
-		logger.Warn("deleteEntry: Failed to open %s\n", pathBase+"/delete")
-		return err
-	}
-
-	defer file.Close()
-
-	_, err = file.WriteString(setstr)
-	if err != nil {
-		logger.Err("%OC|dict: deleteEntry: Failed to write %s\n", "dict_write_failure", 0, setstr)
-		return (err)
-	}
-
-	file.Sync()
-
-	return err
-}
-
 // generateTable generates the table token for the dict proc write string
 func generateTable(table string) string {
 	return fmt.Sprintf("table=%s,", table)
@@ -404,6 +469,55 @@ func generateInt64(value uint64) string {
 	return fmt.Sprintf("int64=%d", value)
 }
 
+// The nft_dict module only knows the unsigned int, bool, address and string
+// value types. Signed integers, floats and lists are written as strings and
+// the Entry accessors parse them back when they are read from the module.
+
+// generateSignedInt generates the string value token for a signed int
+func generateSignedInt(value int32) string {
+	return generateString(strconv.FormatInt(int64(value), 10))
+}
+
+// generateSignedInt64 generates the string value token for a signed 64 bit int
+func generateSignedInt64(value int64) string {
+	return generateString(strconv.FormatInt(value, 10))
+}
+
+// generateFloat generates the string value token for a float
+func generateFloat(value float64) string {
+	return generateString(strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// generateStringList generates the string value token for a string list
+// The items are joined with the list separator so commas and separators in
+// the items are replaced with a dash
+func generateStringList(value []string) string {
+	return generateString(joinStringList(value))
+}
+
+// generateIPList generates the string value token for an IP list
+func generateIPList(value []net.IP) string {
+	return generateString(joinIPList(value))
+}
+
+// joinStringList returns the items joined with the list separator
+func joinStringList(value []string) string {
+	list := make([]string, len(value))
+	for i, item := range value {
+		list[i] = listReplacer.Replace(item)
+	}
+	return strings.Join(list, listSeparator)
+}
+
+// joinIPList returns the addresses joined with the list separator
+func joinIPList(value []net.IP) string {
+	list := make([]string, len(value))
+	for i, item := range value {
+		list[i] = item.String()
+	}
+	return strings.Join(list, listSeparator)
+}
+
 // generateBool generates the bool token for the dict proc write string
 func generateBool(value bool) string {
 	return fmt.Sprintf("bool=%s", strconv.FormatBool(value))
@@ -438,6 +552,16 @@ func generateValue(value interface{}) string {
 		return generateInt(value.(uint32))
 	case uint64:
 		return generateInt64(value.(uint64))
+	case int32:
+		return generateSignedInt(value.(int32))
+	case int64:
+		return generateSignedInt64(value.(int64))
+	case float64:
+		return generateFloat(value.(float64))
+	case []string:
+		return generateStringList(value.([]string))
+	case []net.IP:
+		return generateIPList(value.([]net.IP))
 	default:
 		return ""
 	}
@@ -490,54 +614,64 @@ func generateKey(key interface{}) string {
 
 // AddEntry adds a field/value entry for the supplied key in the supplied table
 func AddEntry(table string, key interface{}, field string, value interface{}) error {
-	var setstr string
+	return addEntry(table, key, field, value, 0)
+}
 
-	// FIXME
-	// there is a bug with ints currently
-	// We don't handle <32-bit ints...
-	// kern.log spews "top_write: Insuffient input"
-	// Checking in this awful code for now
-	// XXX do we handled signed vs unsigned?
-	ui8, ok := value.(uint8)
-	if ok {
-		value = uint32(ui8)
-	}
-	ui16, ok := value.(uint16)
-	if ok {
-		value = uint32(ui16)
-	}
-	i8, ok := value.(int8)
-	if ok {
-		value = uint32(i8)
-	}
-	i16, ok := value.(int16)
-	if ok {
-		value = uint32(i16)
+// addEntry writes the entry and refreshes the expiration of the dictionary
+// A ttl of zero keeps the current ttl of a tracked dictionary
+func addEntry(table string, key interface{}, field string, value interface{}, ttl time.Duration) error {
+	value, ok := normalizeValue(value)
+	if !ok {
+		logger.Warn("AddEntry: Set empty string request for %s %s %s\n", generateTable(table), generateKey(key), generateField(field))
+		return nil
 	}
 
-	switch value.(type) {
-	case string:
-		if value.(string) == "" {
-			logger.Warn("AddEntry: Set empty string request for %s %s %s\n", generateTable(table), generateKey(key), generateField(field))
-			return nil
-		}
-	}
-
-	setstr = fmt.Sprintf("%s%s%s%s", generateTable(table), generateKey(key), generateField(field), generateValue(value))
-
 	if logger.IsDebugEnabled() {
 		logger.Debug("SET table: %s[%v] | %s = %v\n", table, key, field, value)
 	}
 
-	err := writeEntry(setstr)
+	err := getBackend().Write(table, key, field, value)
 
-	if err != nil {
-		logger.Warn("AddEntry: Failed to write %s\n", setstr)
+	if err == nil {
+		track(table, key, ttl)
+		link(table, key, field, value)
+	} else {
+		logger.Warn("AddEntry: Failed to write %s%s%s%s\n", generateTable(table), generateKey(key), generateField(field), generateValue(value))
 	}
 
 	return err
 }
 
+// normalizeValue converts the value to a type the dict module supports
+// Smaller integers are widened to the 32 or 64 bit type with the same sign
+// returns false if the value should not be written
+func normalizeValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case uint8:
+		return uint32(v), true
+	case uint16:
+		return uint32(v), true
+	case uint:
+		return uint64(v), true
+	case int8:
+		return int32(v), true
+	case int16:
+		return int32(v), true
+	case int:
+		return int64(v), true
+	case float32:
+		return float64(v), true
+	case string:
+		return v, v != ""
+	case []string:
+		return v, len(v) != 0
+	case []net.IP:
+		return v, len(v) != 0
+	}
+
+	return value, true
+}
+
 // AddHostEntry adds a field/value entry for the supplied ip key in the host table
 // This is a convenience wrapper for AddEntry
 func AddHostEntry(key net.IP, field string, value interface{}) error {
@@ -564,14 +698,12 @@ func AddSessionEntry(key uint32, field string, value interface{}) error {
 
 // DeleteDictionary removes a dictionary with the supplied key in the supplied table
 func DeleteDictionary(table string, key interface{}) error {
-	var setstr string
-	setstr = fmt.Sprintf("%s%s", generateTable(table), generateKey(key))
-
 	if logger.IsDebugEnabled() {
 		logger.Debug("DEL table: %s[%v]\n", table, key)
 	}
 
-	err := deleteEntry(setstr)
+	untrack(table, key)
+	err := getBackend().Delete(table, key)
 
 	if err != nil {
 		logger.Warn("DeleteDictionary ERROR: %s\n", err)
@@ -605,71 +737,15 @@ func DeleteSession(key uint32) error {
 }
 
 // GetDictionary gets all of the dictionary entries for the supplied key
-// This function will return an error if it cannot open or read
-// /proc/net/dict/read
+// This function will return an error if the backend can not be read
 func GetDictionary(table string, key interface{}) ([]Entry, error) {
-	file, err := os.OpenFile(pathBase+"/read", os.O_RDWR, 0660)
-	setstr := fmt.Sprintf("%s%s", generateTable(table), generateKey(key))
-
-	if err != nil {
-		logger.Warn("GetDictionary: Failed to open %s\n", pathBase+"/read")
-		return nil, err
-	}
-
-	defer file.Close()
-
-	readMutex.Lock()
-	_, err = file.WriteString(setstr)
-
-	if err != nil {
-		logger.Warn("GetDictionary: Failed to write %s\n", setstr)
-		return nil, err
-	}
-
-	file.Sync()
-
-	var entries []Entry
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		entries = append(entries, parseEntry(scanner.Text()))
-	}
-	readMutex.Unlock()
-	return entries, err
+	return getBackend().Dictionary(table, key)
 }
 
 // GetTable gets all of the dictionary entries in the supplied table
-// This function will return an error if it cannot open or read
-// /proc/net/dict/read
+// This function will return an error if the backend can not be read
 func GetTable(table string) ([]Entry, error) {
-	file, err := os.OpenFile(pathBase+"/read", os.O_RDWR, 0660)
-	setstr := fmt.Sprintf("%s", generateTable(table))
-
-	if err != nil {
-		logger.Warn("GetTable: Failed to open %s\n", pathBase+"/read")
-		return nil, err
-	}
-
-	defer file.Close()
-
-	readMutex.Lock()
-	_, err = file.WriteString(setstr)
-
-	if err != nil {
-		logger.Warn("GetTable: Failed to write %s\n", setstr)
-		return nil, err
-	}
-
-	file.Sync()
-
-	var entries []Entry
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		entries = append(entries, parseEntry(scanner.Text()))
-	}
-	readMutex.Unlock()
-	return entries, err
+	return getBackend().Table(table)
 }
 
 // GetEntry gets the dictionary entry for the specified table, key and field
@@ -724,25 +800,9 @@ func GetSessionEntry(key uint32, field string) (Entry, error) {
 }
 
 // GetAllEntries gets all of entries for all known dictionaries
-// This function returns an error if it cannot open or read
-// /proc/net/dict/all
+// This function returns an error if the backend can not be read
 func GetAllEntries() ([]Entry, error) {
-	file, err := os.OpenFile(pathBase+"/all", os.O_RDWR, 0660)
-
-	if err != nil {
-		logger.Warn("GetAll: Failed to open %s\n", pathBase+"/all")
-		return nil, err
-	}
-
-	defer file.Close()
-
-	var entries []Entry
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		entries = append(entries, parseEntry(scanner.Text()))
-	}
-	return entries, err
+	return getBackend().All()
 }
 
 // GetSessions returns the session table
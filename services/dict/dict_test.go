@@ -0,0 +1,312 @@
+package dict
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rateFields are the fields the reporter writes on every conntrack update
+var rateFields = []string{"byte_rate", "client_byte_rate", "server_byte_rate", "packet_rate", "client_packet_rate", "server_packet_rate"}
+
+// newTestProcBackend returns a kernel backend that writes to regular files
+// in a temporary directory instead of /proc/net/dict
+func newTestProcBackend(b *testing.B) *procBackend {
+	dir := b.TempDir()
+	for _, node := range []string{"read", "write", "delete", "all"} {
+		err := os.WriteFile(filepath.Join(dir, node), nil, 0660)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return newProcBackend(dir)
+}
+
+// reportFileOps adds the number of opens, writes, and system calls per operation to the
+// benchmark results. Every open of the write node is followed by an fsync and a close.
+func reportFileOps(b *testing.B, p *procBackend) {
+	b.ReportMetric(float64(p.opens)/float64(b.N), "opens/op")
+	b.ReportMetric(float64(p.writes)/float64(b.N), "writes/op")
+	b.ReportMetric(float64(3*p.opens+p.writes)/float64(b.N), "syscalls/op")
+}
+
+func BenchmarkAddSessionEntry(b *testing.B) {
+	p := newTestProcBackend(b)
+	backend = p
+	defer func() { backend = nil }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, field := range rateFields {
+			AddSessionEntry(uint32(i), field, uint32(j))
+		}
+	}
+	b.StopTimer()
+	reportFileOps(b, p)
+}
+
+func BenchmarkSessionBatch(b *testing.B) {
+	p := newTestProcBackend(b)
+	backend = p
+	defer func() { backend = nil }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := NewSessionBatch(uint32(i))
+		for j, field := range rateFields {
+			batch.Add(field, uint32(j))
+		}
+		batch.Commit()
+	}
+	b.StopTimer()
+	reportFileOps(b, p)
+}
+
+func BenchmarkMemoryAddSessionEntry(b *testing.B) {
+	backend = newMemoryBackend()
+	defer func() { backend = nil }()
+
+	for i := 0; i < b.N; i++ {
+		for j, field := range rateFields {
+			AddSessionEntry(uint32(i%1024), field, uint32(j))
+		}
+	}
+}
+
+func BenchmarkMemorySessionBatch(b *testing.B) {
+	backend = newMemoryBackend()
+	defer func() { backend = nil }()
+
+	for i := 0; i < b.N; i++ {
+		batch := NewSessionBatch(uint32(i % 1024))
+		for j, field := range rateFields {
+			batch.Add(field, uint32(j))
+		}
+		batch.Commit()
+	}
+}
+
+func TestSessionBatch(t *testing.T) {
+	backend = newMemoryBackend()
+	defer func() { backend = nil }()
+
+	batch := NewSessionBatch(42).Add("client_port", uint16(443)).Add("empty", "").Add("server_dns_hint", "example.com")
+	if batch.Len() != 2 {
+		t.Fatalf("expected 2 fields, got %d", batch.Len())
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := GetSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions[42]["client_port"] != uint32(443) || sessions[42]["server_dns_hint"] != "example.com" {
+		t.Fatalf("unexpected session entries: %v", sessions[42])
+	}
+}
+
+func TestWriteBatchError(t *testing.T) {
+	memory := newMemoryBackend()
+	fields := []Field{{"client_port", uint32(443)}, {"bad", struct{}{}}, {"server_dns_hint", "example.com"}}
+	if err := memory.WriteBatch("sessions", uint32(42), fields); err == nil {
+		t.Fatal("expected an error for the unsupported value")
+	}
+
+	entries, _ := memory.Dictionary("sessions", uint32(42))
+	if len(entries) != 2 {
+		t.Fatalf("the fields after the failed one should be written: %v", entries)
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	values := []interface{}{
+		"example.com",
+		uint32(443),
+		uint64(1) << 40,
+		true,
+		net.ParseIP("192.168.1.1").To4(),
+		net.ParseIP("2001:db8::1"),
+	}
+
+	for _, value := range values {
+		// the proc read node uses "type: value" where the write node uses "type=value"
+		// and strings are written as value= but read as string:
+		parsed := parseValue(readToken(generateValue(value)))
+		if formatValue(parsed) != formatValue(value) {
+			t.Errorf("%T round trip failed: %s -> %s", value, formatValue(value), formatValue(parsed))
+		}
+	}
+}
+
+// readToken converts a write node value token to the read node format
+func readToken(token string) string {
+	token = strings.Replace(token, "=", ": ", 1)
+	return strings.Replace(token, "value: ", "string: ", 1)
+}
+
+func TestStringValues(t *testing.T) {
+	// the module has no signed, float or list types so they are written
+	// as strings and parsed by the accessors when they are read back
+	tests := []struct {
+		value interface{}
+		token string
+	}{
+		{int32(-12), "value=-12"},
+		{int64(-1) << 40, "value=-1099511627776"},
+		{float64(-33.8688), "value=-33.8688"},
+		{[]string{"www.example.com", "a,b|c"}, "value=www.example.com|a-b-c"},
+		{[]net.IP{net.ParseIP("10.0.0.1").To4(), net.ParseIP("2001:db8::2")}, "value=10.0.0.1|2001:db8::2"},
+	}
+
+	for _, test := range tests {
+		token := generateValue(test.value)
+		if token != test.token {
+			t.Errorf("generateValue(%T) = %s expected %s", test.value, token, test.token)
+		}
+		entry := Entry{Value: parseValue(readToken(token))}
+
+		var parsed interface{}
+		var err error
+		switch test.value.(type) {
+		case int32:
+			parsed, err = entry.GetSignedInt()
+		case int64:
+			parsed, err = entry.GetSignedInt64()
+		case float64:
+			parsed, err = entry.GetFloat()
+		case []string:
+			parsed, err = entry.GetStringList()
+		case []net.IP:
+			parsed, err = entry.GetIPList()
+		}
+		if err != nil || formatValue(parsed) != formatValue(test.value) {
+			t.Errorf("%T round trip failed: %s -> %s %v", test.value, formatValue(test.value), formatValue(parsed), err)
+		}
+	}
+
+	if _, err := (Entry{Value: "example.com"}).GetFloat(); err == nil {
+		t.Error("GetFloat should fail for a string that is not a number")
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	tests := []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{uint8(6), uint32(6)},
+		{uint16(443), uint32(443)},
+		{int8(-1), int32(-1)},
+		{int16(-300), int32(-300)},
+		{int(-5), int64(-5)},
+		{float32(0.5), float64(0.5)},
+	}
+
+	for _, test := range tests {
+		value, ok := normalizeValue(test.in)
+		if !ok || value != test.out {
+			t.Errorf("normalizeValue(%T %v) = %T %v", test.in, test.in, value, value)
+		}
+	}
+
+	if _, ok := normalizeValue([]string{}); ok {
+		t.Error("empty lists should not be written")
+	}
+}
+
+// resetTracker clears the tracker state left by other tests and runs
+func resetTracker() {
+	trackerMutex.Lock()
+	trackerTable = make(map[string]*tracker)
+	trackerMutex.Unlock()
+}
+
+func TestExpiry(t *testing.T) {
+	backend = newMemoryBackend()
+	resetTracker()
+	defer func() { backend = nil }()
+
+	idle := net.ParseIP("192.168.1.10")
+	active := net.ParseIP("192.168.1.11")
+	AddEntryTTL("host", idle, "hostname", "idle", time.Hour)
+	AddEntryTTL("host", active, "hostname", "active", time.Hour)
+
+	// both hosts expire and touching the active one pushes its expiration back out
+	trackerMutex.Lock()
+	for _, item := range trackerTable {
+		item.expiry.Expires = time.Now().Add(-time.Second)
+	}
+	trackerMutex.Unlock()
+	TouchHost(active)
+	removeTrackers(findExpired(time.Now()))
+
+	if entries, _ := GetDictionary("host", idle); len(entries) != 0 {
+		t.Errorf("idle host was not removed: %v", entries)
+	}
+	if _, err := GetHostEntry(active, "hostname"); err != nil {
+		t.Errorf("active host was removed: %v", err)
+	}
+	if _, err := GetHostEntry(active, lastSeenField); err != nil {
+		t.Errorf("last_seen was not written: %v", err)
+	}
+	if _, ok := GetExpiry("host", idle); ok {
+		t.Error("idle host is still tracked")
+	}
+}
+
+func TestExpiryTracking(t *testing.T) {
+	backend = newMemoryBackend()
+	resetTracker()
+	defer func() { backend = nil }()
+
+	// dictionaries without a ttl are never tracked
+	plain := net.ParseIP("192.168.1.20")
+	AddHostEntry(plain, "hostname", "plain")
+	NewHostBatch(plain).Add("os", "linux").Commit()
+	if len(trackerTable) != 0 {
+		t.Fatalf("untracked dictionary added to the tracker: %v", trackerTable)
+	}
+
+	// a host with a ttl touches the device and user it is linked to
+	host := net.ParseIP("192.168.1.21")
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	AddEntryTTL("device", mac, "vendor", "example", time.Hour)
+	AddEntryTTL("user", "alice", "group", "staff", time.Hour)
+	NewHostBatch(host).Add(hostDeviceField, mac).Add(hostUserField, "alice").SetTTL(time.Hour).Commit()
+
+	trackerMutex.Lock()
+	for _, item := range trackerTable {
+		item.expiry.LastSeen = time.Time{}
+	}
+	trackerMutex.Unlock()
+
+	TouchHost(host)
+	for _, check := range []struct {
+		table string
+		key   interface{}
+	}{{"host", host}, {"device", mac}, {"user", "alice"}} {
+		expiry, ok := GetExpiry(check.table, check.key)
+		if !ok || expiry.LastSeen.IsZero() {
+			t.Errorf("%s was not touched: %v %v", check.table, ok, expiry)
+		}
+	}
+
+	// a dictionary touched after the janitor found it expired is kept
+	trackerMutex.Lock()
+	trackerTable[trackerKey("host", host)].expiry.Expires = time.Now().Add(-time.Second)
+	trackerMutex.Unlock()
+	expired := findExpired(time.Now())
+	if len(expired) != 1 {
+		t.Fatalf("expired %v", expired)
+	}
+	TouchHost(host)
+	removeTrackers(expired)
+	if _, ok := GetExpiry("host", host); !ok {
+		t.Error("touched host was removed")
+	}
+}
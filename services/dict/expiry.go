@@ -0,0 +1,257 @@
+package dict
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The kernel module does not expire entries so dictionaries written with a
+// TTL are tracked here and removed by the janitor when they expire. Only
+// dictionaries with a TTL are tracked so the tracker table is never larger
+// than the number of dictionaries that will eventually be removed. Touch
+// refreshes the last seen time and pushes the expiration out by the TTL so
+// entries for active hosts stay around while idle ones age out. Sessions
+// touch the host dictionaries for their addresses, and a host dictionary
+// with a mac_address or username field also touches that device or user.
+const janitorInterval = 30
+
+// lastSeenField is written to the dictionary when it is touched at most
+// once every lastSeenInterval seconds to limit the writes to the kernel
+const lastSeenField = "last_seen"
+const lastSeenInterval = 60
+
+// The host fields that link a host to the device and user dictionaries
+const hostDeviceField = "mac_address"
+const hostUserField = "username"
+
+// Expiry holds the expiration details for a dictionary
+type Expiry struct {
+	TTL      time.Duration `json:"ttl"`
+	Expires  time.Time     `json:"expires"`
+	LastSeen time.Time     `json:"last_seen"`
+}
+
+// tracker is the tracking state for a single dictionary
+type tracker struct {
+	table       string
+	key         interface{}
+	expiry      Expiry
+	lastWritten time.Time
+	device      net.HardwareAddr
+	user        string
+}
+
+var shutdownChannel = make(chan bool)
+var trackerMutex sync.Mutex
+var trackerTable = make(map[string]*tracker)
+
+// trackerKey returns the name for the table and key in the tracker table
+func trackerKey(table string, key interface{}) string {
+	return table + "|" + generateKey(key)
+}
+
+// track records that the dictionary was written. A ttl of zero keeps the current
+// ttl and does not start tracking a dictionary that is not already tracked.
+// Session dictionaries are removed with the session so they are not tracked.
+func track(table string, key interface{}, ttl time.Duration) {
+	if table == "sessions" {
+		return
+	}
+
+	now := time.Now()
+	name := trackerKey(table, key)
+
+	trackerMutex.Lock()
+	defer trackerMutex.Unlock()
+
+	item, ok := trackerTable[name]
+	if !ok {
+		if ttl <= 0 {
+			return
+		}
+		item = &tracker{table: table, key: copyValue(key)}
+		trackerTable[name] = item
+	}
+	if ttl > 0 {
+		item.expiry.TTL = ttl
+	}
+	item.expiry.LastSeen = now
+	if item.expiry.TTL > 0 {
+		item.expiry.Expires = now.Add(item.expiry.TTL)
+	}
+}
+
+// link records the device or user for a tracked host dictionary
+// when the field that links them is written
+func link(table string, key interface{}, field string, value interface{}) {
+	if table != "host" || (field != hostDeviceField && field != hostUserField) {
+		return
+	}
+
+	trackerMutex.Lock()
+	defer trackerMutex.Unlock()
+
+	item, ok := trackerTable[trackerKey(table, key)]
+	if !ok {
+		return
+	}
+	switch v := value.(type) {
+	case net.HardwareAddr:
+		item.device = copyValue(v).(net.HardwareAddr)
+	case string:
+		if field == hostUserField {
+			item.user = v
+		} else if mac, err := net.ParseMAC(v); err == nil {
+			item.device = mac
+		}
+	}
+}
+
+// untrack removes the dictionary from the tracker table
+func untrack(table string, key interface{}) {
+	trackerMutex.Lock()
+	delete(trackerTable, trackerKey(table, key))
+	trackerMutex.Unlock()
+}
+
+// AddEntryTTL adds a field/value entry for the supplied key in the supplied table
+// and removes the whole dictionary if it is not written or touched for the ttl
+func AddEntryTTL(table string, key interface{}, field string, value interface{}, ttl time.Duration) error {
+	return addEntry(table, key, field, value, ttl)
+}
+
+// GetExpiry returns the expiration details for the dictionary
+// returns false if the dictionary is not tracked
+func GetExpiry(table string, key interface{}) (Expiry, bool) {
+	trackerMutex.Lock()
+	defer trackerMutex.Unlock()
+
+	item, ok := trackerTable[trackerKey(table, key)]
+	if !ok {
+		return Expiry{}, false
+	}
+	return item.expiry, true
+}
+
+// Touch refreshes the last seen time of the dictionary if it is tracked
+// and extends the expiration by the ttl
+func Touch(table string, key interface{}) {
+	touch(table, key)
+}
+
+// touch refreshes the dictionary and returns the tracker state
+// returns nil if the dictionary is not tracked
+func touch(table string, key interface{}) *tracker {
+	var write bool
+
+	now := time.Now()
+
+	trackerMutex.Lock()
+	item, ok := trackerTable[trackerKey(table, key)]
+	var state tracker
+	if ok {
+		item.expiry.LastSeen = now
+		if item.expiry.TTL > 0 {
+			item.expiry.Expires = now.Add(item.expiry.TTL)
+		}
+		if now.Sub(item.lastWritten) >= lastSeenInterval*time.Second {
+			item.lastWritten = now
+			write = true
+		}
+		state = *item
+	}
+	trackerMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if write {
+		getBackend().Write(table, key, lastSeenField, uint64(now.Unix()))
+	}
+	return &state
+}
+
+// TouchHost refreshes the host dictionary for the address along with
+// the device and user dictionaries linked to the host
+func TouchHost(key net.IP) {
+	state := touch("host", key)
+	if state == nil {
+		return
+	}
+	if state.device != nil {
+		touch("device", state.device)
+	}
+	if state.user != "" {
+		touch("user", state.user)
+	}
+}
+
+// TouchDevice refreshes the device dictionary for the mac address
+// This is a convenience wrapper for Touch
+func TouchDevice(key net.HardwareAddr) {
+	Touch("device", key)
+}
+
+// TouchUser refreshes the user dictionary for the username
+// This is a convenience wrapper for Touch
+func TouchUser(key string) {
+	Touch("user", key)
+}
+
+// janitorTask periodically removes expired dictionaries
+func janitorTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(janitorInterval * time.Second):
+			removeExpired()
+		}
+	}
+}
+
+// removeExpired deletes every dictionary that is past its expiration
+func removeExpired() {
+	removeTrackers(findExpired(time.Now()))
+}
+
+// findExpired returns the tracker names of the dictionaries past their expiration
+func findExpired(now time.Time) []string {
+	var expired []string
+
+	trackerMutex.Lock()
+	defer trackerMutex.Unlock()
+
+	for name, item := range trackerTable {
+		if item.expiry.TTL > 0 && now.After(item.expiry.Expires) {
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// removeTrackers deletes the dictionaries for the tracker names. The expiration
+// is checked again under the lock right before the dictionary is removed from
+// the tracker table so one touched since it was found is kept.
+func removeTrackers(names []string) {
+	var removed []*tracker
+
+	for _, name := range names {
+		trackerMutex.Lock()
+		item, ok := trackerTable[name]
+		if ok && item.expiry.TTL > 0 && time.Now().After(item.expiry.Expires) {
+			delete(trackerTable, name)
+			removed = append(removed, item)
+		}
+		trackerMutex.Unlock()
+	}
+
+	for _, item := range removed {
+		logger.Debug("Removing expired dictionary %s[%v]\n", item.table, item.key)
+		DeleteDictionary(item.table, item.key)
+	}
+}
@@ -0,0 +1,188 @@
+package dict
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// memoryBackend stores dictionaries in process. It supports the same tables,
+// key types, and value types as the kernel module and is used when the
+// nft_dict module is not available. Nothing is visible to nftables rules.
+type memoryBackend struct {
+	mutex  sync.RWMutex
+	tables map[string]map[string]*memoryDictionary
+}
+
+// memoryDictionary holds the fields for a single key
+type memoryDictionary struct {
+	key    interface{}
+	fields map[string]interface{}
+}
+
+// newMemoryBackend returns an empty memory backend
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{tables: make(map[string]map[string]*memoryDictionary)}
+}
+
+// Name returns the name of the backend
+func (m *memoryBackend) Name() string {
+	return "memory"
+}
+
+// Write sets the field to the value in the dictionary for the key
+func (m *memoryBackend) Write(table string, key interface{}, field string, value interface{}) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.write(table, key, field, value)
+}
+
+// WriteBatch sets all of the fields in the dictionary for the key
+// A field that fails does not stop the others and the first error is returned
+func (m *memoryBackend) WriteBatch(table string, key interface{}, fields []Field) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var first error
+	for _, item := range fields {
+		err := m.write(table, key, item.Name, item.Value)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// write sets the field to the value in the dictionary for the key
+// The caller must hold the mutex
+func (m *memoryBackend) write(table string, key interface{}, field string, value interface{}) error {
+	name := generateKey(key)
+	if name == "" {
+		return fmt.Errorf("dict: unsupported key type %T", key)
+	}
+	if generateValue(value) == "" {
+		return fmt.Errorf("dict: unsupported value type %T", value)
+	}
+
+	dicts, ok := m.tables[table]
+	if !ok {
+		dicts = make(map[string]*memoryDictionary)
+		m.tables[table] = dicts
+	}
+
+	dict, ok := dicts[name]
+	if !ok {
+		dict = &memoryDictionary{key: copyValue(key), fields: make(map[string]interface{})}
+		dicts[name] = dict
+	}
+
+	dict.fields[field] = copyValue(value)
+	return nil
+}
+
+// Delete removes the dictionary for the key
+func (m *memoryBackend) Delete(table string, key interface{}) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dicts, ok := m.tables[table]
+	if ok {
+		delete(dicts, generateKey(key))
+	}
+	return nil
+}
+
+// Dictionary returns the entries for the key sorted by field
+func (m *memoryBackend) Dictionary(table string, key interface{}) ([]Entry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	dict, ok := m.tables[table][generateKey(key)]
+	if !ok {
+		return nil, nil
+	}
+	return dict.entries(table), nil
+}
+
+// Table returns the entries for every key in the table
+func (m *memoryBackend) Table(table string) ([]Entry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.table(table), nil
+}
+
+// All returns the entries for every table
+func (m *memoryBackend) All() ([]Entry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make([]string, 0, len(m.tables))
+	for name := range m.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []Entry
+	for _, name := range names {
+		entries = append(entries, m.table(name)...)
+	}
+	return entries, nil
+}
+
+// table returns the entries in the table sorted by key
+// The caller must hold the mutex
+func (m *memoryBackend) table(table string) []Entry {
+	dicts := m.tables[table]
+
+	names := make([]string, 0, len(dicts))
+	for name := range dicts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []Entry
+	for _, name := range names {
+		entries = append(entries, dicts[name].entries(table)...)
+	}
+	return entries
+}
+
+// entries returns the fields in the dictionary as entries sorted by field
+func (d *memoryDictionary) entries(table string) []Entry {
+	fields := make([]string, 0, len(d.fields))
+	for field := range d.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	entries := make([]Entry, 0, len(fields))
+	for _, field := range fields {
+		entries = append(entries, Entry{Table: table, Key: copyValue(d.key), Field: field, Value: copyValue(d.fields[field])})
+	}
+	return entries
+}
+
+// copyValue returns a copy of address values so callers can not change what we store
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case net.IP:
+		if ip := v.To4(); ip != nil {
+			return append(net.IP(nil), ip...)
+		}
+		return append(net.IP(nil), v...)
+	case net.HardwareAddr:
+		return append(net.HardwareAddr(nil), v...)
+	case []string:
+		return append([]string(nil), v...)
+	case []net.IP:
+		list := make([]net.IP, len(v))
+		for i, item := range v {
+			list[i] = copyValue(item).(net.IP)
+		}
+		return list
+	}
+	return value
+}
@@ -0,0 +1,198 @@
+package dict
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+const pathBase string = "/proc/net/dict"
+
+// procBackend stores dictionaries in the nft_dict kernel module using
+// the read, write, delete, and all nodes in /proc/net/dict
+// The opens and writes counters track the file operations on the nodes.
+type procBackend struct {
+	base      string
+	readMutex sync.Mutex
+	opens     uint64
+	writes    uint64
+}
+
+// newProcBackend returns the kernel backend using the nodes in the base directory
+func newProcBackend(base string) *procBackend {
+	return &procBackend{base: base}
+}
+
+// Name returns the name of the backend
+func (p *procBackend) Name() string {
+	return "kernel"
+}
+
+// Write writes the field and value to the dict proc write node
+func (p *procBackend) Write(table string, key interface{}, field string, value interface{}) error {
+	setstr := fmt.Sprintf("%s%s%s%s", generateTable(table), generateKey(key), generateField(field), generateValue(value))
+	return p.writeEntry(setstr)
+}
+
+// WriteBatch writes all of the fields for the key through one open of the write node.
+// This is still one write(2) per field because the module parses a single entry per
+// write. Only the open, sync, and close are shared across the batch. A field that
+// fails does not stop the others and the first error is returned.
+func (p *procBackend) WriteBatch(table string, key interface{}, fields []Field) error {
+	file, err := p.open("write", os.O_WRONLY)
+	if err != nil {
+		logger.Warn("WriteBatch: Failed to open %s\n", p.base+"/write")
+		return err
+	}
+
+	defer file.Close()
+
+	var first error
+	prefix := generateTable(table) + generateKey(key)
+	for _, item := range fields {
+		setstr := prefix + generateField(item.Name) + generateValue(item.Value)
+		atomic.AddUint64(&p.writes, 1)
+		_, err = file.WriteString(setstr)
+		if err != nil {
+			logger.Warn("WriteBatch: Failed to write %s\n", setstr)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	file.Sync()
+
+	return first
+}
+
+// Delete writes the table and key to the dict proc delete node
+func (p *procBackend) Delete(table string, key interface{}) error {
+	setstr := fmt.Sprintf("%s%s", generateTable(table), generateKey(key))
+	return p.deleteEntry(setstr)
+}
+
+// Dictionary reads the entries for the table and key from the dict proc read node
+func (p *procBackend) Dictionary(table string, key interface{}) ([]Entry, error) {
+	return p.read(fmt.Sprintf("%s%s", generateTable(table), generateKey(key)))
+}
+
+// Table reads the entries for the table from the dict proc read node
+func (p *procBackend) Table(table string) ([]Entry, error) {
+	return p.read(generateTable(table))
+}
+
+// All reads every entry from the dict proc all node
+func (p *procBackend) All() ([]Entry, error) {
+	file, err := p.open("all", os.O_RDWR)
+
+	if err != nil {
+		logger.Warn("GetAll: Failed to open %s\n", p.base+"/all")
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries = append(entries, parseEntry(scanner.Text()))
+	}
+	return entries, err
+}
+
+// read writes the selector to the dict proc read node and parses the entries
+// This function will return an error if it cannot open or read
+// /proc/net/dict/read
+func (p *procBackend) read(setstr string) ([]Entry, error) {
+	file, err := p.open("read", os.O_RDWR)
+
+	if err != nil {
+		logger.Warn("read: Failed to open %s\n", p.base+"/read")
+		return nil, err
+	}
+
+	defer file.Close()
+
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+
+	atomic.AddUint64(&p.writes, 1)
+	_, err = file.WriteString(setstr)
+
+	if err != nil {
+		logger.Warn("read: Failed to write %s\n", setstr)
+		return nil, err
+	}
+
+	file.Sync()
+
+	var entries []Entry
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries = append(entries, parseEntry(scanner.Text()))
+	}
+	return entries, err
+}
+
+// open opens one of the dict proc nodes
+func (p *procBackend) open(node string, flag int) (*os.File, error) {
+	atomic.AddUint64(&p.opens, 1)
+	return os.OpenFile(p.base+"/"+node, flag, 0660)
+}
+
+// writeEntry writes out a set string to the dict proc write node
+// This function will return an error if it is unable to open
+// or write to /proc/net/dict/write
+func (p *procBackend) writeEntry(setstr string) error {
+	file, err := p.open("write", os.O_WRONLY)
+
+	if err != nil {
+		logger.Warn("writeEntry: Failed to open %s\n", p.base+"/write")
+		return err
+	}
+
+	defer file.Close()
+
+	atomic.AddUint64(&p.writes, 1)
+	_, err = file.WriteString(setstr)
+	if err != nil {
+		logger.Warn("writeEntry: Failed to write %s\n", setstr)
+		return (err)
+	}
+
+	file.Sync()
+
+	return err
+}
+
+// deleteEntry writes out a string to the dict proc delete node
+// This function will return an error if it is unable to open
+// or write to /proc/net/dict/delete
+func (p *procBackend) deleteEntry(setstr string) error {
+	file, err := p.open("delete", os.O_WRONLY)
+
+	if err != nil {
+		logger.Warn("deleteEntry: Failed to open %s\n", p.base+"/delete")
+		return err
+	}
+
+	defer file.Close()
+
+	atomic.AddUint64(&p.writes, 1)
+	_, err = file.WriteString(setstr)
+	if err != nil {
+		logger.Err("%OC|dict: deleteEntry: Failed to write %s\n", "dict_write_failure", 0, setstr)
+		return (err)
+	}
+
+	file.Sync()
+
+	return err
+}
@@ -0,0 +1,222 @@
+package dict
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// These are the names of the value types used in the JSON API
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeInt64  = "int64"
+	TypeBool   = "bool"
+	TypeIP     = "ip"
+	TypeMAC    = "mac"
+
+	TypeSignedInt   = "sint"
+	TypeSignedInt64 = "sint64"
+	TypeFloat       = "float"
+	TypeStringList  = "string_list"
+	TypeIPList      = "ip_list"
+)
+
+// Tables holds the key type for each of the dict tables that can be
+// managed through the API. The sessions table is owned by packetd.
+var Tables = map[string]string{
+	"host":   TypeIP,
+	"user":   TypeString,
+	"device": TypeMAC,
+}
+
+var fieldPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// TypedValue is a dict value along with the name of its type
+// IP and MAC values are stored as strings so they can be used in JSON
+type TypedValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// NewTypedValue returns the typed value for a value read from dict
+func NewTypedValue(value interface{}) TypedValue {
+	switch v := value.(type) {
+	case string:
+		return TypedValue{Type: TypeString, Value: v}
+	case uint32:
+		return TypedValue{Type: TypeInt, Value: v}
+	case uint64:
+		return TypedValue{Type: TypeInt64, Value: v}
+	case bool:
+		return TypedValue{Type: TypeBool, Value: v}
+	case net.IP:
+		return TypedValue{Type: TypeIP, Value: v.String()}
+	case net.HardwareAddr:
+		return TypedValue{Type: TypeMAC, Value: v.String()}
+	case int32:
+		return TypedValue{Type: TypeSignedInt, Value: v}
+	case int64:
+		return TypedValue{Type: TypeSignedInt64, Value: v}
+	case float64:
+		return TypedValue{Type: TypeFloat, Value: v}
+	case []string:
+		return TypedValue{Type: TypeStringList, Value: v}
+	case []net.IP:
+		list := make([]string, len(v))
+		for i, item := range v {
+			list[i] = item.String()
+		}
+		return TypedValue{Type: TypeIPList, Value: list}
+	}
+	return TypedValue{Type: fmt.Sprintf("%T", value), Value: value}
+}
+
+// Parse returns the value converted to the dict type
+// Numbers can be JSON numbers or strings
+func (t TypedValue) Parse() (interface{}, error) {
+	raw := t.Value
+	if number, ok := raw.(json.Number); ok {
+		raw = number.String()
+	}
+	if number, ok := raw.(float64); ok {
+		raw = strconv.FormatFloat(number, 'f', -1, 64)
+	}
+
+	switch t.Type {
+	case TypeString:
+		str, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid string value: %v", t.Value)
+		}
+		if str == "" || strings.ContainsAny(str, ",\n") {
+			return nil, fmt.Errorf("string value must not be empty or contain commas or newlines")
+		}
+		return str, nil
+	case TypeInt:
+		str, _ := raw.(string)
+		value, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int value: %v", t.Value)
+		}
+		return uint32(value), nil
+	case TypeInt64:
+		str, _ := raw.(string)
+		value, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int64 value: %v", t.Value)
+		}
+		return value, nil
+	case TypeSignedInt:
+		str, _ := raw.(string)
+		value, err := strconv.ParseInt(str, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sint value: %v", t.Value)
+		}
+		return int32(value), nil
+	case TypeSignedInt64:
+		str, _ := raw.(string)
+		value, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sint64 value: %v", t.Value)
+		}
+		return value, nil
+	case TypeFloat:
+		str, _ := raw.(string)
+		value, err := strconv.ParseFloat(str, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid float value: %v", t.Value)
+		}
+		return value, nil
+	case TypeStringList, TypeIPList:
+		return t.parseList()
+	case TypeBool:
+		switch v := raw.(type) {
+		case bool:
+			return v, nil
+		case string:
+			value, err := strconv.ParseBool(v)
+			if err == nil {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid bool value: %v", t.Value)
+	case TypeIP:
+		str, _ := raw.(string)
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip value: %v", t.Value)
+		}
+		return ip, nil
+	case TypeMAC:
+		str, _ := raw.(string)
+		mac, err := net.ParseMAC(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac value: %v", t.Value)
+		}
+		return mac, nil
+	}
+
+	return nil, fmt.Errorf("invalid type: %s", t.Type)
+}
+
+// parseList returns a string or IP list from a JSON array
+func (t TypedValue) parseList() (interface{}, error) {
+	items, ok := t.Value.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("invalid %s value: %v", t.Type, t.Value)
+	}
+
+	itemType := TypeString
+	if t.Type == TypeIPList {
+		itemType = TypeIP
+	}
+
+	var names []string
+	var addresses []net.IP
+	for _, item := range items {
+		value, err := TypedValue{Type: itemType, Value: item}.Parse()
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := value.(net.IP); ok {
+			addresses = append(addresses, ip)
+		} else {
+			str := value.(string)
+			if strings.Contains(str, listSeparator) {
+				return nil, fmt.Errorf("list items must not contain %s", listSeparator)
+			}
+			names = append(names, str)
+		}
+	}
+
+	if t.Type == TypeIPList {
+		return addresses, nil
+	}
+	return names, nil
+}
+
+// ParseKey returns the key for the table converted to the key type of the table
+func ParseKey(table string, key string) (interface{}, error) {
+	keyType, ok := Tables[table]
+	if !ok {
+		return nil, fmt.Errorf("invalid table: %s", table)
+	}
+	value, err := TypedValue{Type: keyType, Value: key}.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s key: %s", table, key)
+	}
+	return value, nil
+}
+
+// ValidField returns an error if the field name can not be stored in dict
+func ValidField(field string) error {
+	if !fieldPattern.MatchString(field) {
+		return fmt.Errorf("invalid field: %s", field)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 )
 
@@ -177,6 +178,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 					logger.Err("%OC|Conntrack NEW session tuple mismatch: %v  %v != %v\n", "conntrack_new_session_mismatch", 0, ctid, session.GetClientSideTuple().String(), conntrack.ClientSideTuple.String())
 				} else {
 					logger.Debug("Conntrack NEW session tuple mismatch: %v  %v != %v\n", ctid, session.GetClientSideTuple().String(), conntrack.ClientSideTuple.String())
+					session.setOutcome(unconfirmedOutcome(session))
 				}
 
 				// Remove that session from the sessionTable - we can conclude its not valid anymore
@@ -200,6 +202,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			session.SetServerInterfaceID(uint8((conntrack.ConnMark & 0x0000FF00) >> 8))
 			session.SetServerInterfaceType(uint8((conntrack.ConnMark & 0x0C000000) >> 26))
 			session.SetConntrackConfirmed(true)
+			session.setOutcome(OutcomeConfirmed)
 			session.SetConntrackPointer(conntrack)
 			session.SetLastActivity(time.Now())
 			session.AddEventCount(1)
@@ -301,6 +304,31 @@ func findConntrack(ctid uint32) (*Conntrack, bool) {
 	return entry, status
 }
 
+// FindConntrack returns the conntrack entry for the argumented ctid or nil if not found
+func FindConntrack(ctid uint32) *Conntrack {
+	entry, _ := findConntrack(ctid)
+	return entry
+}
+
+// FindConntrackByTuple returns the conntrack entry with the argumented client side tuple or nil if not found
+func FindConntrackByTuple(tuple Tuple) *Conntrack {
+	conntrackTableMutex.Lock()
+	defer conntrackTableMutex.Unlock()
+	for _, entry := range conntrackTable {
+		if entry.ClientSideTuple.Equal(tuple) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// DeleteConntrack removes the conntrack entry from the kernel which terminates the session
+// The local entry is removed when the kernel sends the DELETE event
+func DeleteConntrack(ctid uint32, family uint8, tuple Tuple) error {
+	logger.Debug("Deleting conntrack entry %d %v\n", ctid, tuple)
+	return kernel.DeleteConntrack(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort)
+}
+
 // insertConntrack adds an entry to the conntrack table
 func insertConntrack(ctid uint32, entry *Conntrack) {
 	logger.Trace("Insert conntrack entry %d\n", ctid)
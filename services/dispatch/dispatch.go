@@ -3,6 +3,7 @@
 // 1) NFqueue (netfilter queue) packets
 // 2) Conntrack events (New, Update, Destroy)
 // 3) Netlogger events (from NFLOG target)
+// along with the outcome of each session once it is known
 // The dispatch will register global callbacks with the kernel package
 // and then dispatch events to subscribers accordingly
 package dispatch
@@ -23,6 +24,7 @@ type SubscriptionHolder struct {
 	NfqueueFunc   NfqueueHandlerFunction
 	ConntrackFunc ConntrackHandlerFunction
 	NetloggerFunc NetloggerHandlerFunction
+	OutcomeFunc   OutcomeHandlerFunction
 }
 
 // The Priority determines the calling order for nfqueue subscribers. When packets
@@ -56,6 +58,9 @@ const ClassifyPriority = 2
 // DNSPriority ...
 const DNSPriority = 2
 
+// EncryptedDNSPriority ...
+const EncryptedDNSPriority = 2
+
 // ExamplePriority ...
 const ExamplePriority = 2
 
@@ -65,6 +70,9 @@ const GeoipPriority = 2
 // RevDNSPriority ...
 const RevDNSPriority = 2
 
+// SinkholePriority ...
+const SinkholePriority = 2
+
 // SniPriority ...
 const SniPriority = 2
 
@@ -44,12 +44,15 @@ type NfqueueMessage struct {
 // NfqueueResult returns status and other information from a subscription handler function
 type NfqueueResult struct {
 	SessionRelease bool
+	// PacketDrop drops the packet instead of accepting it
+	PacketDrop bool
 }
 
 // subscriberResult returns status and other information from a subscription handler function
 type subscriberResult struct {
 	owner          string
 	sessionRelease bool
+	packetDrop     bool
 }
 
 // ReleaseSession is called by a subscriber to stop receiving traffic for a session
@@ -180,6 +183,10 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 				// it in the conntrack table for the conntrack handle to handle
 
 				logger.Debug("Conflicting session [%d] %v != %v\n", ctid, mess.MsgTuple, session.GetClientSideTuple())
+				// In case 1 the old session was blocked or merged. In case 2 it already has an outcome.
+				if !session.GetConntrackConfirmed() {
+					session.setOutcome(unconfirmedOutcome(session))
+				}
 				// We don't need to flush here - this is a new session its already been flushed
 				// session.flushDict()
 				session.removeFromSessionTable()
@@ -264,6 +271,7 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 
 	subcount := 0
 	priority := 0
+	verdict := NfAccept
 	var timeMap = make(map[string]float64)
 	var timeMapLock = sync.RWMutex{}
 
@@ -288,7 +296,7 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 
 				go func() {
 					result := val.NfqueueFunc(mess, ctid, newSession)
-					c <- subscriberResult{owner: key, sessionRelease: result.SessionRelease}
+					c <- subscriberResult{owner: key, sessionRelease: result.SessionRelease, packetDrop: result.PacketDrop}
 				}()
 
 				select {
@@ -321,6 +329,9 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 				if result.sessionRelease {
 					ReleaseSession(session, result.owner)
 				}
+				if result.packetDrop {
+					verdict = NfDrop
+				}
 			}
 		}
 
@@ -338,8 +349,8 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 		timeMapLock.RUnlock()
 	}
 
-	// return the updated mark to be set on the packet
-	return NfAccept
+	// return the verdict for the packet
+	return verdict
 }
 
 // createSession creates a new session and inserts the forward mapping
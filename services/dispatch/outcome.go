@@ -0,0 +1,94 @@
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The outcome of a session is recorded once we know how it ended up in netfilter.
+// Sessions that are confirmed by conntrack are allowed. Sessions that are never
+// confirmed were dropped before they reached the conntrack confirm hook, or they
+// were merged with the confirmed conntrack entry of another session with the
+// same tuple. Bypassed sessions never reach the nfqueue so they have no Session
+// and are only logged from their conntrack entry.
+const (
+	OutcomeConfirmed = "confirmed"
+	OutcomeBlocked   = "blocked"
+	OutcomeMerged    = "merged"
+	OutcomeBypassed  = "bypassed"
+)
+
+// unconfirmedTimeout is how long a session can wait for conntrack confirmation
+// before it is considered blocked. Confirmation normally happens as soon as the
+// first packet leaves netfilter.
+const unconfirmedTimeout = 30 * time.Second
+
+// OutcomeHandlerFunction defines a pointer to a session outcome callback function
+type OutcomeHandlerFunction func(*Session, string)
+
+var outcomeSubList = make(map[string]SubscriptionHolder)
+var outcomeSubMutex sync.Mutex
+
+// InsertOutcomeSubscription adds a subscription for receiving session outcomes
+func InsertOutcomeSubscription(owner string, function OutcomeHandlerFunction) {
+	var holder SubscriptionHolder
+	logger.Info("Adding Outcome Subscription (%s)\n", owner)
+
+	holder.Owner = owner
+	holder.OutcomeFunc = function
+	outcomeSubMutex.Lock()
+	outcomeSubList[owner] = holder
+	outcomeSubMutex.Unlock()
+}
+
+// GetOutcome gets the session outcome or an empty string if it is not known yet
+func (sess *Session) GetOutcome() string {
+	sess.outcomeLock.Lock()
+	defer sess.outcomeLock.Unlock()
+	return sess.outcome
+}
+
+// setOutcome records the session outcome and calls the subscribers
+// The first outcome recorded for a session is final
+func (sess *Session) setOutcome(outcome string) {
+	sess.outcomeLock.Lock()
+	if sess.outcome != "" {
+		sess.outcomeLock.Unlock()
+		return
+	}
+	sess.outcome = outcome
+	sess.outcomeLock.Unlock()
+
+	logger.Debug("Session outcome %s [%d] %v\n", outcome, sess.GetConntrackID(), sess.GetClientSideTuple())
+
+	outcomeSubMutex.Lock()
+	var list []SubscriptionHolder
+	for _, holder := range outcomeSubList {
+		list = append(list, holder)
+	}
+	outcomeSubMutex.Unlock()
+
+	for _, holder := range list {
+		holder.OutcomeFunc(sess, outcome)
+	}
+}
+
+// unconfirmedOutcome returns the outcome of a session that lost its ctid before
+// it was confirmed. It was merged if another confirmed session has the same
+// client side tuple, otherwise its packets were dropped. This searches the whole
+// session table so cleanSessionTable builds an index of the tuples instead.
+func unconfirmedOutcome(sess *Session) string {
+	tuple := sess.GetClientSideTuple()
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	for _, other := range sessionTable {
+		if other != sess && other.GetConntrackConfirmed() && other.GetClientSideTuple().Equal(tuple) {
+			return OutcomeMerged
+		}
+	}
+	return OutcomeBlocked
+}
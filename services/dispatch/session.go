@@ -67,6 +67,10 @@ type Session struct {
 	// Packets that never reach this point (blocked packets) often never get confirmed
 	conntrackConfirmed uint32
 
+	// outcome is how the session ended up in netfilter (see outcome.go)
+	outcome     string
+	outcomeLock sync.Mutex
+
 	// The conntrack entry associated with this session
 	conntrackPointer *Conntrack
 	conntrackLock    sync.Mutex
@@ -393,6 +397,12 @@ func findSession(ctid uint32) *Session {
 // insertSessionTable adds an sess to the session table
 func insertSessionTable(ctid uint32, sess *Session) {
 	logger.Trace("Insert session index %v -> %v\n", ctid, sess.GetClientSideTuple())
+
+	// refresh the last seen time for any host entries the session references
+	tuple := sess.GetClientSideTuple()
+	dict.TouchHost(tuple.ClientAddress)
+	dict.TouchHost(tuple.ServerAddress)
+
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 	if sessionTable[ctid] != nil {
@@ -405,10 +415,22 @@ func insertSessionTable(ctid uint32, sess *Session) {
 
 // cleanSessionTable cleans the session table by removing stale entries
 func cleanSessionTable() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
+	var unconfirmed []*Session
+
+	// the client side tuples of the confirmed sessions so we can tell which
+	// unconfirmed sessions were merged without searching the table for each one
+	confirmed := make(map[string]bool)
 
+	sessionMutex.Lock()
 	for ctid, session := range sessionTable {
+		// Sessions that are not confirmed soon after they are created were blocked or merged
+		// We record the outcome now rather than waiting for the stale purge below
+		if session.GetConntrackConfirmed() {
+			confirmed[session.GetClientSideTuple().String()] = true
+		} else if session.GetOutcome() == "" && time.Since(session.GetCreationTime()) > unconfirmedTimeout {
+			unconfirmed = append(unconfirmed, session)
+		}
+
 		// Having stale sessions is normal if sessions get blocked
 		// Their conntracks never get confirmed and thus there is never a delete conntrack event
 		// These sessions will hang in the table around and get cleaned up here.
@@ -423,6 +445,16 @@ func cleanSessionTable() {
 			delete(sessionTable, ctid)
 		}
 	}
+	sessionMutex.Unlock()
+
+	// the outcome subscribers are called without holding the session table lock
+	for _, session := range unconfirmed {
+		if confirmed[session.GetClientSideTuple().String()] {
+			session.setOutcome(OutcomeMerged)
+		} else {
+			session.setOutcome(OutcomeBlocked)
+		}
+	}
 }
 
 // printSessionTable prints the session table
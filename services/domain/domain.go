@@ -0,0 +1,135 @@
+package domain
+
+import (
+	"strings"
+
+	"github.com/untangle/packetd/services/category"
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// The domain of a session is the single best name from the different ways we
+// learn the name of the server. The plugins call UpdateSession whenever they
+// find a name and we keep the one from the most preferred source, replacing it
+// if a better source arrives later in the session. The chosen name is stored in
+// the domain attachment, dict field and sessions column along with the source
+// and the domain_category from the category service.
+
+// The domain sources in order of preference
+const (
+	// SourceSNI is preferred because the client specified exactly the domain it is seeking
+	SourceSNI = "ssl_sni"
+	// SourceDNSHint is the name the client looked up for the server address
+	SourceDNSHint = "server_dns_hint"
+	// SourceCertificate is specified by the server, but not exact since it is
+	// often a wildcard or a name shared by many sites
+	SourceCertificate = "certificate_subject_cn"
+)
+
+var sourcePreference = []string{SourceSNI, SourceDNSHint, SourceCertificate}
+
+// noCategory is written to the domain_category dict field when the domain has no
+// category. dict ignores empty strings and can not remove a single field so an
+// explicit value is needed to replace the category of the previous domain.
+const noCategory = "none"
+
+// UpdateSession sets the domain of the session to the name from the argumented
+// source unless the session already has a domain from a more preferred source
+func UpdateSession(session *dispatch.Session, source string, name string) {
+	rank := sourceRank(source)
+	if rank < 0 {
+		logger.Warn("Unknown domain source %s\n", source)
+		return
+	}
+	name = normalize(name)
+	if name == "" {
+		return
+	}
+
+	attachments := session.LockAttachments()
+	current, _ := attachments["domain_source"].(string)
+	if !better(current, attachments["domain"], source, name) {
+		session.UnlockAttachments()
+		return
+	}
+	attachments["domain"] = name
+	attachments["domain_source"] = source
+	domainCategory := category.Lookup(name)
+	if domainCategory != "" {
+		attachments["domain_category"] = domainCategory
+	} else {
+		delete(attachments, "domain_category")
+	}
+	session.UnlockAttachments()
+
+	logger.Debug("Setting domain name:%s source:%s category:%s ctid:%d\n", name, source, domainCategory, session.GetConntrackID())
+	writeDict(session.GetConntrackID(), name, source, domainCategory)
+
+	logEvent(session, name, source, domainCategory)
+}
+
+// writeDict writes the domain fields to the session dictionary
+func writeDict(ctid uint32, name string, source string, domainCategory string) error {
+	if domainCategory == "" {
+		domainCategory = noCategory
+	}
+
+	batch := dict.NewSessionBatch(ctid)
+	batch.Add("domain", name)
+	batch.Add("domain_source", source)
+	batch.Add("domain_category", domainCategory)
+	return batch.Commit()
+}
+
+// sourceRank returns the preference of a source where lower is better or -1 if unknown
+func sourceRank(source string) int {
+	for i, item := range sourcePreference {
+		if item == source {
+			return i
+		}
+	}
+	return -1
+}
+
+// better returns true if the name from the source should replace the current domain
+// A different name from the same source replaces the current one
+func better(currentSource string, currentName interface{}, source string, name string) bool {
+	if currentSource == "" {
+		return true
+	}
+	if currentSource == source {
+		return currentName != name
+	}
+	current := sourceRank(currentSource)
+	return current < 0 || sourceRank(source) < current
+}
+
+// normalize returns the name in lower case without a trailing dot or a
+// leading certificate wildcard
+func normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimSuffix(name, ".")
+	name = strings.TrimPrefix(name, "*.")
+	return name
+}
+
+// logEvent logs an update event that updates the domain columns
+// The category is cleared when the new domain does not have one
+func logEvent(session *dispatch.Session, name string, source string, domainCategory string) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+
+	modifiedColumns := make(map[string]interface{})
+	modifiedColumns["domain"] = name
+	modifiedColumns["domain_source"] = source
+	if domainCategory != "" {
+		modifiedColumns["domain_category"] = domainCategory
+	} else {
+		modifiedColumns["domain_category"] = nil
+	}
+
+	reports.LogEvent(reports.CreateEvent("session_domain", "sessions", 2, columns, modifiedColumns))
+}
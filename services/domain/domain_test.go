@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/untangle/packetd/services/dict"
+)
+
+func TestBetter(t *testing.T) {
+	tests := []struct {
+		currentSource string
+		currentName   interface{}
+		source        string
+		name          string
+		expected      bool
+	}{
+		{"", nil, SourceCertificate, "example.com", true},
+		{SourceCertificate, "example.com", SourceDNSHint, "www.example.com", true},
+		{SourceDNSHint, "www.example.com", SourceSNI, "www.example.com", true},
+		{SourceSNI, "www.example.com", SourceDNSHint, "other.example.com", false},
+		{SourceSNI, "www.example.com", SourceCertificate, "example.com", false},
+		{SourceDNSHint, "www.example.com", SourceDNSHint, "www.example.com", false},
+		{SourceDNSHint, "www.example.com", SourceDNSHint, "cdn.example.com", true},
+	}
+
+	for _, test := range tests {
+		if better(test.currentSource, test.currentName, test.source, test.name) != test.expected {
+			t.Errorf("better(%s, %v, %s, %s) != %v", test.currentSource, test.currentName, test.source, test.name, test.expected)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"WWW.Example.COM.": "www.example.com",
+		"*.example.com":    "example.com",
+		" example.com ":    "example.com",
+		"":                 "",
+	}
+
+	for name, expected := range tests {
+		if normalize(name) != expected {
+			t.Errorf("normalize(%q) = %q", name, normalize(name))
+		}
+	}
+}
+
+func TestWriteDictCategory(t *testing.T) {
+	dict.SetBackend(dict.NewMemoryBackend())
+
+	field := func() interface{} {
+		sessions, err := dict.GetSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessions[42]["domain_category"]
+	}
+
+	if err := writeDict(42, "ads.example.com", SourceSNI, "advertising"); err != nil {
+		t.Fatal(err)
+	}
+	if value := field(); value != "advertising" {
+		t.Fatalf("domain_category = %v", value)
+	}
+
+	// a domain without a category must replace the previous category
+	if err := writeDict(42, "www.example.org", SourceSNI, ""); err != nil {
+		t.Fatal(err)
+	}
+	if value := field(); value != noCategory {
+		t.Errorf("domain_category = %v after a domain without a category", value)
+	}
+}
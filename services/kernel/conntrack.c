@@ -19,6 +19,8 @@ struct update_mark_args {
 	uint32_t	ctid;
 	uint32_t	mask;
 	uint32_t	val;
+	uint32_t	mark;
+	int			found;
 };
 
 #define BUFFER_SIZE 1024*1024*8
@@ -218,3 +220,125 @@ void conntrack_dump(void)
 	ret = nfct_send(nfcth,NFCT_Q_DUMP,&family);
 	if (ret < 0) logmessage(LOG_WARNING,logsrc,"nfct_send() result:%d errno:%d\n",ret,errno);
 }
+
+static struct nf_conntrack *conntrack_build(struct conntrack_info *info)
+{
+	struct nf_conntrack		*ct;
+
+	ct = nfct_new();
+	if (ct == NULL) return(NULL);
+
+	nfct_set_attr_u8(ct,ATTR_ORIG_L3PROTO,info->family);
+	nfct_set_attr_u8(ct,ATTR_ORIG_L4PROTO,info->orig_proto);
+
+	if (info->family == AF_INET) {
+		nfct_set_attr(ct,ATTR_ORIG_IPV4_SRC,&info->orig_saddr);
+		nfct_set_attr(ct,ATTR_ORIG_IPV4_DST,&info->orig_daddr);
+	} else {
+		nfct_set_attr(ct,ATTR_ORIG_IPV6_SRC,&info->orig_saddr);
+		nfct_set_attr(ct,ATTR_ORIG_IPV6_DST,&info->orig_daddr);
+	}
+
+	// ports only apply to protocols that have them
+	if (info->orig_sport != 0 || info->orig_dport != 0) {
+		nfct_set_attr_u16(ct,ATTR_ORIG_PORT_SRC,htobe16(info->orig_sport));
+		nfct_set_attr_u16(ct,ATTR_ORIG_PORT_DST,htobe16(info->orig_dport));
+	}
+
+	// when we know the conntrack ID the kernel will only match that entry
+	if (info->conn_id != 0) nfct_set_attr_u32(ct,ATTR_ID,info->conn_id);
+
+	return(ct);
+}
+
+int conntrack_delete(struct conntrack_info *info)
+{
+	struct nfct_handle		*h;
+	struct nf_conntrack		*ct;
+	int						ret;
+
+	if (info->family != AF_INET && info->family != AF_INET6) return(EAFNOSUPPORT);
+
+	// we use a separate handle since the main handle is owned by the conntrack thread
+	h = nfct_open(CONNTRACK,0);
+	if (h == NULL) {
+		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_open()\n",errno);
+		return(errno);
+	}
+
+	ct = conntrack_build(info);
+	if (ct == NULL) {
+		nfct_close(h);
+		return(ENOMEM);
+	}
+
+	ret = nfct_query(h,NFCT_Q_DESTROY,ct);
+	if (ret != 0) {
+		ret = errno;
+		logmessage(LOG_DEBUG,logsrc,"Error %d deleting conntrack [%u]\n",ret,info->conn_id);
+	}
+
+	nfct_destroy(ct);
+	nfct_close(h);
+	return(ret);
+}
+
+static int update_mark_callback(enum nf_conntrack_msg_type type,struct nf_conntrack *ct,void *data)
+{
+	struct update_mark_args		*args = (struct update_mark_args *)data;
+	uint32_t					mark;
+
+	if (args->ctid != 0 && nfct_get_attr_u32(ct,ATTR_ID) != args->ctid) return(NFCT_CB_CONTINUE);
+
+	mark = nfct_get_attr_u32(ct,ATTR_MARK);
+	args->mark = (mark & ~args->mask) | (args->val & args->mask);
+	args->found = 1;
+	return(NFCT_CB_STOP);
+}
+
+int conntrack_update_mark(struct conntrack_info *info,uint32_t mask,uint32_t value)
+{
+	struct update_mark_args		args;
+	struct nfct_handle			*h;
+	struct nf_conntrack			*ct;
+	int							ret;
+
+	if (info->family != AF_INET && info->family != AF_INET6) return(EAFNOSUPPORT);
+
+	h = nfct_open(CONNTRACK,0);
+	if (h == NULL) {
+		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_open()\n",errno);
+		return(errno);
+	}
+
+	ct = conntrack_build(info);
+	if (ct == NULL) {
+		nfct_close(h);
+		return(ENOMEM);
+	}
+
+	// fetch the current mark so we only change the bits in the mask
+	memset(&args,0,sizeof(args));
+	args.ctid = info->conn_id;
+	args.mask = mask;
+	args.val = value;
+	nfct_callback_register(h,NFCT_T_ALL,update_mark_callback,&args);
+
+	ret = nfct_query(h,NFCT_Q_GET,ct);
+	if (ret != 0) {
+		ret = errno;
+	} else if (args.found == 0) {
+		ret = ENOENT;
+	} else {
+		nfct_set_attr_u32(ct,ATTR_MARK,args.mark);
+		ret = nfct_query(h,NFCT_Q_UPDATE,ct);
+		if (ret != 0) ret = errno;
+	}
+
+	if (ret != 0) logmessage(LOG_DEBUG,logsrc,"Error %d updating conntrack mark [%u]\n",ret,info->conn_id);
+
+	nfct_callback_unregister(h);
+	nfct_destroy(ct);
+	nfct_close(h);
+	return(ret);
+}
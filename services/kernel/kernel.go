@@ -11,6 +11,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -39,6 +40,19 @@ var shutdownFlag uint32
 var shutdownChannel = make(chan bool)
 var shutdownChannelCloseOnce sync.Once
 
+// These track the packets passed to the nfqueue callback and the verdicts returned
+// so the watchdog can tell when packet processing has stalled
+var nfqueueReceived uint64
+var nfqueueVerdicts uint64
+var nfqueueLastVerdict int64
+
+// NfqueueStats holds the nfqueue callback counters
+type NfqueueStats struct {
+	Received    uint64
+	Verdicts    uint64
+	LastVerdict time.Time
+}
+
 // These maps are used to track ctid's we see during playback. They are set to the
 // maps passed to the playback function and cleared when playback is finished.
 var nfCleanTracker map[uint32]bool
@@ -155,6 +169,20 @@ func SetBypassFlag(value int) {
 	C.set_bypass_flag(C.int(value))
 }
 
+// GetNfqueueStats returns the number of packets received and verdicts set by
+// the nfqueue callback and the time of the last verdict
+func GetNfqueueStats() NfqueueStats {
+	var stats NfqueueStats
+	// load verdicts first so it can never be larger than received
+	stats.Verdicts = atomic.LoadUint64(&nfqueueVerdicts)
+	stats.Received = atomic.LoadUint64(&nfqueueReceived)
+	last := atomic.LoadInt64(&nfqueueLastVerdict)
+	if last != 0 {
+		stats.LastVerdict = time.Unix(0, last)
+	}
+	return stats
+}
+
 // GetWarehouseFlag gets the value of the warehouse traffic capture and playback flag
 func GetWarehouseFlag() int {
 	return int(C.get_warehouse_flag())
@@ -185,6 +213,51 @@ func CloseWarehouseCapture() {
 	C.close_warehouse_capture()
 }
 
+// DeleteConntrack removes a conntrack entry from the kernel. The entry is found using the
+// original direction tuple. If ctid is not zero only the entry with that ID is removed.
+func DeleteConntrack(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16) error {
+	info := makeConntrackInfo(ctid, family, protocol, client, server, clientPort, serverPort)
+	ret := C.conntrack_delete(&info)
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
+
+// UpdateConntrackMark changes the bits of a conntrack mark selected by mask to the bits in value
+// The entry is found the same way as DeleteConntrack
+func UpdateConntrackMark(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16, mask uint32, value uint32) error {
+	info := makeConntrackInfo(ctid, family, protocol, client, server, clientPort, serverPort)
+	ret := C.conntrack_update_mark(&info, C.uint32_t(mask), C.uint32_t(value))
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
+
+// makeConntrackInfo fills a conntrack_info structure with the original direction tuple
+func makeConntrackInfo(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16) C.struct_conntrack_info {
+	var info C.struct_conntrack_info
+
+	info.conn_id = C.u_int32_t(ctid)
+	info.family = C.u_int8_t(family)
+	info.orig_proto = C.u_int8_t(protocol)
+	info.orig_sport = C.u_int16_t(clientPort)
+	info.orig_dport = C.u_int16_t(serverPort)
+
+	if family == C.AF_INET {
+		copy((*[4]byte)(unsafe.Pointer(&info.orig_saddr))[:], client.To4())
+		copy((*[4]byte)(unsafe.Pointer(&info.orig_daddr))[:], server.To4())
+	}
+
+	if family == C.AF_INET6 {
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_saddr))[:], client.To16())
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_daddr))[:], server.To16())
+	}
+
+	return info
+}
+
 // RegisterConntrackCallback registers the global conntrack callback for handling conntrack events
 func RegisterConntrackCallback(cb ConntrackCallback) {
 	conntrackCallback = cb
@@ -249,11 +322,17 @@ func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint
 		verdict := nfqueueCallback(conntrackID, fam, packet, packetLength, pmark)
 		if playflag == 0 {
 			C.nfqueue_set_verdict(index, nfid, C.uint32_t(verdict))
+			atomic.AddUint64(&nfqueueVerdicts, 1)
+			atomic.StoreInt64(&nfqueueLastVerdict, time.Now().UnixNano())
 		}
 		C.nfqueue_free_buffer(buffer)
 
 	}
 
+	if playflag == 0 {
+		atomic.AddUint64(&nfqueueReceived, 1)
+	}
+
 	// if playflag != 0 then we are doing a warehouse recording playback
 	// in this case we often speed up these playbacks, and as such
 	// if we launch this asynchronously and return the next packet will
@@ -434,8 +434,10 @@ func initLoggerConfig() {
 	config["packetd"] = "INFO"
 	config["reports"] = "INFO"
 	config["restd"] = "INFO"
+	config["rules"] = "INFO"
 	config["settings"] = "INFO"
 	config["warehouse"] = "INFO"
+	config["watchdog"] = "INFO"
 
 	// convert the config map to a json object
 	jstr, err := json.MarshalIndent(config, "", "")
@@ -33,6 +33,15 @@ func AddCounter(name string, amount uint64) uint64 {
 	return counterTable[name]
 }
 
+// SetCounter is called to replace the value of a named counter
+// It is used for counters that track a current size rather than a total
+func SetCounter(name string, value uint64) {
+	counterMutex.Lock()
+	defer counterMutex.Unlock()
+
+	counterTable[name] = value
+}
+
 // GetCounter is called to get the value of a named counter
 func GetCounter(name string) uint64 {
 	counterMutex.Lock()
@@ -0,0 +1,296 @@
+package reports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	// ExportExcel is CSV with a byte order mark, CRLF line endings,
+	// timestamps in a format that spreadsheets recognize as dates and
+	// text that cannot be mistaken for a formula
+	ExportExcel = "excel"
+)
+
+// exportTimeout is the longest the export query can run. The results are copied
+// to a temporary table so the database is only locked while the query runs and
+// not while the client downloads the file.
+const exportTimeout = 30 * time.Second
+
+// exportMaxRows is the most rows an export copies. The temporary table is in
+// /tmp with the database so this bounds the memory an export can use.
+var exportMaxRows = 200000
+
+// exportFlushRows is how often the output is flushed to the client
+const exportFlushRows = 1000
+
+// the columns that hold milliseconds since the epoch
+var timestampColumns = map[string]bool{
+	"time_stamp": true,
+	"end_time":   true,
+	"time_trunc": true,
+	"last_seen":  true,
+}
+
+var filenameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Export is a report query whose results are written to a file
+type Export struct {
+	Format      string
+	Filename    string
+	ContentType string
+	// Truncated is true if the query returned more than exportMaxRows rows
+	Truncated bool
+
+	conn  *sql.Conn
+	table string
+	rows  *sql.Rows
+}
+
+// exportID is used to name the temporary tables of the exports
+var exportID uint64
+
+// CreateExport runs the query for the ReportEntry and returns the export
+// The query is cancelled if the context is done before the export is written
+func CreateExport(ctx context.Context, reportEntryStr string, format string) (*Export, error) {
+	reportEntry, err := parseReportEntry(reportEntryStr)
+	if err != nil {
+		return nil, err
+	}
+	return createExport(ctx, reportEntry, format)
+}
+
+// createExport runs the query for an export of the ReportEntry
+func createExport(ctx context.Context, reportEntry *ReportEntry, format string) (*Export, error) {
+	export := &Export{Format: format}
+	switch format {
+	case ExportCSV, ExportExcel:
+		export.ContentType = "text/csv; charset=utf-8"
+		export.Filename = exportFilename(reportEntry) + ".csv"
+	case ExportNDJSON:
+		export.ContentType = "application/x-ndjson"
+		export.Filename = exportFilename(reportEntry) + ".ndjson"
+	default:
+		return nil, errors.New("Unsupported export format: " + format)
+	}
+
+	var err error
+	export.conn, err = db.Conn(ctx)
+	if err != nil {
+		logger.Err("db.Conn error: %s\n", err)
+		return nil, err
+	}
+
+	// temporary tables only exist on the connection that created them
+	export.table = fmt.Sprintf("export_%d", atomic.AddUint64(&exportID, 1))
+	err = export.snapshot(ctx, reportEntry)
+	if err != nil {
+		export.conn.Close()
+		return nil, err
+	}
+
+	export.rows, err = export.conn.QueryContext(ctx, "SELECT * FROM temp."+export.table+" ORDER BY rowid LIMIT ?", exportMaxRows)
+	if err != nil {
+		logger.Err("db.Query error: %s\n", err)
+		export.Close()
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// snapshot copies the results of the report query to the temporary table
+// One row more than exportMaxRows is copied to tell if the results were truncated
+func (export *Export) snapshot(ctx context.Context, reportEntry *ReportEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	stmt, err := makeSQLString(ctx, reportEntry)
+	if err != nil {
+		logger.Warn("Failed to make SQL: %v\n", err)
+		return err
+	}
+
+	logger.Info("Export SQL: %v %v\n", stmt.sql, stmt.args)
+	args := append(stmt.args, exportMaxRows+1)
+	_, err = export.conn.ExecContext(ctx, "CREATE TEMP TABLE "+export.table+" AS SELECT * FROM ("+stmt.sql+") LIMIT ?", args...)
+	if err != nil {
+		logger.Err("db.Exec error: %s\n", err)
+		return err
+	}
+
+	var count int
+	err = export.conn.QueryRowContext(ctx, "SELECT count(*) FROM temp."+export.table).Scan(&count)
+	if err != nil {
+		logger.Err("db.QueryRow error: %s\n", err)
+		return err
+	}
+	if count > exportMaxRows {
+		logger.Warn("Export %s truncated to %d rows\n", export.Filename, exportMaxRows)
+		export.Truncated = true
+	}
+	return nil
+}
+
+// Write streams all the rows to the writer one at a time
+// The writer is flushed regularly if it supports it
+func (export *Export) Write(w io.Writer) error {
+	columns, err := export.rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := w.(interface{ Flush() })
+	var writeRow func(values []interface{}) error
+	var flush func() error
+
+	switch export.Format {
+	case ExportNDJSON:
+		encoder := json.NewEncoder(w)
+		writeRow = func(values []interface{}) error {
+			entry := make(map[string]interface{}, len(columns))
+			for i, col := range columns {
+				entry[col] = exportValue(col, values[i], time.RFC3339)
+			}
+			return encoder.Encode(entry)
+		}
+		flush = func() error { return nil }
+	default:
+		layout := time.RFC3339
+		if export.Format == ExportExcel {
+			layout = "2006-01-02 15:04:05"
+			_, err = w.Write([]byte("\xef\xbb\xbf"))
+			if err != nil {
+				return err
+			}
+		}
+		writer := csv.NewWriter(w)
+		writer.UseCRLF = (export.Format == ExportExcel)
+		err = writer.Write(columns)
+		if err != nil {
+			return err
+		}
+		record := make([]string, len(columns))
+		writeRow = func(values []interface{}) error {
+			for i, col := range columns {
+				value := exportValue(col, values[i], layout)
+				if value == nil {
+					record[i] = ""
+				} else if str, ok := value.(string); ok && export.Format == ExportExcel {
+					record[i] = excelString(str)
+				} else {
+					record[i] = fmt.Sprintf("%v", value)
+				}
+			}
+			return writer.Write(record)
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	count := 0
+	for export.rows.Next() {
+		err = export.rows.Scan(valuePtrs...)
+		if err != nil {
+			return err
+		}
+		err = writeRow(values)
+		if err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushRows == 0 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	logger.Debug("Exported %d rows as %s\n", count, export.Format)
+	return export.rows.Err()
+}
+
+// Close releases the rows and drops the temporary table
+func (export *Export) Close() {
+	if export.rows != nil {
+		export.rows.Close()
+	}
+	_, err := export.conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp."+export.table)
+	if err != nil {
+		logger.Warn("Failed to drop %s: %v\n", export.table, err)
+	}
+	export.conn.Close()
+}
+
+// exportValue returns the value to export for a column
+// Timestamp columns are formatted with the layout in the local time zone
+func exportValue(column string, value interface{}, layout string) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case int64:
+		if timestampColumns[column] {
+			return time.Unix(0, v*int64(time.Millisecond)).Format(layout)
+		}
+	}
+	return value
+}
+
+// excelString returns a string that spreadsheets will not run as a formula
+// Strings that start with a formula character are prefixed with a quote
+func excelString(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// exportFilename returns the base filename for an export of the ReportEntry
+func exportFilename(reportEntry *ReportEntry) string {
+	name := reportEntry.UniqueID
+	if name == "" {
+		name = reportEntry.Name
+	}
+	name = filenameRegex.ReplaceAllString(name, "_")
+	if name == "" || name == "_" {
+		name = "report"
+	}
+	return name
+}
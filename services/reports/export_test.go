@@ -0,0 +1,173 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	openTestDatabase(t)
+
+	stamp := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, hostname, client_port) VALUES (1, ?, 'host, \"one\"', 80), (2, ?, NULL, 443)", stamp.UnixNano()/1e6, stamp.UnixNano()/1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := `{"type": "TEXT", "uniqueId": "sessions/by host", "table": "sessions", "queryText": {"columns": ["time_stamp", "hostname", "client_port"]}}`
+
+	export := runExport(t, entry, ExportCSV)
+	if export.Filename != "sessions_by_host.csv" {
+		t.Errorf("filename %s", export.Filename)
+	}
+	records, err := csv.NewReader(strings.NewReader(export.output)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "time_stamp,hostname,client_port" {
+		t.Fatalf("csv records: %v", records)
+	}
+	if records[1][0] != stamp.Format(time.RFC3339) || records[1][1] != "host, \"one\"" || records[1][2] != "80" || records[2][1] != "" {
+		t.Errorf("csv row: %v %v", records[1], records[2])
+	}
+
+	export = runExport(t, entry, ExportExcel)
+	if !strings.HasPrefix(export.output, "\xef\xbb\xbftime_stamp,hostname,client_port\r\n") || !strings.Contains(export.output, stamp.Format("2006-01-02 15:04:05")) {
+		t.Errorf("excel output: %q", export.output)
+	}
+
+	// text that starts with a formula character is quoted in the excel format only
+	_, err = db.Exec("INSERT INTO sessions (session_id, time_stamp, hostname, client_port) VALUES (3, ?, '=HYPERLINK(\"x\")', 53)", stamp.UnixNano()/1e6+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export = runExport(t, entry, ExportExcel); !strings.Contains(export.output, "\"'=HYPERLINK(\"\"x\"\")\"") {
+		t.Errorf("excel formula not quoted: %q", export.output)
+	}
+	if export = runExport(t, entry, ExportCSV); !strings.Contains(export.output, "\"=HYPERLINK(\"\"x\"\")\"") {
+		t.Errorf("csv formula changed: %q", export.output)
+	}
+	_, err = db.Exec("DELETE FROM sessions WHERE session_id = 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export = runExport(t, entry, ExportNDJSON)
+	lines := strings.Split(strings.TrimSpace(export.output), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("ndjson lines: %v", lines)
+	}
+	var row map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &row)
+	if err != nil || row["time_stamp"] != stamp.Format(time.RFC3339) || row["client_port"] != float64(80) {
+		t.Errorf("ndjson row: %v %v", row, err)
+	}
+
+	_, err = CreateExport(context.Background(), entry, "xml")
+	if err == nil {
+		t.Error("unsupported format accepted")
+	}
+}
+
+func TestExcelString(t *testing.T) {
+	tests := map[string]string{
+		"=1+2":        "'=1+2",
+		"+1":          "'+1",
+		"-1":          "'-1",
+		"@SUM(A1)":    "'@SUM(A1)",
+		"\tcmd":       "'\tcmd",
+		"example.com": "example.com",
+		"a=b":         "a=b",
+		"":            "",
+	}
+	for value, expected := range tests {
+		if result := excelString(value); result != expected {
+			t.Errorf("excelString(%q) = %q expected %q", value, result, expected)
+		}
+	}
+}
+
+// updateWriter updates the sessions table on the first write
+type updateWriter struct {
+	bytes.Buffer
+	err    error
+	called bool
+}
+
+func (w *updateWriter) Write(data []byte) (int, error) {
+	if !w.called {
+		w.called = true
+		_, w.err = db.Exec("UPDATE sessions SET client_port = client_port")
+	}
+	return w.Buffer.Write(data)
+}
+
+func TestExportLock(t *testing.T) {
+	openTestDatabase(t)
+
+	_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, client_port) VALUES (1, ?, 80), (2, ?, 443)", time.Now().UnixNano()/1e6, time.Now().UnixNano()/1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, err := CreateExport(context.Background(), `{"type": "TEXT", "table": "sessions", "queryText": {"columns": ["session_id"]}}`, ExportNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer export.Close()
+
+	// the results are copied so the database is not locked while they are written
+	var writer updateWriter
+	err = export.Write(&writer)
+	if err != nil || writer.err != nil {
+		t.Errorf("database locked during export: %v %v", err, writer.err)
+	}
+	if strings.Count(writer.String(), "\n") != 2 {
+		t.Errorf("ndjson output: %q", writer.String())
+	}
+}
+
+func TestExportMaxRows(t *testing.T) {
+	openTestDatabase(t)
+
+	_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, client_port) VALUES (1, ?, 80), (2, ?, 443), (3, ?, 53)", time.Now().UnixNano()/1e6, time.Now().UnixNano()/1e6, time.Now().UnixNano()/1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := `{"type": "TEXT", "table": "sessions", "queryText": {"columns": ["session_id"]}}`
+
+	defer func(max int) { exportMaxRows = max }(exportMaxRows)
+	exportMaxRows = 3
+	if export := runExport(t, entry, ExportNDJSON); export.Truncated || strings.Count(export.output, "\n") != 3 {
+		t.Errorf("export at the limit: %v %q", export.Truncated, export.output)
+	}
+
+	exportMaxRows = 2
+	if export := runExport(t, entry, ExportNDJSON); !export.Truncated || strings.Count(export.output, "\n") != 2 {
+		t.Errorf("export over the limit: %v %q", export.Truncated, export.output)
+	}
+}
+
+type exportResult struct {
+	*Export
+	output string
+}
+
+// runExport writes the export of the report entry and returns the output
+func runExport(t *testing.T, entry string, format string) exportResult {
+	export, err := CreateExport(context.Background(), entry, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer export.Close()
+
+	var buffer bytes.Buffer
+	err = export.Write(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exportResult{export, buffer.String()}
+}
@@ -0,0 +1,398 @@
+package reports
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The report library is the bundled report entries in the library directory
+// along with the user defined entries in settings. Bundled entries are always
+// read only and can not be changed or removed. User defined entries can use any
+// uniqueId that is not already taken by a bundled entry.
+
+// LibrarySettingsPath is the location of the user defined report entries in the settings
+var LibrarySettingsPath = []string{"packetd", "reportEntries"}
+
+//go:embed library/*.json
+var libraryFiles embed.FS
+
+var bundledEntries []ReportEntry
+var bundledOnce sync.Once
+
+// libraryLock serializes changes to the user defined entries in settings
+var libraryLock sync.Mutex
+
+var uniqueIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// reportTypes are the supported ReportEntry types
+var reportTypes = map[string]bool{
+	"TEXT":              true,
+	"EVENTS":            true,
+	"CATEGORIES":        true,
+	"SERIES":            true,
+	"CATEGORIES_SERIES": true,
+}
+
+// ErrReportEntryNotFound is returned when no report entry has the requested uniqueId
+var ErrReportEntryNotFound = errors.New("Report entry not found")
+
+// ErrReportEntryReadOnly is returned when a bundled report entry is changed or removed
+var ErrReportEntryReadOnly = errors.New("Report entry is read only")
+
+// ErrReportEntryExists is returned when a report entry is added with a uniqueId that is taken
+var ErrReportEntryExists = errors.New("Report entry already exists")
+
+// ReportEntryError is returned when a report entry or the user conditions for it fail validation
+type ReportEntryError struct {
+	UniqueID string
+	Err      error
+}
+
+func (e *ReportEntryError) Error() string {
+	return fmt.Sprintf("report entry %s: %v", e.UniqueID, e.Err)
+}
+
+// libraryRequest holds the user conditions for running a report from the library
+type libraryRequest struct {
+	UserConditions []ReportCondition `json:"userConditions"`
+}
+
+// GetReportEntries returns all the report entries in the library
+// sorted by category, display order and name
+func GetReportEntries() ([]ReportEntry, error) {
+	list, err := getUserReportEntries()
+	if err != nil {
+		return nil, err
+	}
+	list = append(getBundledReportEntries(), list...)
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Category != list[j].Category {
+			return list[i].Category < list[j].Category
+		}
+		if list[i].DisplayOrder != list[j].DisplayOrder {
+			return list[i].DisplayOrder < list[j].DisplayOrder
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// GetReportEntry returns the report entry with the argumented uniqueId
+func GetReportEntry(uniqueID string) (*ReportEntry, error) {
+	for _, entry := range getBundledReportEntries() {
+		if entry.UniqueID == uniqueID {
+			return &entry, nil
+		}
+	}
+
+	list, err := getUserReportEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range list {
+		if entry.UniqueID == uniqueID {
+			return &entry, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrReportEntryNotFound, uniqueID)
+}
+
+// AddReportEntry validates and adds a user defined report entry and returns it
+// A uniqueId is made from the name if the entry does not have one
+func AddReportEntry(entry ReportEntry) (ReportEntry, error) {
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+
+	list, err := getUserReportEntries()
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.UniqueID == "" {
+		entry.UniqueID = newUniqueID(entry.Name, list)
+	} else if findReportEntry(entry.UniqueID, list) >= 0 || isBundledReportEntry(entry.UniqueID) {
+		return entry, fmt.Errorf("%w: %s", ErrReportEntryExists, entry.UniqueID)
+	}
+	entry.ReadOnly = false
+
+	err = entry.Validate()
+	if err != nil {
+		return entry, &ReportEntryError{UniqueID: entry.UniqueID, Err: err}
+	}
+
+	list = append(list, entry)
+	return entry, setUserReportEntries(list)
+}
+
+// UpdateReportEntry validates and replaces the user defined report entry with the argumented uniqueId
+func UpdateReportEntry(uniqueID string, entry ReportEntry) error {
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+
+	if isBundledReportEntry(uniqueID) {
+		return fmt.Errorf("%w: %s", ErrReportEntryReadOnly, uniqueID)
+	}
+	list, err := getUserReportEntries()
+	if err != nil {
+		return err
+	}
+	i := findReportEntry(uniqueID, list)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrReportEntryNotFound, uniqueID)
+	}
+
+	entry.UniqueID = uniqueID
+	entry.ReadOnly = false
+	err = entry.Validate()
+	if err != nil {
+		return &ReportEntryError{UniqueID: uniqueID, Err: err}
+	}
+
+	list[i] = entry
+	return setUserReportEntries(list)
+}
+
+// DeleteReportEntry removes the user defined report entry with the argumented uniqueId
+func DeleteReportEntry(uniqueID string) error {
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+
+	if isBundledReportEntry(uniqueID) {
+		return fmt.Errorf("%w: %s", ErrReportEntryReadOnly, uniqueID)
+	}
+	list, err := getUserReportEntries()
+	if err != nil {
+		return err
+	}
+	i := findReportEntry(uniqueID, list)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrReportEntryNotFound, uniqueID)
+	}
+
+	list = append(list[:i], list[i+1:]...)
+	return setUserReportEntries(list)
+}
+
+// CreateQueryByID runs the query for the library report entry with the argumented uniqueId
+// The request is optional JSON with the userConditions to add to the entry conditions
+func CreateQueryByID(uniqueID string, requestStr string, owner string) (*Query, error) {
+	reportEntry, err := libraryReportEntry(uniqueID, requestStr)
+	if err != nil {
+		return nil, err
+	}
+	return createQuery(reportEntry, owner)
+}
+
+// CreateExportByID runs the query for an export of the library report entry with the argumented uniqueId
+// The request is the same as CreateQueryByID
+func CreateExportByID(ctx context.Context, uniqueID string, requestStr string, format string) (*Export, error) {
+	reportEntry, err := libraryReportEntry(uniqueID, requestStr)
+	if err != nil {
+		return nil, err
+	}
+	return createExport(ctx, reportEntry, format)
+}
+
+// Validate checks the ReportEntry has a valid uniqueId and type and the
+// attributes required by the type. The table, columns and conditions are
+// checked against the schema by building the SQL for the entry.
+func (reportEntry *ReportEntry) Validate() error {
+	if !uniqueIDRegex.MatchString(reportEntry.UniqueID) {
+		return errors.New("Invalid uniqueId: " + reportEntry.UniqueID)
+	}
+	if reportEntry.Name == "" {
+		return errors.New("Missing required attribute Name")
+	}
+	if !reportTypes[reportEntry.Type] {
+		return errors.New("Unsupported reportEntry type: " + reportEntry.Type)
+	}
+	if reportEntry.Table == "" {
+		return errors.New("Missing required attribute Table")
+	}
+
+	// build the SQL from a copy with the default time range
+	entry := *reportEntry
+	entry.Conditions = append([]ReportCondition{}, reportEntry.Conditions...)
+	mergeConditions(&entry)
+	err := addOrUpdateTimestampConditions(&entry)
+	if err != nil {
+		return err
+	}
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	tables, err := parseTable(entry.Table)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Type {
+	case "TEXT":
+		_, err = makeTextSQLString(&entry, tables)
+	case "EVENTS":
+		_, err = makeEventsSQLString(&entry, tables)
+	case "CATEGORIES":
+		_, err = makeCategoriesSQLString(&entry, tables)
+	case "SERIES":
+		_, err = makeSeriesSQLString(&entry, tables)
+	case "CATEGORIES_SERIES":
+		// the series columns come from the data so only the categories can be checked
+		if entry.QueryCategories.Limit <= 0 {
+			return errors.New("Missing required attribute Limit")
+		}
+		if entry.QuerySeries.TimeIntervalSeconds < 0 {
+			return errors.New("Illegal value for TimeIntervalSeconds")
+		}
+		_, err = makeCategoriesSQLString(&entry, tables)
+	}
+	return err
+}
+
+// libraryReportEntry returns the library report entry with the argumented uniqueId
+// with the user conditions from the request and the default time range added
+func libraryReportEntry(uniqueID string, requestStr string) (*ReportEntry, error) {
+	reportEntry, err := GetReportEntry(uniqueID)
+	if err != nil {
+		return nil, err
+	}
+
+	var request libraryRequest
+	if strings.TrimSpace(requestStr) != "" {
+		decoder := json.NewDecoder(strings.NewReader(requestStr))
+		decoder.UseNumber()
+		err = decoder.Decode(&request)
+		if err != nil {
+			return nil, &ReportEntryError{UniqueID: uniqueID, Err: err}
+		}
+	}
+
+	reportEntry.Conditions = append([]ReportCondition{}, reportEntry.Conditions...)
+	reportEntry.UserConditions = request.UserConditions
+	mergeConditions(reportEntry)
+	err = addOrUpdateTimestampConditions(reportEntry)
+	if err != nil {
+		logger.Err("Timestamp condition error: %s\n", err)
+		return nil, &ReportEntryError{UniqueID: uniqueID, Err: err}
+	}
+
+	return reportEntry, nil
+}
+
+// getBundledReportEntries returns the report entries in the library directory
+// The files are parsed the first time they are needed
+func getBundledReportEntries() []ReportEntry {
+	bundledOnce.Do(func() {
+		files, err := libraryFiles.ReadDir("library")
+		if err != nil {
+			logger.Err("Failed to read report library: %v\n", err)
+			return
+		}
+		for _, file := range files {
+			data, err := libraryFiles.ReadFile("library/" + file.Name())
+			if err != nil {
+				logger.Err("Failed to read report library %s: %v\n", file.Name(), err)
+				continue
+			}
+			var list []ReportEntry
+			err = unmarshallEntries(data, &list)
+			if err != nil {
+				logger.Err("Invalid report library %s: %v\n", file.Name(), err)
+				continue
+			}
+			for _, entry := range list {
+				entry.ReadOnly = true
+				bundledEntries = append(bundledEntries, entry)
+			}
+		}
+		logger.Info("Loaded %d report entries from the library\n", len(bundledEntries))
+	})
+
+	// copy so callers can not change the bundled entries
+	return append([]ReportEntry{}, bundledEntries...)
+}
+
+// isBundledReportEntry returns true if the uniqueId belongs to a bundled entry
+func isBundledReportEntry(uniqueID string) bool {
+	return findReportEntry(uniqueID, getBundledReportEntries()) >= 0
+}
+
+// getUserReportEntries returns the user defined report entries from settings
+func getUserReportEntries() ([]ReportEntry, error) {
+	var list []ReportEntry
+
+	value, err := settings.GetSettings(LibrarySettingsPath)
+	if err != nil || value == nil {
+		// no user defined entries is not an error
+		return list, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	// numbers are kept as json.Number for the time_stamp conditions
+	err = unmarshallEntries(data, &list)
+	if err != nil {
+		return nil, errors.New("Invalid report entries in settings")
+	}
+
+	return list, nil
+}
+
+// setUserReportEntries saves the user defined report entries in settings
+func setUserReportEntries(list []ReportEntry) error {
+	if list == nil {
+		list = []ReportEntry{}
+	}
+	_, err := settings.SetSettings(LibrarySettingsPath, list)
+	return err
+}
+
+// unmarshallEntries parses a list of report entries
+func unmarshallEntries(data []byte, list *[]ReportEntry) error {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(list)
+}
+
+// findReportEntry returns the index of the entry with the uniqueId in the list or -1
+func findReportEntry(uniqueID string, list []ReportEntry) int {
+	for i := range list {
+		if list[i].UniqueID == uniqueID {
+			return i
+		}
+	}
+	return -1
+}
+
+// newUniqueID returns an unused uniqueId based on the name
+func newUniqueID(name string, list []ReportEntry) string {
+	base := strings.Trim(strings.ToLower(filenameRegex.ReplaceAllString(name, "-")), "-_")
+	if base == "" {
+		base = "report"
+	}
+	if len(base) > 50 {
+		base = base[:50]
+	}
+	base = "user-" + base
+
+	uniqueID := base
+	for i := 2; findReportEntry(uniqueID, list) >= 0 || isBundledReportEntry(uniqueID); i++ {
+		uniqueID = base + "-" + strconv.Itoa(i)
+	}
+	return uniqueID
+}
@@ -0,0 +1,95 @@
+package reports
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLibrary(t *testing.T) {
+	openTestDatabase(t)
+
+	list := getBundledReportEntries()
+	if len(list) == 0 {
+		t.Fatal("no bundled report entries")
+	}
+	seen := make(map[string]bool)
+	for _, entry := range list {
+		if seen[entry.UniqueID] {
+			t.Errorf("duplicate uniqueId %s", entry.UniqueID)
+		}
+		seen[entry.UniqueID] = true
+		if !entry.ReadOnly {
+			t.Errorf("%s is not read only", entry.UniqueID)
+		}
+		err := entry.Validate()
+		if err != nil {
+			t.Errorf("%s: %v", entry.UniqueID, err)
+		}
+	}
+
+	// the bundled entries can not be changed by the caller
+	list[0].Name = "changed"
+	entry, err := GetReportEntry(list[0].UniqueID)
+	if err != nil || entry.Name == "changed" {
+		t.Errorf("bundled entry changed: %v %v", entry, err)
+	}
+	if UpdateReportEntry(list[0].UniqueID, *entry) == nil || DeleteReportEntry(list[0].UniqueID) == nil {
+		t.Error("bundled entry is not read only")
+	}
+
+	invalid := []ReportEntry{
+		{UniqueID: "", Name: "name", Type: "EVENTS", Table: "sessions"},
+		{UniqueID: "a/b", Name: "name", Type: "EVENTS", Table: "sessions"},
+		{UniqueID: "id", Type: "EVENTS", Table: "sessions"},
+		{UniqueID: "id", Name: "name", Type: "PIE", Table: "sessions"},
+		{UniqueID: "id", Name: "name", Type: "EVENTS", Table: "no_such_table"},
+		{UniqueID: "id", Name: "name", Type: "TEXT", Table: "sessions"},
+		{UniqueID: "id", Name: "name", Type: "TEXT", Table: "sessions", QueryText: QueryTextOptions{Columns: []string{"no_such_column"}}},
+		{UniqueID: "id", Name: "name", Type: "CATEGORIES", Table: "sessions", QueryCategories: QueryCategoriesOptions{GroupColumn: "hostname", AggregationFunction: "count"}},
+		{UniqueID: "id", Name: "name", Type: "SERIES", Table: "sessions"},
+		{UniqueID: "id", Name: "name", Type: "CATEGORIES_SERIES", Table: "sessions", QueryCategories: QueryCategoriesOptions{GroupColumn: "hostname", AggregationFunction: "count", AggregationValue: "*"}},
+		{UniqueID: "id", Name: "name", Type: "EVENTS", Table: "sessions", Conditions: []ReportCondition{{Column: "hostname", Operator: "MATCHES", Value: "x"}}},
+	}
+	for _, entry := range invalid {
+		if entry.Validate() == nil {
+			t.Errorf("invalid entry accepted: %+v", entry)
+		}
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	_, err = db.Exec("INSERT INTO sessions (session_id, time_stamp, application_name) VALUES (1, ?, 'HTTP'), (2, ?, 'DNS')", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := CreateQueryByID("sessions-top-applications", `{"userConditions": [{"column": "application_name", "operator": "EQ", "value": "DNS"}]}`, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := GetData(q.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CloseQuery(q.ID)
+	var rows []map[string]interface{}
+	if json.Unmarshal([]byte(str), &rows) != nil || len(rows) != 1 || rows[0]["application_name"] != "DNS" {
+		t.Errorf("query by uniqueId: %s", str)
+	}
+
+	if _, err = CreateQueryByID("no-such-entry", "", "admin"); !errors.Is(err, ErrReportEntryNotFound) {
+		t.Errorf("query for missing entry: %v", err)
+	}
+	if _, err = CreateQueryByID("sessions-top-applications", "{", "admin"); !isReportEntryError(err) {
+		t.Errorf("query with invalid conditions: %v", err)
+	}
+	if err = DeleteReportEntry("sessions-top-applications"); !errors.Is(err, ErrReportEntryReadOnly) {
+		t.Errorf("delete bundled entry: %v", err)
+	}
+}
+
+// isReportEntryError returns true if the error is a ReportEntryError
+func isReportEntryError(err error) bool {
+	var entryErr *ReportEntryError
+	return errors.As(err, &entryErr)
+}
@@ -0,0 +1,297 @@
+package reports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// queryTimeout is the longest the database can spend on a single create or get data call
+const queryTimeout = 30 * time.Second
+
+// queryIdleTimeout is how long a query stays open without a get data call
+const queryIdleTimeout = 60 * time.Second
+
+// queryMaxRows is the most rows returned for a single query
+const queryMaxRows = 50000
+
+// queryPageRows is the most rows returned by a single get data call
+const queryPageRows = 1000
+
+const queryCleanInterval = 10 * time.Second
+
+// Query holds the results of a database query operation
+type Query struct {
+	ID    uint64
+	Rows  *sql.Rows
+	Owner string
+
+	reportType string
+	table      string
+	created    time.Time
+	lastAccess int64
+	rowCount   uint64
+	cancel     context.CancelFunc
+
+	// mutex serializes access to Rows
+	mutex sync.Mutex
+}
+
+// QueryStatus holds the details of an open query for the status API
+type QueryStatus struct {
+	ID        uint64    `json:"id"`
+	Owner     string    `json:"owner"`
+	Type      string    `json:"type"`
+	Table     string    `json:"table"`
+	Created   time.Time `json:"created"`
+	Age       int64     `json:"age"`
+	Idle      int64     `json:"idle"`
+	Rows      uint64    `json:"rows"`
+	Truncated bool      `json:"truncated"`
+}
+
+var queries = make(map[uint64]*Query)
+var queriesLock sync.RWMutex
+var queryID uint64
+
+// CreateQuery submits a database query for the owner and returns the query
+// The rows are read with GetData until the query is closed or left idle
+func CreateQuery(reportEntryStr string, owner string) (*Query, error) {
+	reportEntry, err := parseReportEntry(reportEntryStr)
+	if err != nil {
+		return nil, err
+	}
+	return createQuery(reportEntry, owner)
+}
+
+// createQuery submits the database query for a ReportEntry
+func createQuery(reportEntry *ReportEntry, owner string) (*Query, error) {
+	var err error
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(queryTimeout, cancel)
+
+	var rows *sql.Rows
+	var stmt *statement
+
+	dbLock.RLock()
+
+	stmt, err = makeSQLString(ctx, reportEntry)
+	if err != nil {
+		logger.Warn("Failed to make SQL: %v\n", err)
+		dbLock.RUnlock()
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+
+	logger.Info("SQL: %v %v\n", stmt.sql, stmt.args)
+	rows, err = db.QueryContext(ctx, stmt.sql, stmt.args...)
+	dbLock.RUnlock()
+
+	if !timer.Stop() {
+		err = errors.New("Query timed out")
+	}
+	if err != nil {
+		logger.Err("db.Query error: %s\n", err)
+		if rows != nil {
+			rows.Close()
+		}
+		cancel()
+		return nil, err
+	}
+
+	q := new(Query)
+	q.ID = atomic.AddUint64(&queryID, 1)
+	q.Rows = rows
+	q.Owner = owner
+	q.reportType = reportEntry.Type
+	q.table = reportEntry.Table
+	q.created = time.Now()
+	q.cancel = cancel
+	q.touch()
+
+	queriesLock.Lock()
+	queries[q.ID] = q
+	queriesLock.Unlock()
+	return q, nil
+}
+
+// GetData returns the next page of data for the provided QueryID
+// Each call resets the idle timeout for the query
+func GetData(queryID uint64) (string, error) {
+	q := findQuery(queryID)
+	if q == nil {
+		logger.Warn("Query not found: %d\n", queryID)
+		return "", errors.New("Query ID not found")
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.touch()
+	defer q.touch()
+
+	result := make([]map[string]interface{}, 0)
+
+	limit := queryPageRows
+	if remaining := queryMaxRows - int(atomic.LoadUint64(&q.rowCount)); remaining < limit {
+		limit = remaining
+	}
+
+	if q.Rows != nil && limit > 0 {
+		var err error
+		timer := time.AfterFunc(queryTimeout, q.cancel)
+		result, err = getRows(q.Rows, limit)
+		if !timer.Stop() {
+			logger.Warn("Query %d timed out\n", q.ID)
+			removeQuery(q)
+			q.close()
+			return "", errors.New("Query timed out")
+		}
+		if err != nil {
+			return "", err
+		}
+		count := atomic.AddUint64(&q.rowCount, uint64(len(result)))
+		if count >= queryMaxRows {
+			logger.Warn("Query %d reached the maximum of %d rows\n", q.ID, queryMaxRows)
+		}
+		// release the rows once there is nothing more to return
+		if len(result) < limit || count >= queryMaxRows {
+			q.Rows.Close()
+			q.Rows = nil
+		}
+	}
+
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonData), nil
+}
+
+// CloseQuery closes the query now
+func CloseQuery(queryID uint64) (string, error) {
+	q := findQuery(queryID)
+	if q == nil {
+		logger.Warn("Query not found: %d\n", queryID)
+		return "", errors.New("Query ID not found")
+	}
+	cleanupQuery(q)
+	return "Success", nil
+}
+
+// GetQueryStatus returns the details of all the open queries
+func GetQueryStatus() []QueryStatus {
+	list := make([]QueryStatus, 0)
+	now := time.Now()
+
+	queriesLock.RLock()
+	defer queriesLock.RUnlock()
+
+	for _, q := range queries {
+		count := atomic.LoadUint64(&q.rowCount)
+		list = append(list, QueryStatus{
+			ID:        q.ID,
+			Owner:     q.Owner,
+			Type:      q.reportType,
+			Table:     q.table,
+			Created:   q.created,
+			Age:       int64(now.Sub(q.created) / time.Second),
+			Idle:      int64(now.Sub(q.lastAccessTime()) / time.Second),
+			Rows:      count,
+			Truncated: count >= queryMaxRows,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// findQuery returns the open query with the argumented ID or nil
+func findQuery(queryID uint64) *Query {
+	queriesLock.RLock()
+	defer queriesLock.RUnlock()
+	return queries[queryID]
+}
+
+// removeQuery removes the query from the open queries
+func removeQuery(query *Query) {
+	queriesLock.Lock()
+	delete(queries, query.ID)
+	queriesLock.Unlock()
+}
+
+// cleanupQuery removes the query and releases the rows
+// The query is cancelled first so a get data call in progress returns quickly
+func cleanupQuery(query *Query) {
+	logger.Debug("cleanupQuery(%d)\n", query.ID)
+	removeQuery(query)
+	query.cancel()
+
+	query.mutex.Lock()
+	query.close()
+	query.mutex.Unlock()
+	logger.Debug("cleanupQuery(%d) finished\n", query.ID)
+}
+
+// close cancels the query and closes the rows
+// The caller must hold the query mutex
+func (query *Query) close() {
+	query.cancel()
+	if query.Rows != nil {
+		query.Rows.Close()
+		query.Rows = nil
+	}
+}
+
+// touch records the current time as the last access time
+func (query *Query) touch() {
+	atomic.StoreInt64(&query.lastAccess, time.Now().UnixNano())
+}
+
+// lastAccessTime returns the time of the last access
+func (query *Query) lastAccessTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&query.lastAccess))
+}
+
+// queryCleaner periodically closes the queries that have not been read
+// within the idle timeout. Queries being read are skipped.
+func queryCleaner() {
+	for {
+		time.Sleep(queryCleanInterval)
+		cleanIdleQueries(time.Now())
+	}
+}
+
+// cleanIdleQueries closes the queries that have been idle since before the idle timeout
+func cleanIdleQueries(now time.Time) {
+	var idle []*Query
+
+	queriesLock.RLock()
+	for _, q := range queries {
+		if now.Sub(q.lastAccessTime()) > queryIdleTimeout {
+			idle = append(idle, q)
+		}
+	}
+	queriesLock.RUnlock()
+
+	for _, q := range idle {
+		if !q.mutex.TryLock() {
+			continue
+		}
+		if now.Sub(q.lastAccessTime()) > queryIdleTimeout {
+			logger.Info("Closing idle query %d owned by %s\n", q.ID, q.Owner)
+			removeQuery(q)
+			q.close()
+		}
+		q.mutex.Unlock()
+	}
+}
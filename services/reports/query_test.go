@@ -0,0 +1,70 @@
+package reports
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestQueryLifecycle(t *testing.T) {
+	openTestDatabase(t)
+
+	now := time.Now().UnixNano() / 1e6
+	for i := 1; i <= queryPageRows+10; i++ {
+		_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp) VALUES (?, ?)", i, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := CreateQuery(`{"type": "EVENTS", "table": "sessions"}`, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []int{queryPageRows, 10, 0}
+	for _, expected := range pages {
+		str, err := GetData(q.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []map[string]interface{}
+		if json.Unmarshal([]byte(str), &rows) != nil || len(rows) != expected {
+			t.Fatalf("expected %d rows got %d", expected, len(rows))
+		}
+	}
+
+	status := GetQueryStatus()
+	if len(status) != 1 || status[0].ID != q.ID || status[0].Owner != "admin" || status[0].Rows != queryPageRows+10 {
+		t.Errorf("status: %+v", status)
+	}
+
+	// a query read recently is kept
+	cleanIdleQueries(time.Now())
+	if findQuery(q.ID) == nil {
+		t.Fatal("active query removed")
+	}
+
+	cleanIdleQueries(time.Now().Add(queryIdleTimeout + time.Second))
+	if findQuery(q.ID) != nil {
+		t.Fatal("idle query not removed")
+	}
+	if q.Rows != nil {
+		t.Error("idle query rows not closed")
+	}
+	if _, err := GetData(q.ID); err == nil {
+		t.Error("data returned for removed query")
+	}
+	if len(GetQueryStatus()) != 0 {
+		t.Error("removed query in status")
+	}
+
+	q, err = CreateQuery(`{"type": "EVENTS", "table": "sessions"}`, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CloseQuery(q.ID)
+	if findQuery(q.ID) != nil || q.Rows != nil {
+		t.Error("closed query not removed")
+	}
+}
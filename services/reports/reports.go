@@ -31,12 +31,6 @@ type Event struct {
 	ModifiedColumns map[string]interface{}
 }
 
-// Query holds the results of a database query operation
-type Query struct {
-	ID   uint64
-	Rows *sql.Rows
-}
-
 // QueryCategoriesOptions stores the query options for CATEGORY type reports
 type QueryCategoriesOptions struct {
 	GroupColumn         string `json:"groupColumn"`
@@ -87,13 +81,11 @@ type ReportEntry struct {
 	QueryCategories      QueryCategoriesOptions       `json:"queryCategories"`
 	QueryText            QueryTextOptions             `json:"queryText"`
 	QuerySeries          QuerySeriesOptions           `json:"querySeries"`
+	Rendering            map[string]interface{}       `json:"rendering,omitempty"`
 }
 
 var db *sql.DB
 var dbLock sync.RWMutex
-var queries = make(map[uint64]*Query)
-var queriesLock sync.RWMutex
-var queryID uint64
 var eventQueue = make(chan Event, 10000)
 
 // EventsLogged records the number of events logged
@@ -118,6 +110,8 @@ func Startup() {
 		createTables()
 		go eventLogger()
 		go dbCleaner()
+		go queryCleaner()
+		go rollupTask()
 	}()
 }
 
@@ -126,23 +120,11 @@ func Shutdown() {
 	db.Close()
 }
 
-func unmarshall(reportEntryStr string, reportEntry *ReportEntry) error {
-	decoder := json.NewDecoder(strings.NewReader(reportEntryStr))
-	decoder.UseNumber()
-	err := decoder.Decode(reportEntry)
-	// err := json.Unmarshal(reportEntryBytes, reportEntry)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// CreateQuery submits a database query and returns the results
-func CreateQuery(reportEntryStr string) (*Query, error) {
-	var err error
+// parseReportEntry parses a ReportEntry and adds the user and time conditions
+func parseReportEntry(reportEntryStr string) (*ReportEntry, error) {
 	reportEntry := &ReportEntry{}
 
-	err = unmarshall(reportEntryStr, reportEntry)
+	err := unmarshall(reportEntryStr, reportEntry)
 	if err != nil {
 		logger.Err("json.Unmarshal error: %s\n", err)
 		return nil, err
@@ -156,76 +138,18 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 		return nil, err
 	}
 
-	var rows *sql.Rows
-	var sqlStr string
-
-	// Hold RLock, gets unlocked in CloseQuery/cleanupQuery
-	dbLock.RLock()
-
-	sqlStr, err = makeSQLString(reportEntry)
-	if err != nil {
-		logger.Warn("Failed to make SQL: %v\n", err)
-		dbLock.RUnlock()
-		return nil, err
-	}
-	values := conditionValues(reportEntry.Conditions)
-
-	logger.Info("SQL: %v %v\n", sqlStr, values)
-	rows, err = db.Query(sqlStr, values...)
-	if err != nil {
-		logger.Err("db.Query error: %s\n", err)
-		dbLock.RUnlock()
-		return nil, err
-	}
-
-	dbLock.RUnlock()
-
-	q := new(Query)
-	q.ID = atomic.AddUint64(&queryID, 1)
-	q.Rows = rows
-
-	queriesLock.Lock()
-	queries[q.ID] = q
-	queriesLock.Unlock()
-	go func() {
-		time.Sleep(30 * time.Second)
-		cleanupQuery(q)
-	}()
-	return q, nil
+	return reportEntry, nil
 }
 
-// GetData returns the data for the provided QueryID
-func GetData(queryID uint64) (string, error) {
-	queriesLock.RLock()
-	q := queries[queryID]
-	queriesLock.RUnlock()
-	if q == nil {
-		logger.Warn("Query not found: %d\n", queryID)
-		return "", errors.New("Query ID not found")
-	}
-	result, err := getRows(q.Rows, 1000)
-	if err != nil {
-		return "", err
-	}
-	jsonData, err := json.Marshal(result)
+func unmarshall(reportEntryStr string, reportEntry *ReportEntry) error {
+	decoder := json.NewDecoder(strings.NewReader(reportEntryStr))
+	decoder.UseNumber()
+	err := decoder.Decode(reportEntry)
+	// err := json.Unmarshal(reportEntryBytes, reportEntry)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	return string(jsonData), nil
-}
-
-// CloseQuery closes the query now
-func CloseQuery(queryID uint64) (string, error) {
-	queriesLock.RLock()
-	q := queries[queryID]
-	queriesLock.RUnlock()
-	if q == nil {
-		logger.Warn("Query not found: %d\n", queryID)
-		return "", errors.New("Query ID not found")
-	}
-	cleanupQuery(q)
-	return "Success", nil
+	return nil
 }
 
 // CreateEvent creates an Event
@@ -392,7 +316,7 @@ func getRows(rows *sql.Rows, limit int) ([]map[string]interface{}, error) {
 	values := make([]interface{}, columnCount)
 	valuePtrs := make([]interface{}, columnCount)
 
-	for i := 0; rows.Next() && i < limit; i++ {
+	for i := 0; i < limit && rows.Next(); i++ {
 		for i := 0; i < columnCount; i++ {
 			valuePtrs[i] = &values[i]
 		}
@@ -412,19 +336,12 @@ func getRows(rows *sql.Rows, limit int) ([]map[string]interface{}, error) {
 		tableData = append(tableData, entry)
 	}
 
-	return tableData, nil
-}
-
-func cleanupQuery(query *Query) {
-	logger.Debug("cleanupQuery(%d)\n", query.ID)
-	queriesLock.Lock()
-	defer queriesLock.Unlock()
-	delete(queries, query.ID)
-	if query.Rows != nil {
-		query.Rows.Close()
-		query.Rows = nil
+	err = rows.Err()
+	if err != nil {
+		return nil, err
 	}
-	logger.Debug("cleanupQuery(%d) finished\n", query.ID)
+
+	return tableData, nil
 }
 
 func createTables() {
@@ -476,17 +393,18 @@ func createTables() {
                      client_hops integer,
                      server_hops integer,
                      client_dns_hint text,
-                     server_dns_hint text)`)
-
-	// FIXME add domain (SNI + dns_prediction + cert_prediction)
-	// We need a singular "domain" field that takes all the various domain determination methods into account and chooses the best one
-	// I think the preference order is:
-	//    ssl_sni (preferred because the client specified exactly the domain it is seeking)
-	//    server_dns_hint (use a dns hint if no other method is known)
-	//    certificate_subject_cn (preferred next as its specified by the server, but not exact, this same field is used by both certsniff and certfetch)
-
-	// FIXME add domain_category
-	// We need to add domain level categorization
+                     server_dns_hint text,
+                     domain text,
+                     domain_source text,
+                     domain_category text,
+                     bypassed boolean,
+                     outcome text,
+                     encrypted_dns text)`)
+
+	// domain is the best of ssl_sni, server_dns_hint and certificate_subject_cn
+	// and domain_source is the column it came from (see the domain service)
+	// domain_category is the category of the domain (see the category service)
+	// encrypted_dns is DoT, DoQ or DoH for sessions carrying encrypted DNS (see the encdns plugin)
 
 	_, err = db.Exec(
 		`CREATE TABLE IF NOT EXISTS session_stats (
@@ -598,6 +516,135 @@ func createTables() {
 	if err != nil {
 		logger.Err("Failed to create table: %s\n", err.Error())
 	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS session_actions (
+                     time_stamp bigint NOT NULL,
+                     session_id int8,
+                     conntrack_id int8,
+                     action text,
+                     family int1,
+                     ip_protocol int,
+                     client_address inet,
+                     client_port int2,
+                     server_address inet,
+                     server_port int2,
+                     block_type text,
+                     block_minutes int,
+                     username text,
+                     result text)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS watchdog_events (
+                     time_stamp bigint NOT NULL,
+                     action text,
+                     mode text,
+                     reason text,
+                     backlog int8,
+                     dropped int8,
+                     pending int8,
+                     verdict_delay int8,
+                     result text)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS firewall_events (
+                     time_stamp bigint NOT NULL,
+                     prefix text,
+                     rule_table text,
+                     rule_chain text,
+                     rule_id integer,
+                     action text,
+                     ip_version int1,
+                     ip_protocol int1,
+                     src_address text,
+                     dst_address text,
+                     src_port int2,
+                     dst_port int2,
+                     src_interface_id int1,
+                     dst_interface_id int1,
+                     icmp_type int2,
+                     mark integer)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS dns_events (
+                     time_stamp bigint NOT NULL,
+                     session_id int8,
+                     ip_protocol int1,
+                     client_address text,
+                     client_port int2,
+                     resolver_address text,
+                     resolver_port int2,
+                     query_id int4,
+                     qname text,
+                     qtype text,
+                     rcode text,
+                     answer_count int2,
+                     answers text,
+                     latency real,
+                     truncated boolean,
+                     edns_udp_size int4)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS sinkhole_events (
+                     time_stamp bigint NOT NULL,
+                     session_id int8,
+                     client_address text,
+                     client_port int2,
+                     resolver_address text,
+                     resolver_port int2,
+                     qname text,
+                     qtype text,
+                     action text,
+                     blocklist text)`)
+
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+	}
+
+	// the database can outlive a restart so columns added
+	// since the table was first created must be added
+	addColumn("sessions", "domain", "text")
+	addColumn("sessions", "domain_source", "text")
+	addColumn("sessions", "domain_category", "text")
+	addColumn("sessions", "bypassed", "boolean")
+	addColumn("sessions", "outcome", "text")
+	addColumn("sessions", "encrypted_dns", "text")
+	addColumn("dns_events", "truncated", "boolean")
+	addColumn("dns_events", "edns_udp_size", "int4")
+
+	createRollupTables()
+	loadSchema()
+}
+
+// addColumn adds a column to an existing table if it is missing
+func addColumn(table string, column string, columnType string) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil {
+		logger.Warn("Failed to check column %s.%s: %v\n", table, column, err)
+		return
+	}
+	if count != 0 {
+		return
+	}
+	logger.Info("Adding column %s.%s\n", table, column)
+	runSQL("ALTER TABLE " + table + " ADD COLUMN " + column + " " + columnType)
 }
 
 // addDefaultTimestampConditions adds time_stamp > X and time_stamp < Y
@@ -694,6 +741,11 @@ func dbCleaner() {
 			trimPercent("sessions", .1)
 			trimPercent("session_stats", .1)
 			trimPercent("interface_stats", .1)
+			trimPercent("session_actions", .1)
+			trimPercent("watchdog_events", .1)
+			trimPercent("firewall_events", .1)
+			trimPercent("dns_events", .1)
+			trimPercent("sinkhole_events", .1)
 			runSQL("VACUUM")
 			dbLock.Unlock()
 			logger.Info("Trimmed DB.\n")
@@ -0,0 +1,388 @@
+package reports
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The rollup tables hold the session counts, bytes and packets per hour and per day
+// for each combination of the rollup dimensions. The hourly rollup is built from the
+// sessions and session_stats tables and the daily rollup is built from the hourly.
+// Rows are only added for complete periods so the data since the end of the last
+// rollup is read from the raw tables when a report uses the rollups.
+
+const rollupInterval = 5 * time.Minute
+
+// rollupDelay allows events still in the queue to be written before a period is rolled up
+const rollupDelay = time.Minute
+
+// rollupLevel is a rollup table and the period it aggregates
+type rollupLevel struct {
+	table     string
+	period    int64
+	retention time.Duration
+	// end is the end of the last rolled up period in ms, protected by dbLock
+	end int64
+}
+
+var hourlyRollup = &rollupLevel{table: "session_rollup_hourly", period: 3600 * 1000, retention: 90 * 24 * time.Hour}
+var dailyRollup = &rollupLevel{table: "session_rollup_daily", period: 86400 * 1000, retention: 2 * 365 * 24 * time.Hour}
+
+// rollupLevels is ordered from coarsest to finest
+var rollupLevels = []*rollupLevel{dailyRollup, hourlyRollup}
+
+// the session columns a rollup is grouped by
+var rollupDimensions = []string{
+	"application_name",
+	"hostname",
+	"client_address",
+	"client_interface_id",
+	"server_interface_id",
+	"client_country",
+	"server_country",
+}
+
+// the session_stats columns summed in a rollup
+var rollupMetrics = []string{
+	"bytes",
+	"client_bytes",
+	"server_bytes",
+	"packets",
+	"client_packets",
+	"server_packets",
+}
+
+// createRollupTables creates the rollup tables
+// You must hold the dbLock write lock to call this function
+func createRollupTables() {
+	var columns []string
+	for _, column := range rollupDimensions {
+		columns = append(columns, column+" "+rollupColumnType(column))
+	}
+	columns = append(columns, "sessions int8")
+	for _, column := range rollupMetrics {
+		columns = append(columns, column+" int8")
+	}
+
+	for _, level := range rollupLevels {
+		_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + level.table + " (time_stamp bigint NOT NULL, " + strings.Join(columns, ", ") + ")")
+		if err != nil {
+			logger.Err("Failed to create table: %s\n", err.Error())
+		}
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS " + level.table + "_time_stamp ON " + level.table + " (time_stamp)")
+		if err != nil {
+			logger.Err("Failed to create index: %s\n", err.Error())
+		}
+	}
+}
+
+// rollupColumnType returns the type of a rollup dimension column
+func rollupColumnType(column string) string {
+	switch column {
+	case "client_address":
+		return "inet"
+	case "client_interface_id", "server_interface_id":
+		return "int"
+	}
+	return "text"
+}
+
+// rollupTask periodically rolls up the completed periods
+func rollupTask() {
+	dbLock.Lock()
+	for _, level := range rollupLevels {
+		level.end = lastRollupEnd(level)
+	}
+	dbLock.Unlock()
+
+	for {
+		runRollups(time.Now())
+		time.Sleep(rollupInterval)
+	}
+}
+
+// runRollups rolls up the periods completed before the argumented time and
+// removes the rollup rows older than the retention
+func runRollups(now time.Time) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	limit := now.Add(-rollupDelay).UnixNano() / 1e6
+	rollup(hourlyRollup, limit)
+	rollup(dailyRollup, hourlyRollup.end)
+
+	for _, level := range rollupLevels {
+		cutoff := now.Add(-level.retention).UnixNano() / 1e6
+		_, err := db.Exec("DELETE FROM "+level.table+" WHERE time_stamp < ?", cutoff)
+		if err != nil {
+			logger.Warn("Failed to trim %s: %s\n", level.table, err.Error())
+		}
+	}
+}
+
+// rollup aggregates the complete periods before limit into the rollup table
+// You must hold the dbLock write lock to call this function
+func rollup(level *rollupLevel, limit int64) {
+	source := rollupRawSource(0)
+	if level == dailyRollup {
+		source = &statement{sql: "SELECT * FROM " + hourlyRollup.table}
+	}
+
+	start := level.end
+	if start == 0 {
+		var first *int64
+		err := db.QueryRow("SELECT min(time_stamp) FROM ("+source.sql+")", source.args...).Scan(&first)
+		if err != nil || first == nil {
+			return
+		}
+		start = *first / level.period * level.period
+	}
+	end := limit / level.period * level.period
+	if end <= start {
+		return
+	}
+
+	period := strconv.FormatInt(level.period, 10)
+	dimensions := strings.Join(rollupDimensions, ", ")
+	var sums []string
+	for _, column := range append([]string{"sessions"}, rollupMetrics...) {
+		sums = append(sums, "sum("+column+")")
+	}
+
+	stmt := &statement{sql: "INSERT INTO " + level.table}
+	stmt.add(" SELECT (time_stamp/" + period + "*" + period + ") AS bucket, " + dimensions + ", " + strings.Join(sums, ", "))
+	stmt.add(" FROM ( ")
+	stmt.addStatement(source)
+	stmt.add(" ) WHERE time_stamp >= ? AND time_stamp < ?", start, end)
+	stmt.add(" GROUP BY bucket, " + dimensions)
+
+	result, err := db.Exec(stmt.sql, stmt.args...)
+	if err != nil {
+		logger.Warn("Failed to roll up %s: %s\n", level.table, err.Error())
+		return
+	}
+	count, _ := result.RowsAffected()
+	logger.Debug("Rolled up %d rows into %s\n", count, level.table)
+	level.end = end
+}
+
+// lastRollupEnd returns the end of the last period in the rollup table
+// You must hold the dbLock write lock to call this function
+func lastRollupEnd(level *rollupLevel) int64 {
+	var last *int64
+	err := db.QueryRow("SELECT max(time_stamp) FROM " + level.table).Scan(&last)
+	if err != nil || last == nil {
+		return 0
+	}
+	return *last + level.period
+}
+
+// rollupRawSource returns the query for the rollup columns from the raw tables
+// with one row for each session and one row for each session_stats entry
+func rollupRawSource(start int64) *statement {
+	dimensions := "sessions." + strings.Join(rollupDimensions, ", sessions.")
+	var zeros []string
+	for _, column := range rollupMetrics {
+		zeros = append(zeros, "0 AS "+column)
+	}
+
+	stmt := &statement{}
+	stmt.add("SELECT time_stamp, " + dimensions + ", 1 AS sessions, " + strings.Join(zeros, ", "))
+	stmt.add(" FROM sessions WHERE time_stamp >= ?", start)
+	stmt.add(" UNION ALL ")
+	stmt.add("SELECT session_stats.time_stamp, " + dimensions + ", 0 AS sessions, session_stats." + strings.Join(rollupMetrics, ", session_stats."))
+	stmt.add(" FROM session_stats JOIN sessions USING (session_id) WHERE session_stats.time_stamp >= ?", start)
+	return stmt
+}
+
+// rollupSource returns the FROM clause for a report that uses the rollup level
+// The rolled up periods are combined with the newer data from the finer
+// rollup and the raw tables so the most recent data is included.
+func rollupSource(level *rollupLevel) *statement {
+	stmt := &statement{sql: "( "}
+	stmt.add("SELECT * FROM "+level.table+" WHERE time_stamp < ?", level.end)
+	end := level.end
+	if level == dailyRollup && hourlyRollup.end > end {
+		stmt.add(" UNION ALL SELECT * FROM "+hourlyRollup.table+" WHERE time_stamp >= ? AND time_stamp < ?", end, hourlyRollup.end)
+		end = hourlyRollup.end
+	}
+	stmt.add(" UNION ALL ")
+	stmt.addStatement(rollupRawSource(end))
+	stmt.add(" ) AS " + level.table)
+	return stmt
+}
+
+// chooseRollup returns a copy of the report entry and tables that use the coarsest
+// rollup that matches the series interval. It returns nil if the report can not
+// be answered from the rollups because of the interval, tables or columns.
+func chooseRollup(reportEntry *ReportEntry, tables *reportTables) (*ReportEntry, *reportTables) {
+	if reportEntry.Type != "SERIES" && reportEntry.Type != "CATEGORIES_SERIES" {
+		return nil, nil
+	}
+
+	interval := int64(reportEntry.QuerySeries.TimeIntervalSeconds) * 1000
+	for _, level := range rollupLevels {
+		if interval <= 0 || interval%level.period != 0 || schema[level.table] == nil {
+			continue
+		}
+		entry, err := makeRollupEntry(reportEntry, tables, level)
+		if err != nil {
+			logger.Debug("Unable to use %s: %v\n", level.table, err)
+			return nil, nil
+		}
+		return entry, &reportTables{names: []string{level.table}, from: rollupSource(level)}
+	}
+
+	return nil, nil
+}
+
+// makeRollupEntry returns a copy of the report entry with the columns and
+// aggregations changed to the equivalent rollup columns
+func makeRollupEntry(reportEntry *ReportEntry, tables *reportTables, level *rollupLevel) (*ReportEntry, error) {
+	hasSessions := false
+	hasStats := false
+	for _, name := range tables.names {
+		switch name {
+		case "sessions":
+			hasSessions = true
+		case "session_stats":
+			hasStats = true
+		default:
+			return nil, errors.New("Unsupported table: " + name)
+		}
+	}
+	if !hasSessions {
+		return nil, errors.New("Missing sessions table")
+	}
+
+	entry := *reportEntry
+	entry.Table = level.table
+	entry.ColumnDisambiguation = nil
+
+	entry.Conditions = nil
+	for _, condition := range reportEntry.Conditions {
+		column, err := rollupColumn(tables, getColumnName(reportEntry, condition.Column))
+		if err != nil {
+			return nil, err
+		}
+		condition.Column = column
+		// include the whole period containing the start time
+		if column == "time_stamp" && (condition.Operator == "GT" || condition.Operator == "GE") {
+			value, ok := condition.Value.(string)
+			if ok {
+				start, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				if condition.Operator == "GT" {
+					start++
+				}
+				condition.Operator = "GT"
+				condition.Value = strconv.FormatInt(start/level.period*level.period-1, 10)
+			}
+		}
+		entry.Conditions = append(entry.Conditions, condition)
+	}
+
+	entry.QuerySeries.Columns = nil
+	for _, column := range reportEntry.QuerySeries.Columns {
+		expr, err := rollupExpression(tables, hasStats, column)
+		if err != nil {
+			return nil, err
+		}
+		entry.QuerySeries.Columns = append(entry.QuerySeries.Columns, expr)
+	}
+
+	if reportEntry.Type == "CATEGORIES_SERIES" {
+		column, err := rollupColumn(tables, reportEntry.QueryCategories.GroupColumn)
+		if err != nil {
+			return nil, err
+		}
+		function, value, err := rollupAggregation(tables, hasStats, reportEntry.QueryCategories.AggregationFunction, reportEntry.QueryCategories.AggregationValue)
+		if err != nil {
+			return nil, err
+		}
+		entry.QueryCategories.GroupColumn = column
+		entry.QueryCategories.AggregationFunction = function
+		entry.QueryCategories.AggregationValue = value
+	}
+
+	return &entry, nil
+}
+
+// rollupColumn returns the rollup column for a column in the report tables
+func rollupColumn(tables *reportTables, name string) (string, error) {
+	column, err := tables.column(name)
+	if err != nil {
+		return "", err
+	}
+	if index := strings.LastIndex(column, "."); index >= 0 {
+		column = column[index+1:]
+	}
+	if column == "time_stamp" {
+		return column, nil
+	}
+	for _, dimension := range rollupDimensions {
+		if column == dimension {
+			return column, nil
+		}
+	}
+	return "", errors.New("Column not in rollup: " + name)
+}
+
+// rollupAggregation returns the rollup aggregation for a report aggregation
+// Counting sessions becomes the sum of the session counts and the sums of the
+// session_stats columns are the sums of the rolled up sums.
+func rollupAggregation(tables *reportTables, hasStats bool, function string, value string) (string, string, error) {
+	function = strings.ToLower(strings.TrimSpace(function))
+	value = strings.TrimSpace(value)
+
+	if function == "count" && !hasStats && (value == "*" || integerRegex.MatchString(value)) {
+		return "sum", "sessions", nil
+	}
+	if function == "sum" && hasStats {
+		column, err := tables.column(value)
+		if err != nil {
+			return "", "", err
+		}
+		if index := strings.LastIndex(column, "."); index >= 0 {
+			column = column[index+1:]
+		}
+		for _, metric := range rollupMetrics {
+			if column == metric {
+				return "sum", column, nil
+			}
+		}
+	}
+	return "", "", errors.New("Aggregation not in rollup: " + function + "(" + value + ")")
+}
+
+// rollupExpression returns the rollup expression for a series column
+func rollupExpression(tables *reportTables, hasStats bool, expr string) (string, error) {
+	expr = strings.TrimSpace(expr)
+
+	var alias string
+	if matches := aliasRegex.FindStringSubmatch(expr); matches != nil {
+		expr = strings.TrimSpace(matches[1])
+		alias = matches[2]
+	}
+
+	matches := aggregateRegex.FindStringSubmatch(expr)
+	if matches == nil {
+		return "", errors.New("Column not in rollup: " + expr)
+	}
+	function, value, err := rollupAggregation(tables, hasStats, matches[1], matches[2])
+	if err != nil {
+		return "", err
+	}
+
+	// keep the original column name in the results
+	if alias == "" {
+		alias = quoteIdentifier(expr)
+	}
+	return function + "(" + value + ") as " + alias, nil
+}
@@ -0,0 +1,124 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	openTestDatabase(t)
+	for _, level := range rollupLevels {
+		level.end = 0
+	}
+
+	hour := int64(3600 * 1000)
+	now := time.Now()
+	today := now.UnixNano() / 1e6 / dailyRollup.period * dailyRollup.period
+	times := []int64{
+		today - 2*dailyRollup.period + 5*hour,
+		today - dailyRollup.period + 10*hour,
+		today - dailyRollup.period + 10*hour + 60000,
+		now.UnixNano()/1e6 - 1000,
+	}
+	for i, ts := range times {
+		_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, application_name, client_address) VALUES (?, ?, 'HTTP', '10.0.0.1')", i+1, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO session_stats (session_id, time_stamp, bytes, packets) VALUES (?, ?, 1000, 10)", i+1, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runRollups(now)
+	if hourlyRollup.end != (now.UnixNano()/1e6-rollupDelay.Milliseconds())/hour*hour {
+		t.Errorf("hourly end %d", hourlyRollup.end)
+	}
+	if dailyRollup.end != hourlyRollup.end/dailyRollup.period*dailyRollup.period {
+		t.Errorf("daily end %d", dailyRollup.end)
+	}
+
+	var count, sessions, bytes int64
+	db.QueryRow("SELECT count(*), sum(sessions), sum(bytes) FROM session_rollup_daily").Scan(&count, &sessions, &bytes)
+	if count != 2 || sessions != 3 || bytes != 3000 {
+		t.Errorf("daily rollup has %d rows %d sessions %d bytes", count, sessions, bytes)
+	}
+
+	// running again must not add the same periods twice
+	runRollups(now)
+	db.QueryRow("SELECT sum(sessions) FROM session_rollup_hourly").Scan(&sessions)
+	if sessions < 3 || sessions > 4 {
+		t.Errorf("hourly rollup has %d sessions", sessions)
+	}
+
+	start := strconv.FormatInt(today-3*dailyRollup.period, 10)
+	for _, interval := range []int{3600, 86400} {
+		entry := &ReportEntry{Type: "SERIES", Table: "session_stats join sessions using (session_id)"}
+		entry.ColumnDisambiguation = []ReportColumnDisambiguation{{ColumnName: "time_stamp", NewColumnName: "session_stats.time_stamp"}}
+		entry.Conditions = []ReportCondition{{Column: "time_stamp", Operator: "GT", Value: json.Number(start)}}
+		entry.QuerySeries = QuerySeriesOptions{Columns: []string{"sum(bytes) as bytes", "sum(packets)"}, TimeIntervalSeconds: interval}
+		addOrUpdateTimestampConditions(entry)
+
+		stmt, err := makeSQLString(context.Background(), entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stmt.sql, "session_rollup") {
+			t.Errorf("interval %d did not use a rollup: %s", interval, stmt.sql)
+		}
+		var total, packets int64
+		for _, row := range runEntry(t, entry) {
+			if value, ok := row["bytes"].(int64); ok {
+				total += value
+			}
+			if value, ok := row["sum(packets)"].(int64); ok {
+				packets += value
+			}
+		}
+		if total != 4000 || packets != 40 {
+			t.Errorf("interval %d total %d bytes %d packets", interval, total, packets)
+		}
+	}
+
+	// sessions counts use the rollup and other aggregations do not
+	entry := newTestEntry(t, "CATEGORIES_SERIES", "sessions")
+	entry.Conditions[0].Value = start
+	entry.QueryCategories = QueryCategoriesOptions{GroupColumn: "application_name", AggregationFunction: "count", AggregationValue: "*", Limit: 5}
+	entry.QuerySeries.TimeIntervalSeconds = 86400
+	if _, tables := chooseRollup(entry, mustParseTable(t, entry.Table)); tables == nil || tables.names[0] != dailyRollup.table {
+		t.Error("sessions count did not use the daily rollup")
+	}
+	var total int64
+	for _, row := range runEntry(t, entry) {
+		if value, ok := row["HTTP"].(int64); ok {
+			total += value
+		}
+	}
+	if total != 4 {
+		t.Errorf("categories series total %d", total)
+	}
+
+	entry.QueryCategories.AggregationFunction = "max"
+	entry.QueryCategories.AggregationValue = "client_port"
+	if rollupEntry, _ := chooseRollup(entry, mustParseTable(t, entry.Table)); rollupEntry != nil {
+		t.Error("max used the rollup")
+	}
+	entry.QueryCategories.AggregationFunction = "count"
+	entry.QuerySeries.TimeIntervalSeconds = 60
+	if rollupEntry, _ := chooseRollup(entry, mustParseTable(t, entry.Table)); rollupEntry != nil {
+		t.Error("60 second interval used the rollup")
+	}
+}
+
+func mustParseTable(t *testing.T, table string) *reportTables {
+	tables, err := parseTable(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
@@ -0,0 +1,206 @@
+package reports
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// schema holds the columns of each table in the database
+// It is loaded after the tables are created and is used as the whitelist for
+// every identifier that comes from a ReportEntry. It is protected by dbLock.
+var schema = make(map[string]map[string]bool)
+
+// the aggregation functions allowed in report queries
+var aggregationFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"total": true,
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var columnRegex = regexp.MustCompile(`^(?:([A-Za-z_][A-Za-z0-9_]*)\.)?([A-Za-z_][A-Za-z0-9_]*)$`)
+var aggregateRegex = regexp.MustCompile(`^([A-Za-z_]+)\(\s*([^()]*?)\s*\)$`)
+var aliasRegex = regexp.MustCompile(`(?i)^(.*?)\s+as\s+([A-Za-z_][A-Za-z0-9_]*|"(?:[^"]|"")*")$`)
+var joinRegex = regexp.MustCompile(`(?i)\s+join\s+`)
+var usingRegex = regexp.MustCompile(`(?i)^([A-Za-z_][A-Za-z0-9_]*)\s+using\s*\(\s*([A-Za-z_][A-Za-z0-9_]*)\s*\)$`)
+var integerRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// loadSchema reads the columns of every table from the database
+// You must hold the dbLock write lock to call this function
+func loadSchema() {
+	tables, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		logger.Err("Failed to read tables: %s\n", err.Error())
+		return
+	}
+
+	var names []string
+	for tables.Next() {
+		var name string
+		if tables.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	tables.Close()
+
+	loaded := make(map[string]map[string]bool)
+	for _, name := range names {
+		if !identifierRegex.MatchString(name) {
+			continue
+		}
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?)", name)
+		if err != nil {
+			logger.Err("Failed to read columns for %s: %s\n", name, err.Error())
+			continue
+		}
+		columns := make(map[string]bool)
+		for rows.Next() {
+			var column string
+			if rows.Scan(&column) == nil {
+				columns[column] = true
+			}
+		}
+		rows.Close()
+		loaded[name] = columns
+	}
+
+	schema = loaded
+}
+
+// reportTables holds the tables used by a report and the validated FROM clause
+type reportTables struct {
+	names []string
+	from  *statement
+}
+
+// parseTable validates the table of a ReportEntry and returns the tables it uses
+// The table is either a single table name or tables joined with USING
+// example: "session_stats join sessions using (session_id)"
+func parseTable(table string) (*reportTables, error) {
+	parts := joinRegex.Split(strings.TrimSpace(table), -1)
+
+	first := parts[0]
+	if schema[first] == nil {
+		return nil, errors.New("Unknown table: " + first)
+	}
+	result := &reportTables{names: []string{first}, from: &statement{sql: first}}
+
+	for _, part := range parts[1:] {
+		matches := usingRegex.FindStringSubmatch(part)
+		if matches == nil {
+			return nil, errors.New("Invalid join: " + part)
+		}
+		name, column := matches[1], matches[2]
+		if schema[name] == nil {
+			return nil, errors.New("Unknown table: " + name)
+		}
+		if !schema[name][column] || !result.hasColumn(column) {
+			return nil, errors.New("Invalid join column: " + column)
+		}
+		result.names = append(result.names, name)
+		result.from.add(" JOIN " + name + " USING (" + column + ")")
+	}
+
+	return result, nil
+}
+
+// hasColumn returns true if any of the tables has the column
+func (tables *reportTables) hasColumn(column string) bool {
+	for _, name := range tables.names {
+		if schema[name][column] {
+			return true
+		}
+	}
+	return false
+}
+
+// column validates a column name which may be qualified with the table name
+func (tables *reportTables) column(name string) (string, error) {
+	matches := columnRegex.FindStringSubmatch(name)
+	if matches == nil {
+		return "", errors.New("Invalid column: " + name)
+	}
+
+	table, column := matches[1], matches[2]
+	if table == "" {
+		if !tables.hasColumn(column) {
+			return "", errors.New("Unknown column: " + name)
+		}
+		return column, nil
+	}
+
+	for _, have := range tables.names {
+		if have == table && schema[table][column] {
+			return table + "." + column, nil
+		}
+	}
+	return "", errors.New("Unknown column: " + name)
+}
+
+// aggregation validates an aggregation function and value and returns the SQL
+// the value can be a column, * or an integer constant
+func (tables *reportTables) aggregation(function string, value string) (string, error) {
+	function = strings.ToLower(strings.TrimSpace(function))
+	if !aggregationFunctions[function] {
+		return "", errors.New("Invalid aggregation function: " + function)
+	}
+
+	result, err := tables.aggregationValue(value)
+	if err != nil {
+		return "", err
+	}
+	return function + "(" + result + ")", nil
+}
+
+// aggregationValue validates the value passed to an aggregation function
+func (tables *reportTables) aggregationValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "*" || integerRegex.MatchString(value) {
+		return value, nil
+	}
+	return tables.column(value)
+}
+
+// expression validates a column expression from the report columns list
+// which is either a column or an aggregation, optionally followed by an alias
+// The alias is a name or a quoted identifier
+// example: "count(*) as sessions"
+func (tables *reportTables) expression(expr string) (string, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return "", errors.New("Missing column name")
+	}
+
+	var alias string
+	if matches := aliasRegex.FindStringSubmatch(expr); matches != nil {
+		expr = strings.TrimSpace(matches[1])
+		alias = matches[2]
+	}
+
+	var result string
+	var err error
+	if matches := aggregateRegex.FindStringSubmatch(expr); matches != nil {
+		result, err = tables.aggregation(matches[1], matches[2])
+	} else {
+		result, err = tables.column(expr)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if alias != "" {
+		result += " AS " + alias
+	}
+	return result, nil
+}
+
+// quoteIdentifier quotes a string for use as an identifier such as a column alias
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -1,151 +1,193 @@
 package reports
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/untangle/packetd/services/logger"
 )
 
-// makeSQLString makes a SQL string from a ReportEntry
+// statement holds a SQL string and the values bound to its parameters
+type statement struct {
+	sql  string
+	args []interface{}
+}
+
+// add appends SQL and the values for any parameters it contains
+func (stmt *statement) add(sql string, args ...interface{}) {
+	stmt.sql += sql
+	stmt.args = append(stmt.args, args...)
+}
+
+// addStatement appends another statement and its values
+func (stmt *statement) addStatement(other *statement) {
+	stmt.add(other.sql, other.args...)
+}
+
+// makeSQLString makes a SQL statement from a ReportEntry
+// All values are bound as parameters and all identifiers are checked against the schema
+// The context is used for the distinct values query of CATEGORIES_SERIES reports
 // You must hold the dbLock read lock to call this function
-func makeSQLString(reportEntry *ReportEntry) (string, error) {
+func makeSQLString(ctx context.Context, reportEntry *ReportEntry) (*statement, error) {
 	if reportEntry.Table == "" {
-		return "", errors.New("Missing required attribute Table")
+		return nil, errors.New("Missing required attribute Table")
+	}
+	tables, err := parseTable(reportEntry.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// series with an interval of an hour or more are answered from the rollups when possible
+	rollupEntry, rollupTables := chooseRollup(reportEntry, tables)
+	if rollupEntry != nil {
+		logger.Debug("Using %s for report %s\n", rollupTables.names[0], reportEntry.UniqueID)
+		reportEntry, tables = rollupEntry, rollupTables
 	}
 
 	switch reportEntry.Type {
 	case "TEXT":
-		return makeTextSQLString(reportEntry)
+		return makeTextSQLString(reportEntry, tables)
 	case "EVENTS":
-		return makeEventsSQLString(reportEntry)
+		return makeEventsSQLString(reportEntry, tables)
 	case "CATEGORIES":
-		return makeCategoriesSQLString(reportEntry)
+		return makeCategoriesSQLString(reportEntry, tables)
 	case "SERIES":
-		return makeSeriesSQLString(reportEntry)
+		return makeSeriesSQLString(reportEntry, tables)
 	case "CATEGORIES_SERIES":
-		return makeCategoriesSeriesSQLString(reportEntry)
+		return makeCategoriesSeriesSQLString(ctx, reportEntry, tables)
 	}
 
-	return "", errors.New("Unsupported reportEntry type")
+	return nil, errors.New("Unsupported reportEntry type")
 }
 
-// makeTextSQLString makes a SQL string from a TEXT type ReportEntry
-func makeTextSQLString(reportEntry *ReportEntry) (string, error) {
+// makeTextSQLString makes a SQL statement from a TEXT type ReportEntry
+func makeTextSQLString(reportEntry *ReportEntry, tables *reportTables) (*statement, error) {
 	if reportEntry.QueryText.Columns == nil {
-		return "", errors.New("Missing required attribute Columns")
+		return nil, errors.New("Missing required attribute Columns")
 	}
 
-	sqlStr := "SELECT"
+	stmt := &statement{sql: "SELECT"}
 	for i, column := range reportEntry.QueryText.Columns {
-		if column == "" {
-			return "", errors.New("Missing column name")
+		expr, err := tables.expression(column)
+		if err != nil {
+			return nil, err
 		}
 		if i == 0 {
-			sqlStr += " " + column
+			stmt.add(" " + expr)
 		} else {
-			sqlStr += ", " + column
+			stmt.add(", " + expr)
 		}
 	}
-	sqlStr += " FROM"
-	sqlStr += " " + escape(reportEntry.Table)
-	sqlStr += " WHERE"
-	for i, condition := range reportEntry.Conditions {
-		if i != 0 {
-			sqlStr += " AND"
-		}
-		newStr, err := getConditionSQL(reportEntry, &condition)
-		if err != nil {
-			logger.Warn("Invalid condition: %v %v\n", condition, err)
-			return "", err
-		}
-		sqlStr += newStr
+	stmt.add(" FROM ")
+	stmt.addStatement(tables.from)
+	err := addConditions(stmt, reportEntry, tables)
+	if err != nil {
+		return nil, err
 	}
-	return sqlStr, nil
+	return stmt, nil
 }
 
-// makeEventsSQLString makes a SQL string from a EVENTS type ReportEntry
-func makeEventsSQLString(reportEntry *ReportEntry) (string, error) {
-	sqlStr := "SELECT * FROM"
-	sqlStr += " " + escape(reportEntry.Table)
-	sqlStr += " WHERE"
-	for i, condition := range reportEntry.Conditions {
-		if i != 0 {
-			sqlStr += " AND"
-		}
-		newStr, err := getConditionSQL(reportEntry, &condition)
-		if err != nil {
-			logger.Warn("Invalid condition: %v %v\n", condition, err)
-			return "", err
-		}
-		sqlStr += newStr
+// makeEventsSQLString makes a SQL statement from a EVENTS type ReportEntry
+func makeEventsSQLString(reportEntry *ReportEntry, tables *reportTables) (*statement, error) {
+	stmt := &statement{sql: "SELECT * FROM "}
+	stmt.addStatement(tables.from)
+	err := addConditions(stmt, reportEntry, tables)
+	if err != nil {
+		return nil, err
 	}
-	return sqlStr, nil
+	return stmt, nil
 }
 
-// makeCategoriesSQLString makes a SQL string from a CATEGORY type ReportEntry
-func makeCategoriesSQLString(reportEntry *ReportEntry) (string, error) {
+// makeCategoriesSQLString makes a SQL statement from a CATEGORY type ReportEntry
+func makeCategoriesSQLString(reportEntry *ReportEntry, tables *reportTables) (*statement, error) {
 	if reportEntry.QueryCategories.GroupColumn == "" {
-		return "", errors.New("Missing required attribute GroupColumn")
+		return nil, errors.New("Missing required attribute GroupColumn")
 	}
 	if reportEntry.QueryCategories.AggregationFunction == "" {
-		return "", errors.New("Missing required attribute AggregationFunction")
+		return nil, errors.New("Missing required attribute AggregationFunction")
 	}
 	if reportEntry.QueryCategories.AggregationValue == "" {
-		return "", errors.New("Missing required attribute AggregationValue")
+		return nil, errors.New("Missing required attribute AggregationValue")
 	}
 	var orderByColumn = 2
 	if reportEntry.QueryCategories.OrderByColumn < 0 || reportEntry.QueryCategories.OrderByColumn > 2 {
-		return "", errors.New("Illegal value for OrderByColumn")
+		return nil, errors.New("Illegal value for OrderByColumn")
 	}
 	if reportEntry.QueryCategories.OrderByColumn != 0 {
 		orderByColumn = reportEntry.QueryCategories.OrderByColumn
 	}
+	if reportEntry.QueryCategories.Limit < 0 {
+		return nil, errors.New("Illegal value for Limit")
+	}
 	var order = "DESC"
 	if reportEntry.QueryCategories.OrderAsc {
 		order = "ASC"
 	}
 
-	sqlStr := "SELECT"
-	sqlStr += " " + reportEntry.QueryCategories.GroupColumn
-	sqlStr += ", " + reportEntry.QueryCategories.AggregationFunction + "(" + reportEntry.QueryCategories.AggregationValue + ")"
-	sqlStr += " as value"
-	sqlStr += " FROM " + escape(reportEntry.Table)
-	sqlStr += " WHERE"
-	for i, condition := range reportEntry.Conditions {
-		if i != 0 {
-			sqlStr += " AND"
-		}
-		newStr, err := getConditionSQL(reportEntry, &condition)
-		if err != nil {
-			logger.Warn("Invalid condition: %v %v\n", condition, err)
-			return "", err
-		}
-		sqlStr += newStr
+	groupColumn, err := tables.column(reportEntry.QueryCategories.GroupColumn)
+	if err != nil {
+		return nil, err
+	}
+	aggregation, err := tables.aggregation(reportEntry.QueryCategories.AggregationFunction, reportEntry.QueryCategories.AggregationValue)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := &statement{sql: "SELECT"}
+	inner.add(" " + groupColumn)
+	inner.add(", " + aggregation)
+	inner.add(" as value")
+	inner.add(" FROM ")
+	inner.addStatement(tables.from)
+	err = addConditions(inner, reportEntry, tables)
+	if err != nil {
+		return nil, err
 	}
-	sqlStr += " GROUP BY " + reportEntry.QueryCategories.GroupColumn
-	sqlStr += fmt.Sprintf(" ORDER BY %d %s", orderByColumn, order)
+	inner.add(" GROUP BY " + groupColumn)
+	inner.add(fmt.Sprintf(" ORDER BY %d %s", orderByColumn, order))
 
 	if reportEntry.QueryCategories.Limit != 0 {
-		sqlStr += fmt.Sprintf(" LIMIT %d", reportEntry.QueryCategories.Limit)
+		inner.add(" LIMIT ?", reportEntry.QueryCategories.Limit)
 	}
 
 	// remove "0" values
-	sqlStr = "SELECT " + reportEntry.QueryCategories.GroupColumn + ", value FROM ( " + sqlStr + " ) WHERE value > 0"
+	stmt := &statement{sql: "SELECT * FROM ( "}
+	stmt.addStatement(inner)
+	stmt.add(" ) WHERE value > 0")
 
-	logger.Debug("Categories SQL: %v %v\n", sqlStr)
-	return sqlStr, nil
+	logger.Debug("Categories SQL: %v %v\n", stmt.sql, stmt.args)
+	return stmt, nil
 }
 
-// makeSeriesSQLString makes a SQL string from a SERIES type ReportEntry
-func makeSeriesSQLString(reportEntry *ReportEntry) (string, error) {
+// makeSeriesSQLString makes a SQL statement from a SERIES type ReportEntry
+func makeSeriesSQLString(reportEntry *ReportEntry, tables *reportTables) (*statement, error) {
 	if reportEntry.QuerySeries.Columns == nil {
-		return "", errors.New("Missing required attribute Columns")
+		return nil, errors.New("Missing required attribute Columns")
 	}
 
+	var columns []string
+	for _, column := range reportEntry.QuerySeries.Columns {
+		expr, err := tables.expression(column)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, expr)
+	}
+
+	return makeSeriesStatement(reportEntry, tables, &statement{sql: ", " + strings.Join(columns, ", ")})
+}
+
+// makeSeriesStatement makes the SQL statement for a time series with the argumented columns
+// left joined to the timeline so every interval has a row
+func makeSeriesStatement(reportEntry *ReportEntry, tables *reportTables, columns *statement) (*statement, error) {
 	var timeIntervalSec = reportEntry.QuerySeries.TimeIntervalSeconds
+	if timeIntervalSec < 0 {
+		return nil, errors.New("Illegal value for TimeIntervalSeconds")
+	}
 	if timeIntervalSec == 0 {
 		timeIntervalSec = 60
 	}
@@ -154,107 +196,113 @@ func makeSeriesSQLString(reportEntry *ReportEntry) (string, error) {
 	startTime, err := findStartTime(*reportEntry)
 	if err != nil {
 		logger.Warn("start time condition not found: %v\n", reportEntry.Conditions)
-		return "", err
+		return nil, err
 	}
 
 	endTime, err := findEndTime(*reportEntry)
 	if err != nil {
 		logger.Warn("end time condition not found\n")
-		return "", err
+		return nil, err
 	}
 
-	tStr, err := makeTimelineSQLString(startTime, endTime, int64(timeIntervalSec))
+	timeColumn, err := tables.column(getColumnName(reportEntry, "time_stamp"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	qStr := "SELECT"
-	qStr += fmt.Sprintf(" (%s/%d*%d) as time_trunc", getColumnName(reportEntry, "time_stamp"), timeIntervalMilli, timeIntervalMilli)
-	for _, column := range reportEntry.QuerySeries.Columns {
-		if column == "" {
-			return "", errors.New("Missing column name")
-		}
-		qStr += ", " + column
-	}
-	qStr += " FROM " + escape(reportEntry.Table)
-	qStr += " WHERE"
-	for i, condition := range reportEntry.Conditions {
-		if i != 0 {
-			qStr += " AND"
-		}
-		newStr, err := getConditionSQL(reportEntry, &condition)
-		if err != nil {
-			logger.Warn("Invalid condition: %v %v\n", condition, err)
-			return "", err
-		}
-		qStr += newStr
+	qStmt := &statement{sql: "SELECT"}
+	qStmt.add(" ("+timeColumn+"/?*?) as time_trunc", timeIntervalMilli, timeIntervalMilli)
+	qStmt.addStatement(columns)
+	qStmt.add(" FROM ")
+	qStmt.addStatement(tables.from)
+	err = addConditions(qStmt, reportEntry, tables)
+	if err != nil {
+		return nil, err
 	}
-	qStr += " GROUP BY time_trunc"
-
-	sqlStr := "SELECT * FROM "
-	sqlStr += " ( " + tStr + " ) as t1 "
-	sqlStr += "LEFT JOIN "
-	sqlStr += " ( " + qStr + " ) as t2 "
-	sqlStr += " USING (time_trunc) "
-	sqlStr += " ORDER BY time_trunc ASC "
-
-	logger.Debug("Series Query SQL: %v %v\n", qStr)
-	logger.Debug("Series SQL: %v %v\n", sqlStr)
-	return sqlStr, nil
+	qStmt.add(" GROUP BY time_trunc")
+
+	stmt := &statement{sql: "SELECT * FROM "}
+	stmt.add(" ( ")
+	stmt.addStatement(makeTimelineSQLString(startTime, endTime, int64(timeIntervalSec)))
+	stmt.add(" ) as t1 ")
+	stmt.add("LEFT JOIN ")
+	stmt.add(" ( ")
+	stmt.addStatement(qStmt)
+	stmt.add(" ) as t2 ")
+	stmt.add(" USING (time_trunc) ")
+	stmt.add(" ORDER BY time_trunc ASC ")
+
+	logger.Debug("Series SQL: %v %v\n", stmt.sql, stmt.args)
+	return stmt, nil
 }
 
-// makeCategoriesSeriesSQLString makes a SQL string from a CATEGORIES_SERIES type ReportEntry
-func makeCategoriesSeriesSQLString(reportEntry *ReportEntry) (string, error) {
+// makeCategoriesSeriesSQLString makes a SQL statement from a CATEGORIES_SERIES type ReportEntry
+func makeCategoriesSeriesSQLString(ctx context.Context, reportEntry *ReportEntry, tables *reportTables) (*statement, error) {
 	if reportEntry.QueryCategories.Limit == 0 {
-		return "", errors.New("Missing required attribute Limit")
+		return nil, errors.New("Missing required attribute Limit")
 	}
 
-	distinctValues, err := getDistinctValues(reportEntry)
+	distinctValues, err := getDistinctValues(ctx, reportEntry, tables)
 	logger.Debug("Distinct Values: %v\n", distinctValues)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var columns []string
-	aggFunc := reportEntry.QueryCategories.AggregationFunction
-	aggValue := reportEntry.QueryCategories.AggregationValue
-	for _, column := range distinctValues {
-		columnStr := aggFunc + "("
-		columnStr += "CASE WHEN " + reportEntry.QueryCategories.GroupColumn + " = '" + column + "'"
-		columnStr += " THEN " + aggValue + " END)"
-		columnStr += " AS '" + escapeSingleTick(column) + "'"
-		columns = append(columns, columnStr)
-	}
-	if len(columns) == 0 {
+	groupColumn, err := tables.column(reportEntry.QueryCategories.GroupColumn)
+	if err != nil {
+		return nil, err
+	}
+	aggFunc := strings.ToLower(strings.TrimSpace(reportEntry.QueryCategories.AggregationFunction))
+	if !aggregationFunctions[aggFunc] {
+		return nil, errors.New("Invalid aggregation function: " + aggFunc)
+	}
+	aggValue, err := tables.aggregationValue(reportEntry.QueryCategories.AggregationValue)
+	if err != nil {
+		return nil, err
+	}
+	// count(*) becomes count(CASE WHEN ... THEN 1 END)
+	if aggValue == "*" {
+		aggValue = "1"
+	}
+
+	// the distinct values come from the database so they are bound as parameters
+	// and quoted when used as the column alias
+	columns := &statement{}
+	for _, value := range distinctValues {
+		columns.add(", " + aggFunc + "(")
+		columns.add("CASE WHEN "+groupColumn+" = ?", value)
+		columns.add(" THEN " + aggValue + " END)")
+		columns.add(" AS " + quoteIdentifier(value))
+	}
+	if len(distinctValues) == 0 {
 		//return "", errors.New("No values for series")
-		return "SELECT null", nil
+		return &statement{sql: "SELECT null"}, nil
 	}
-	reportEntry.QuerySeries.Columns = columns
 
-	sqlStr, err := makeSeriesSQLString(reportEntry)
-	if sqlStr != "" {
-		logger.Debug("Categories Series SQL: %v %v\n", sqlStr)
+	stmt, err := makeSeriesStatement(reportEntry, tables, columns)
+	if stmt != nil {
+		logger.Debug("Categories Series SQL: %v %v\n", stmt.sql, stmt.args)
 	}
-	return sqlStr, err
+	return stmt, err
 }
 
 //makeTimelineSQLString makes a SQL query string to provide the timeline to left join
 //on time-based series reports to provide all datapoints
-func makeTimelineSQLString(startTime string, endTime string, intervalSec int64) (string, error) {
-	divisor := strconv.FormatInt(intervalSec*1000, 10)
-
-	sqlStr := "SELECT DISTINCT (("
-	sqlStr += "(" + startTime + "/" + divisor + ")"
-	sqlStr += "+a*10000+b*1000+c*100+d*10+e" + ")*" + divisor + ") AS time_trunc FROM"
-	sqlStr += " (" + makeSeqSQLString("a", 9) + "), "
-	sqlStr += " (" + makeSeqSQLString("b", 10) + "), "
-	sqlStr += " (" + makeSeqSQLString("c", 10) + "), "
-	sqlStr += " (" + makeSeqSQLString("d", 10) + "), "
-	sqlStr += " (" + makeSeqSQLString("e", 10) + ") "
-	sqlStr += "WHERE time_trunc < " + endTime
-
-	logger.Debug("Timeline SQL: %v %v\n", sqlStr)
-	return sqlStr, nil
+func makeTimelineSQLString(startTime int64, endTime int64, intervalSec int64) *statement {
+	divisor := intervalSec * 1000
+
+	stmt := &statement{sql: "SELECT DISTINCT (("}
+	stmt.add("(?/?)", startTime, divisor)
+	stmt.add("+a*10000+b*1000+c*100+d*10+e"+")*?) AS time_trunc FROM", divisor)
+	stmt.add(" (" + makeSeqSQLString("a", 9) + "), ")
+	stmt.add(" (" + makeSeqSQLString("b", 10) + "), ")
+	stmt.add(" (" + makeSeqSQLString("c", 10) + "), ")
+	stmt.add(" (" + makeSeqSQLString("d", 10) + "), ")
+	stmt.add(" (" + makeSeqSQLString("e", 10) + ") ")
+	stmt.add("WHERE time_trunc < ?", endTime)
+
+	logger.Debug("Timeline SQL: %v %v\n", stmt.sql, stmt.args)
+	return stmt
 }
 
 //makeSeriesSQLString makes a SQL string to get the sequence 0 to max-1
@@ -293,17 +341,18 @@ func getMapValue(m map[string]interface{}) string {
 
 // getDistinctValues returns the distinct values to be used
 // in a CATEGORIES_SERIES report
-func getDistinctValues(reportEntry *ReportEntry) ([]string, error) {
-	categoriesSQLStr, err := makeCategoriesSQLString(reportEntry)
+func getDistinctValues(ctx context.Context, reportEntry *ReportEntry, tables *reportTables) ([]string, error) {
+	stmt, err := makeCategoriesSQLString(reportEntry, tables)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := db.Query(categoriesSQLStr, conditionValues(reportEntry.Conditions)...)
+	rows, err := db.QueryContext(ctx, stmt.sql, stmt.args...)
 	if err != nil {
 		logger.Warn("Failed to get Distinct values: %v\n", err)
 		return nil, err
 	}
+	defer rows.Close()
 	categories, err := getRows(rows, reportEntry.QueryCategories.Limit)
 	if err != nil {
 		return nil, err
@@ -321,90 +370,6 @@ func getDistinctValues(reportEntry *ReportEntry) ([]string, error) {
 	return values, nil
 }
 
-// escape escapes quotes in as string
-// this is a really gross way to handle SQL safety
-// https://github.com/golang/go/issues/18478
-func escape(source string) string {
-	var j int
-	if len(source) == 0 {
-		return ""
-	}
-	tempStr := source[:]
-	desc := make([]byte, len(tempStr)*2)
-	for i := 0; i < len(tempStr); i++ {
-		flag := false
-		var escape byte
-		switch tempStr[i] {
-		case '\r':
-			flag = true
-			escape = '\r'
-			break
-		case '\n':
-			flag = true
-			escape = '\n'
-			break
-		case '\\':
-			flag = true
-			escape = '\\'
-			break
-		case '\'':
-			flag = true
-			escape = '\''
-			break
-		case '"':
-			flag = true
-			escape = '"'
-			break
-		case '\032':
-			flag = true
-			escape = 'Z'
-			break
-		default:
-		}
-		if flag {
-			desc[j] = '\\'
-			desc[j+1] = escape
-			j = j + 2
-		} else {
-			desc[j] = tempStr[i]
-			j = j + 1
-		}
-	}
-	return string(desc[0:j])
-}
-
-// escape escapes quotes in as string
-// this is a really gross way to handle SQL safety
-// https://github.com/golang/go/issues/18478
-func escapeSingleTick(source string) string {
-	var j int
-	if len(source) == 0 {
-		return ""
-	}
-	tempStr := source[:]
-	desc := make([]byte, len(tempStr)*2)
-	for i := 0; i < len(tempStr); i++ {
-		flag := false
-		var escape byte
-		switch tempStr[i] {
-		case '\'':
-			flag = true
-			escape = '\''
-			break
-		default:
-		}
-		if flag {
-			desc[j] = '\\'
-			desc[j+1] = escape
-			j = j + 2
-		} else {
-			desc[j] = tempStr[i]
-			j = j + 1
-		}
-	}
-	return string(desc[0:j])
-}
-
 // operatorSQL returns the sql equivalent of a condition operator
 func operatorSQL(operator string) (string, error) {
 	switch operator {
@@ -437,47 +402,76 @@ func operatorSQL(operator string) (string, error) {
 	}
 }
 
-// conditionValues returns a slice of the condition values of slice of ReportConditions
-func conditionValues(conditions []ReportCondition) []interface{} {
-	values := make([]interface{}, len(conditions))
-	for i, condition := range conditions {
-		values[i] = condition.Value
+// addConditions adds the WHERE clause for the conditions of a ReportEntry
+func addConditions(stmt *statement, reportEntry *ReportEntry, tables *reportTables) error {
+	for i, condition := range reportEntry.Conditions {
+		if i == 0 {
+			stmt.add(" WHERE")
+		} else {
+			stmt.add(" AND")
+		}
+		err := addConditionSQL(stmt, reportEntry, tables, &condition)
+		if err != nil {
+			logger.Warn("Invalid condition: %v %v\n", condition, err)
+			return err
+		}
 	}
-	return values
+	return nil
 }
 
 // findStartTime returns the time value for the time_stamp > (GT) condition
-func findStartTime(reportEntry ReportEntry) (string, error) {
+func findStartTime(reportEntry ReportEntry) (int64, error) {
 	return findTime(reportEntry, "GT")
 }
 
 // findEndTime returns the time value for the time_stamp < (LT) condition
-func findEndTime(reportEntry ReportEntry) (string, error) {
+func findEndTime(reportEntry ReportEntry) (int64, error) {
 	return findTime(reportEntry, "LT")
 }
 
 // findTime returns the time value for the time_stamp operator condition
-func findTime(reportEntry ReportEntry, operator string) (string, error) {
+func findTime(reportEntry ReportEntry, operator string) (int64, error) {
 	for _, cond := range reportEntry.Conditions {
 		if cond.Column == "time_stamp" && cond.Operator == operator {
 			t, ok := cond.Value.(string)
 			if ok {
-				return t, nil
+				return strconv.ParseInt(t, 10, 64)
 			}
 		}
 	}
 
-	return "", errors.New("time not found")
+	return 0, errors.New("time not found")
 }
 
-// getConditionSQL returns the SQL for a given condition
-func getConditionSQL(reportEntry *ReportEntry, condition *ReportCondition) (string, error) {
+// addConditionSQL adds the SQL for a given condition
+// IN and NOT_IN take a list of values which each get a parameter
+func addConditionSQL(stmt *statement, reportEntry *ReportEntry, tables *reportTables, condition *ReportCondition) error {
 	opStr, err := operatorSQL(condition.Operator)
 	if err != nil {
-		return "", err
+		return err
+	}
+	columnName, err := tables.column(getColumnName(reportEntry, condition.Column))
+	if err != nil {
+		return err
+	}
+
+	list, ok := condition.Value.([]interface{})
+	if condition.Operator != "IN" && condition.Operator != "NOT_IN" {
+		if ok {
+			return errors.New("Invalid value for operator " + condition.Operator)
+		}
+		stmt.add(" "+columnName+" "+opStr+" ?", condition.Value)
+		return nil
+	}
+
+	if !ok {
+		list = []interface{}{condition.Value}
+	}
+	if len(list) == 0 {
+		return errors.New("Missing values for operator " + condition.Operator)
 	}
-	columnName := getColumnName(reportEntry, condition.Column)
-	return " " + columnName + " " + opStr + " ?", nil
+	stmt.add(" "+columnName+" "+opStr+" (?"+strings.Repeat(", ?", len(list)-1)+")", list...)
+	return nil
 }
 
 // getColumnName returns the proper column name providing the name
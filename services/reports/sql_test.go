@@ -0,0 +1,315 @@
+package reports
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDatabase creates the tables in a temporary database
+func openTestDatabase(t *testing.T) {
+	var err error
+	db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "reports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	createTables()
+	if schema["sessions"] == nil || !schema["sessions"]["client_address"] {
+		t.Fatal("schema not loaded")
+	}
+}
+
+// tableCount returns the number of tables in the database
+func tableCount(t *testing.T) int {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table'").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// newTestEntry returns a report entry with the default time conditions added
+func newTestEntry(t *testing.T, reportType string, table string) *ReportEntry {
+	entry := &ReportEntry{Type: reportType, Table: table}
+	err := addOrUpdateTimestampConditions(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// runEntry builds and runs the query for a report entry and returns the rows
+func runEntry(t *testing.T, entry *ReportEntry) []map[string]interface{} {
+	stmt, err := makeSQLString(context.Background(), entry)
+	if err != nil {
+		t.Fatalf("makeSQLString: %v", err)
+	}
+	rows, err := db.Query(stmt.sql, stmt.args...)
+	if err != nil {
+		t.Fatalf("query %s: %v", stmt.sql, err)
+	}
+	defer rows.Close()
+	result, err := getRows(rows, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestReportQueries(t *testing.T) {
+	openTestDatabase(t)
+
+	now := time.Now().UnixNano() / 1e6
+	_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, client_address, application_name, ip_protocol) VALUES (1, ?, '10.0.0.1', 'HTTP', 6), (2, ?, '10.0.0.2', 'DNS', 17)", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO session_stats (session_id, time_stamp, bytes) VALUES (1, ?, 100), (2, ?, 50)", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := newTestEntry(t, "TEXT", "sessions")
+	text.QueryText.Columns = []string{"count(*) as session_count"}
+	if result := runEntry(t, text); len(result) != 1 || result[0]["session_count"] != int64(2) {
+		t.Errorf("TEXT result: %v", result)
+	}
+
+	events := newTestEntry(t, "EVENTS", "sessions")
+	events.Conditions = append(events.Conditions, ReportCondition{Column: "ip_protocol", Operator: "IN", Value: []interface{}{"6", "1"}})
+	if result := runEntry(t, events); len(result) != 1 || result[0]["application_name"] != "HTTP" {
+		t.Errorf("EVENTS result: %v", result)
+	}
+
+	categories := newTestEntry(t, "CATEGORIES", "sessions")
+	categories.QueryCategories = QueryCategoriesOptions{GroupColumn: "client_address", AggregationFunction: "count", AggregationValue: "*"}
+	if result := runEntry(t, categories); len(result) != 2 {
+		t.Errorf("CATEGORIES result: %v", result)
+	}
+
+	series := newTestEntry(t, "SERIES", "sessions")
+	series.QuerySeries = QuerySeriesOptions{Columns: []string{"count(*) as sessions"}, TimeIntervalSeconds: 3600}
+	if result := runEntry(t, series); len(result) == 0 {
+		t.Errorf("SERIES returned no rows")
+	}
+
+	joined := newTestEntry(t, "CATEGORIES_SERIES", "session_stats join sessions using (session_id)")
+	joined.ColumnDisambiguation = []ReportColumnDisambiguation{{ColumnName: "time_stamp", NewColumnName: "session_stats.time_stamp"}}
+	joined.QueryCategories = QueryCategoriesOptions{GroupColumn: "application_name", AggregationFunction: "sum", AggregationValue: "bytes", Limit: 10}
+	joined.QuerySeries.TimeIntervalSeconds = 3600
+	result := runEntry(t, joined)
+	var total int64
+	for _, row := range result {
+		if value, ok := row["HTTP"].(int64); ok {
+			total += value
+		}
+	}
+	if total != 100 {
+		t.Errorf("CATEGORIES_SERIES HTTP total %d: %v", total, result)
+	}
+}
+
+func TestIdentifierInjection(t *testing.T) {
+	openTestDatabase(t)
+
+	payloads := []string{
+		"sessions; DROP TABLE sessions",
+		"sessions --",
+		"client_address FROM sessions; DROP TABLE sessions; --",
+		"client_address) FROM sessions UNION SELECT sql FROM sqlite_master --",
+		"(SELECT sql FROM sqlite_master)",
+		"sqlite_master",
+		"no_such_column",
+		"sessions.no_such_column",
+		"session_stats.bytes",
+		"client_address, sqlite_version()",
+		"\"client_address\"",
+		"client_address'",
+		"1; DELETE FROM sessions",
+	}
+
+	tests := []struct {
+		name  string
+		apply func(entry *ReportEntry, payload string)
+	}{
+		{"table", func(entry *ReportEntry, payload string) {
+			entry.Table = payload
+		}},
+		{"join", func(entry *ReportEntry, payload string) {
+			entry.Table = "sessions join " + payload
+		}},
+		{"text column", func(entry *ReportEntry, payload string) {
+			entry.QueryText.Columns = []string{payload}
+		}},
+		{"text alias", func(entry *ReportEntry, payload string) {
+			entry.QueryText.Columns = []string{"count(*) as " + payload}
+		}},
+		{"aggregate column", func(entry *ReportEntry, payload string) {
+			entry.QueryText.Columns = []string{"sum(" + payload + ")"}
+		}},
+		{"condition column", func(entry *ReportEntry, payload string) {
+			entry.Type = "EVENTS"
+			entry.Conditions = append(entry.Conditions, ReportCondition{Column: payload, Operator: "EQ", Value: "1"})
+		}},
+		{"condition operator", func(entry *ReportEntry, payload string) {
+			entry.Type = "EVENTS"
+			entry.Conditions = append(entry.Conditions, ReportCondition{Column: "client_address", Operator: payload, Value: "1"})
+		}},
+		{"disambiguation", func(entry *ReportEntry, payload string) {
+			entry.Type = "EVENTS"
+			entry.ColumnDisambiguation = []ReportColumnDisambiguation{{ColumnName: "client_port", NewColumnName: payload}}
+			entry.Conditions = append(entry.Conditions, ReportCondition{Column: "client_port", Operator: "EQ", Value: "1"})
+		}},
+		{"group column", func(entry *ReportEntry, payload string) {
+			entry.Type = "CATEGORIES"
+			entry.QueryCategories = QueryCategoriesOptions{GroupColumn: payload, AggregationFunction: "count", AggregationValue: "*"}
+		}},
+		{"aggregation function", func(entry *ReportEntry, payload string) {
+			entry.Type = "CATEGORIES"
+			entry.QueryCategories = QueryCategoriesOptions{GroupColumn: "client_address", AggregationFunction: payload, AggregationValue: "*"}
+		}},
+		{"aggregation value", func(entry *ReportEntry, payload string) {
+			entry.Type = "CATEGORIES"
+			entry.QueryCategories = QueryCategoriesOptions{GroupColumn: "client_address", AggregationFunction: "count", AggregationValue: payload}
+		}},
+		{"series column", func(entry *ReportEntry, payload string) {
+			entry.Type = "SERIES"
+			entry.QuerySeries.Columns = []string{payload}
+		}},
+	}
+
+	before := tableCount(t)
+	for _, test := range tests {
+		for _, payload := range payloads {
+			entry := newTestEntry(t, "TEXT", "sessions")
+			entry.QueryText.Columns = []string{"count(*)"}
+			test.apply(entry, payload)
+
+			// any plain or quoted name is a valid alias
+			if test.name == "text alias" && aliasRegex.MatchString("x as "+payload) {
+				continue
+			}
+
+			stmt, err := makeSQLString(context.Background(), entry)
+			if err == nil {
+				t.Errorf("%s: accepted %q: %s", test.name, payload, stmt.sql)
+			}
+		}
+	}
+	if tableCount(t) != before {
+		t.Errorf("tables changed")
+	}
+}
+
+func TestValueInjection(t *testing.T) {
+	openTestDatabase(t)
+
+	payloads := []string{
+		"' OR '1'='1",
+		"1; DROP TABLE sessions; --",
+		"x') UNION SELECT sql FROM sqlite_master --",
+		"\" OR \"\"=\"",
+		"\\'; DELETE FROM sessions; --",
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, client_address, application_name) VALUES (1, ?, '10.0.0.1', 'HTTP')", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := tableCount(t)
+
+	for _, payload := range payloads {
+		for _, operator := range []string{"EQ", "LIKE", "IN"} {
+			entry := newTestEntry(t, "EVENTS", "sessions")
+			entry.Conditions = append(entry.Conditions, ReportCondition{Column: "client_address", Operator: operator, Value: payload})
+
+			stmt, err := makeSQLString(context.Background(), entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(stmt.sql, payload) {
+				t.Errorf("value %q in SQL: %s", payload, stmt.sql)
+			}
+			if result := runEntry(t, entry); len(result) != 0 {
+				t.Errorf("value %q matched rows: %v", payload, result)
+			}
+		}
+
+		// time values are bound to the timeline too
+		entry := newTestEntry(t, "SERIES", "sessions")
+		entry.QuerySeries.Columns = []string{"count(*)"}
+		entry.Conditions[0].Value = payload
+		_, err := makeSQLString(context.Background(), entry)
+		if err == nil {
+			t.Errorf("time value %q accepted", payload)
+		}
+	}
+
+	if tableCount(t) != before {
+		t.Errorf("tables changed")
+	}
+	var count int
+	db.QueryRow("SELECT count(*) FROM sessions").Scan(&count)
+	if count != 1 {
+		t.Errorf("sessions changed: %d", count)
+	}
+}
+
+func TestCategoryValueInjection(t *testing.T) {
+	openTestDatabase(t)
+
+	// the category values come from the database and become columns in the series query
+	names := []string{
+		"x' END) AS y FROM sessions; DROP TABLE sessions; --",
+		"a\"b",
+		"\" FROM sessions; DROP TABLE sessions; --",
+	}
+	now := time.Now().UnixNano() / 1e6
+	for i, name := range names {
+		_, err := db.Exec("INSERT INTO sessions (session_id, time_stamp, application_name) VALUES (?, ?, ?)", i+1, now, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := tableCount(t)
+
+	entry := newTestEntry(t, "CATEGORIES_SERIES", "sessions")
+	entry.QueryCategories = QueryCategoriesOptions{GroupColumn: "application_name", AggregationFunction: "count", AggregationValue: "*", Limit: 10}
+	entry.QuerySeries.TimeIntervalSeconds = 3600
+	result := runEntry(t, entry)
+
+	found := make(map[string]int64)
+	for _, row := range result {
+		for _, name := range names {
+			if value, ok := row[name].(int64); ok {
+				found[name] += value
+			}
+		}
+	}
+	for _, name := range names {
+		if found[name] != 1 {
+			t.Errorf("category %q count %d: %v", name, found[name], result)
+		}
+	}
+
+	if tableCount(t) != before {
+		t.Errorf("tables changed")
+	}
+}
+
+func TestTimelineParameters(t *testing.T) {
+	stmt := makeTimelineSQLString(1000, 7200000, 3600)
+	if strings.Contains(stmt.sql, strconv.Itoa(7200000)) {
+		t.Errorf("time value in SQL: %s", stmt.sql)
+	}
+	if strings.Count(stmt.sql, "?") != len(stmt.args) {
+		t.Errorf("%d parameters with %d values", strings.Count(stmt.sql, "?"), len(stmt.args))
+	}
+}
@@ -0,0 +1,301 @@
+package restd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rules"
+)
+
+// sessionKillRequest holds the details of a request to terminate a session
+// The session is found by conntrack_id or by the client side tuple.
+// Block can be tuple, client or server to block new traffic for the tuple or
+// the client or server host for BlockMinutes after the session is terminated.
+type sessionKillRequest struct {
+	ConntrackID   uint32 `json:"conntrack_id"`
+	Protocol      uint8  `json:"ip_protocol"`
+	ClientAddress string `json:"client_address"`
+	ClientPort    uint16 `json:"client_port"`
+	ServerAddress string `json:"server_address"`
+	ServerPort    uint16 `json:"server_port"`
+	Block         string `json:"block"`
+	BlockMinutes  int    `json:"block_minutes"`
+}
+
+// controlSessionKill terminates the session described in the JSON body
+func controlSessionKill(c *gin.Context) {
+	var request sessionKillRequest
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	killSession(c, &request)
+}
+
+// deleteSession terminates the session with the conntrack_id in the path
+// The block and block_minutes query parameters work the same as controlSessionKill
+func deleteSession(c *gin.Context) {
+	var request sessionKillRequest
+
+	ctid, err := strconv.ParseUint(c.Param("ctid"), 10, 32)
+	if err != nil || ctid == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid conntrack_id"})
+		return
+	}
+	request.ConntrackID = uint32(ctid)
+
+	request.Block = c.Query("block")
+	if str := c.Query("block_minutes"); str != "" {
+		request.BlockMinutes, err = strconv.Atoi(str)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid block_minutes"})
+			return
+		}
+	}
+
+	killSession(c, &request)
+}
+
+// killSession deletes the conntrack entry for the request, installs the optional
+// block, and logs the action to the session_actions table
+func killSession(c *gin.Context, request *sessionKillRequest) {
+	var tuple dispatch.Tuple
+	var family uint8
+	var sessionID uint64
+	var ctid uint32
+
+	request.Block = strings.ToLower(request.Block)
+	switch request.Block {
+	case "":
+	case "tuple", "client", "server":
+		if request.BlockMinutes <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "block_minutes must be greater than zero"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "block must be tuple, client or server"})
+		return
+	}
+
+	if request.ConntrackID != 0 {
+		conntrack := dispatch.FindConntrack(request.ConntrackID)
+		if conntrack == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "conntrack_id not found"})
+			return
+		}
+		conntrack.Guardian.RLock()
+		ctid = conntrack.ConntrackID
+		family = conntrack.Family
+		sessionID = conntrack.SessionID
+		tuple = conntrack.ClientSideTuple
+		conntrack.Guardian.RUnlock()
+	} else {
+		tuple = dispatch.Tuple{
+			Protocol:      request.Protocol,
+			ClientAddress: net.ParseIP(request.ClientAddress),
+			ClientPort:    request.ClientPort,
+			ServerAddress: net.ParseIP(request.ServerAddress),
+			ServerPort:    request.ServerPort,
+		}
+		if tuple.Protocol == 0 || tuple.ClientAddress == nil || tuple.ServerAddress == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "conntrack_id or ip_protocol, client_address and server_address required"})
+			return
+		}
+
+		// the entry may not be in our table if it was never queued so we still try to delete it by tuple
+		conntrack := dispatch.FindConntrackByTuple(tuple)
+		if conntrack != nil {
+			conntrack.Guardian.RLock()
+			ctid = conntrack.ConntrackID
+			family = conntrack.Family
+			sessionID = conntrack.SessionID
+			conntrack.Guardian.RUnlock()
+		} else if tuple.ClientAddress.To4() != nil {
+			family = syscall.AF_INET
+		} else {
+			family = syscall.AF_INET6
+		}
+	}
+
+	logger.Info("Killing session %d %v\n", ctid, tuple)
+	killErr := dispatch.DeleteConntrack(ctid, family, tuple)
+	if killErr != nil {
+		logger.Warn("Failed to delete conntrack %d %v: %v\n", ctid, tuple, killErr)
+	}
+
+	var blockErr error
+	switch request.Block {
+	case "tuple":
+		blockErr = rules.BlockTuple(tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ServerPort, request.BlockMinutes)
+	case "client":
+		blockErr = rules.BlockHost(tuple.ClientAddress, request.BlockMinutes)
+	case "server":
+		blockErr = rules.BlockHost(tuple.ServerAddress, request.BlockMinutes)
+	}
+
+	if blockErr != nil {
+		logger.Warn("Failed to block %s %v: %v\n", request.Block, tuple, blockErr)
+	}
+
+	// report every failure so a block error does not hide the kill error
+	var failures []string
+	if killErr != nil {
+		failures = append(failures, "kill failed: "+killErr.Error())
+	}
+	if blockErr != nil {
+		failures = append(failures, "block failed: "+blockErr.Error())
+	}
+	result := "success"
+	if len(failures) != 0 {
+		result = strings.Join(failures, "; ")
+	}
+
+	var username string
+	if value, ok := sessions.Default(c).Get("username").(string); ok {
+		username = value
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     sessionID,
+		"conntrack_id":   ctid,
+		"action":         "kill",
+		"family":         family,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress.String(),
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress.String(),
+		"server_port":    tuple.ServerPort,
+		"block_type":     request.Block,
+		"block_minutes":  request.BlockMinutes,
+		"username":       username,
+		"result":         result,
+	}
+	reports.LogEvent(reports.CreateEvent("session_kill", "session_actions", 1, columns, nil))
+
+	if errors.Is(killErr, syscall.ENOENT) && blockErr == nil && request.Block != "" {
+		// the session was already gone but the block was still installed
+		c.JSON(http.StatusOK, gin.H{"result": result})
+		return
+	}
+	if killErr != nil || blockErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": result})
+}
+
+// getBypassRules returns the bypass rules along with the hit counters
+func getBypassRules(c *gin.Context) {
+	status, err := rules.GetBypassRuleStatus()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// addBypassRule adds the bypass rule in the JSON body and returns it with the assigned ruleId
+func addBypassRule(c *gin.Context) {
+	rule, err := readBypassRule(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule, err = rules.AddBypassRule(rule)
+	if err != nil {
+		c.JSON(bypassRuleStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// updateBypassRule replaces the bypass rule in the path with the rule in the JSON body
+func updateBypassRule(c *gin.Context) {
+	ruleID, err := strconv.Atoi(c.Param("rule_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule_id"})
+		return
+	}
+
+	rule, err := readBypassRule(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = rules.UpdateBypassRule(ruleID, rule)
+	if err != nil {
+		c.JSON(bypassRuleStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
+
+// deleteBypassRule removes the bypass rule in the path
+func deleteBypassRule(c *gin.Context) {
+	ruleID, err := strconv.Atoi(c.Param("rule_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule_id"})
+		return
+	}
+
+	err = rules.DeleteBypassRule(ruleID)
+	if err != nil {
+		c.JSON(bypassRuleStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
+
+// bypassRuleStatus returns the HTTP status for an error from the bypass rule functions
+func bypassRuleStatus(err error) int {
+	if err == rules.ErrBypassRuleNotFound {
+		return http.StatusNotFound
+	}
+	if _, ok := err.(*rules.BypassRuleError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// readBypassRule parses a bypass rule from the JSON body
+// rules are enabled unless the body says otherwise
+func readBypassRule(c *gin.Context) (rules.BypassRule, error) {
+	rule := rules.BypassRule{Enabled: true}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return rule, err
+	}
+
+	err = json.Unmarshal(body, &rule)
+	return rule, err
+}
@@ -0,0 +1,206 @@
+package restd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// dictEntry is a single dictionary from one of the dict tables
+type dictEntry struct {
+	Table  string                     `json:"table"`
+	Key    string                     `json:"key"`
+	Fields map[string]dict.TypedValue `json:"fields"`
+	Expiry *dictExpiry                `json:"expiry,omitempty"`
+}
+
+// dictExpiry holds the expiration details for a dictionary
+// TTL is in seconds and the times are in milliseconds like the reports
+type dictExpiry struct {
+	TTL      int64 `json:"ttl,omitempty"`
+	Expires  int64 `json:"expires,omitempty"`
+	LastSeen int64 `json:"last_seen"`
+}
+
+// dictGetTable is the RESTD /api/dict/:table handler
+// It returns every dictionary in the table
+func dictGetTable(c *gin.Context) {
+	table := c.Param("table")
+	if _, ok := dict.Tables[table]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid table"})
+		return
+	}
+
+	entries, err := dict.GetTable(table)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, groupDictEntries(table, entries))
+}
+
+// dictGetEntry is the RESTD /api/dict/:table/:key handler
+// It returns the dictionary for the key
+func dictGetEntry(c *gin.Context) {
+	table, key, ok := parseDictKey(c)
+	if !ok {
+		return
+	}
+
+	entries, err := dict.GetDictionary(table, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	list := groupDictEntries(table, entries)
+	if len(list) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list[0])
+}
+
+// dictSetEntry is the RESTD PUT /api/dict/:table/:key handler
+// The body is an object of field names and typed values which are added to
+// the dictionary. Existing fields that are not in the body are not changed.
+// {"tag": {"type": "string", "value": "printer"}, "vlan": {"type": "int", "value": 10}}
+// The optional ttl query parameter is the number of seconds to keep the
+// dictionary after it was last written or seen in a session.
+func dictSetEntry(c *gin.Context) {
+	var fields map[string]dict.TypedValue
+	var ttl int64
+
+	table, key, ok := parseDictKey(c)
+	if !ok {
+		return
+	}
+
+	if str := c.Query("ttl"); str != "" {
+		var err error
+		ttl, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl"})
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// use json.Number so large int64 values are not converted to float
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err = decoder.Decode(&fields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(fields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no fields"})
+		return
+	}
+
+	batch := dict.NewBatch(table, key).SetTTL(time.Duration(ttl) * time.Second)
+	for field, typed := range fields {
+		err = dict.ValidField(field)
+		if err == nil {
+			var value interface{}
+			value, err = typed.Parse()
+			batch.Add(field, value)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": field + ": " + err.Error()})
+			return
+		}
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("Updated %d fields in dict %s[%v]\n", len(fields), table, key)
+	dictGetEntry(c)
+}
+
+// dictDeleteEntry is the RESTD DELETE /api/dict/:table/:key handler
+// It removes the dictionary for the key
+func dictDeleteEntry(c *gin.Context) {
+	table, key, ok := parseDictKey(c)
+	if !ok {
+		return
+	}
+
+	err := dict.DeleteDictionary(table, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("Deleted dict %s[%v]\n", table, key)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// parseDictKey returns the table and the typed key from the request path
+// If they are not valid the error response is sent and false is returned
+func parseDictKey(c *gin.Context) (string, interface{}, bool) {
+	table := c.Param("table")
+	if _, ok := dict.Tables[table]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid table"})
+		return "", nil, false
+	}
+
+	key, err := dict.ParseKey(table, c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", nil, false
+	}
+
+	return table, key, true
+}
+
+// groupDictEntries combines the entries for each key into a single dictEntry
+func groupDictEntries(table string, entries []dict.Entry) []dictEntry {
+	list := []dictEntry{}
+	index := make(map[string]int)
+
+	for _, entry := range entries {
+		key := dict.NewTypedValue(entry.Key).Value
+		name, ok := key.(string)
+		if !ok {
+			continue
+		}
+		i, found := index[name]
+		if !found {
+			i = len(list)
+			index[name] = i
+			list = append(list, dictEntry{Table: table, Key: name, Fields: make(map[string]dict.TypedValue)})
+		}
+		list[i].Fields[entry.Field] = dict.NewTypedValue(entry.Value)
+		if !found {
+			if expiry, ok := dict.GetExpiry(table, entry.Key); ok {
+				list[i].Expiry = &dictExpiry{LastSeen: expiry.LastSeen.UnixNano() / 1e6}
+				if expiry.TTL > 0 {
+					list[i].Expiry.TTL = int64(expiry.TTL / time.Second)
+					list[i].Expiry.Expires = expiry.Expires.UnixNano() / 1e6
+				}
+			}
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,152 @@
+package restd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// getReportEntries returns all the report entries in the report library
+func getReportEntries(c *gin.Context) {
+	list, err := reports.GetReportEntries()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// getReportEntry returns the report entry with the unique_id in the path
+func getReportEntry(c *gin.Context) {
+	entry, err := reports.GetReportEntry(c.Param("unique_id"))
+	if err != nil {
+		c.JSON(reportEntryStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// addReportEntry adds the report entry in the JSON body and returns it with the assigned uniqueId
+func addReportEntry(c *gin.Context) {
+	entry, err := readReportEntry(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err = reports.AddReportEntry(entry)
+	if err != nil {
+		c.JSON(reportEntryStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// updateReportEntry replaces the report entry in the path with the entry in the JSON body
+func updateReportEntry(c *gin.Context) {
+	entry, err := readReportEntry(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = reports.UpdateReportEntry(c.Param("unique_id"), entry)
+	if err != nil {
+		c.JSON(reportEntryStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
+
+// deleteReportEntry removes the report entry in the path
+func deleteReportEntry(c *gin.Context) {
+	err := reports.DeleteReportEntry(c.Param("unique_id"))
+	if err != nil {
+		c.JSON(reportEntryStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+}
+
+// reportsCreateQueryByID runs the query for the report entry in the path
+// The optional JSON body has the userConditions to add to the entry conditions
+func reportsCreateQueryByID(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	q, err := reports.CreateQueryByID(c.Param("unique_id"), string(body), queryOwner(c))
+	if err != nil {
+		c.JSON(reportEntryStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	str := fmt.Sprintf("%v", q.ID)
+	logger.Debug("CreateQueryByID(%s)\n", str)
+	c.String(http.StatusOK, str)
+}
+
+// reportsExportByID streams the results for the report entry in the path
+// The body is the same as reportsCreateQueryByID
+func reportsExportByID(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	export, err := reports.CreateExportByID(c.Request.Context(), c.Param("unique_id"), string(body), c.DefaultQuery("format", reports.ExportCSV))
+	if err != nil {
+		// the other export errors are reported the same as reportsExport
+		status := reportEntryStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	defer export.Close()
+
+	writeExport(c, export)
+}
+
+// reportEntryStatus returns the HTTP status for an error from the report library functions
+func reportEntryStatus(err error) int {
+	var entryErr *reports.ReportEntryError
+	switch {
+	case errors.Is(err, reports.ErrReportEntryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, reports.ErrReportEntryReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, reports.ErrReportEntryExists):
+		return http.StatusConflict
+	case errors.As(err, &entryErr):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// readReportEntry parses a report entry from the JSON body
+func readReportEntry(c *gin.Context) (reports.ReportEntry, error) {
+	var entry reports.ReportEntry
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return entry, err
+	}
+
+	err = json.Unmarshal(body, &entry)
+	return entry, err
+}
@@ -19,11 +19,13 @@ import (
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/category"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
 	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rules"
 	"github.com/untangle/packetd/services/settings"
 )
 
@@ -83,16 +85,38 @@ func Startup() {
 	api.POST("/reports/create_query", reportsCreateQuery)
 	api.GET("/reports/get_data/:query_id", reportsGetData)
 	api.POST("/reports/close_query/:query_id", reportsCloseQuery)
+	api.POST("/reports/export", reportsExport)
+	api.GET("/reports/library", getReportEntries)
+	api.POST("/reports/library", addReportEntry)
+	api.GET("/reports/library/:unique_id", getReportEntry)
+	api.PUT("/reports/library/:unique_id", updateReportEntry)
+	api.DELETE("/reports/library/:unique_id", deleteReportEntry)
+	api.POST("/reports/library/:unique_id/create_query", reportsCreateQueryByID)
+	api.POST("/reports/library/:unique_id/export", reportsExportByID)
 
 	api.POST("/warehouse/capture", warehouseCapture)
 	api.POST("/warehouse/playback", warehousePlayback)
 	api.POST("/warehouse/cleanup", warehouseCleanup)
 	api.GET("/warehouse/status", warehouseStatus)
 	api.POST("/control/traffic", trafficControl)
+	api.POST("/control/session/kill", controlSessionKill)
+	api.GET("/control/bypass", getBypassRules)
+	api.POST("/control/bypass", addBypassRule)
+	api.PUT("/control/bypass/:rule_id", updateBypassRule)
+	api.DELETE("/control/bypass/:rule_id", deleteBypassRule)
+
+	api.GET("/dict/:table", dictGetTable)
+	api.GET("/dict/:table/:key", dictGetEntry)
+	api.PUT("/dict/:table/:key", dictSetEntry)
+	api.DELETE("/dict/:table/:key", dictDeleteEntry)
 
 	api.GET("/status/sessions", statusSessions)
+	api.DELETE("/status/sessions/:ctid", deleteSession)
 	api.GET("/status/system", statusSystem)
 	api.GET("/status/hardware", statusHardware)
+	api.GET("/status/rules", statusRules)
+	api.GET("/status/watchdog", statusWatchdog)
+	api.GET("/status/queries", statusQueries)
 
 	api.POST("/sysupgrade", sysupgradeHandler)
 
@@ -210,7 +234,7 @@ func reportsCreateQuery(c *gin.Context) {
 		return
 	}
 
-	q, err := reports.CreateQuery(string(body))
+	q, err := reports.CreateQuery(string(body), queryOwner(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -220,6 +244,51 @@ func reportsCreateQuery(c *gin.Context) {
 	c.String(http.StatusOK, str)
 }
 
+// reportsExport runs the query for the ReportEntry in the body and streams
+// all the results as a file in the format from the format parameter
+func reportsExport(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	export, err := reports.CreateExport(c.Request.Context(), string(body), c.DefaultQuery("format", reports.ExportCSV))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer export.Close()
+
+	writeExport(c, export)
+}
+
+// writeExport sends the headers for the export file and streams the results
+func writeExport(c *gin.Context, export *reports.Export) {
+	c.Header("Content-Type", export.ContentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", export.Filename))
+	if export.Truncated {
+		c.Header("X-Export-Truncated", "true")
+	}
+	c.Status(http.StatusOK)
+
+	// the status is already sent so errors can only be logged
+	err := export.Write(c.Writer)
+	if err != nil {
+		logger.Warn("Failed to export %s: %v\n", export.Filename, err)
+	}
+}
+
+// queryOwner returns the user that created a report query for the status
+// falling back to the client address when the request was not authenticated
+func queryOwner(c *gin.Context) string {
+	user, ok := sessions.Default(c).Get("username").(string)
+	if ok && user != "" {
+		return user
+	}
+	return c.ClientIP()
+}
+
 func reportsCloseQuery(c *gin.Context) {
 	queryStr := c.Param("query_id")
 	if queryStr == "" {
@@ -422,6 +491,9 @@ func setSettings(c *gin.Context) {
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, jsonResult)
 	} else {
+		// the bypass rules and category overrides may have changed so apply them again
+		rules.SyncBypassRules()
+		category.LoadOverrides()
 		c.JSON(http.StatusOK, jsonResult)
 	}
 	return
@@ -441,6 +513,9 @@ func trimSettings(c *gin.Context) {
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, jsonResult)
 	} else {
+		// the bypass rules and category overrides may have been removed so apply them again
+		rules.SyncBypassRules()
+		category.LoadOverrides()
 		c.JSON(http.StatusOK, jsonResult)
 	}
 	return
@@ -0,0 +1,488 @@
+package restd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The /api/status/sessions handler accepts the following query parameters:
+//
+//   <field>=<value>    only return sessions where field matches value. The value can be
+//                      a CIDR (client_address=192.168.1.0/24), a numeric range (server_port=1-1024)
+//                      or a plain value (ip_protocol=6). Repeating a field matches any of the
+//                      values, different fields must all match. Only the conntrack fields in
+//                      sessionFields can be used directly, the fields added from dict must use
+//                      the filter. prefix (filter.application_name=Facebook). Any other
+//                      parameter is rejected.
+//   sort=<field>       sort the sessions by the field. The age, bytes, packets and rate
+//                      aliases are accepted in place of the full field names.
+//   order=asc|desc     the sort order (default asc)
+//   offset=<n>         skip the first n sessions
+//   limit=<n>          return at most n sessions
+//   cursor=<token>     return the sessions after the token returned in the X-Next-Cursor header
+//   fields=<a,b,c>     only return the listed fields for each session
+//   summary=<field>    return the count of sessions grouped by the field instead of the sessions
+//
+// The X-Total-Count header holds the number of sessions that matched the filters.
+
+// reservedSessionParams are the query parameters that are not field filters
+var reservedSessionParams = map[string]bool{
+	"sort":    true,
+	"order":   true,
+	"offset":  true,
+	"limit":   true,
+	"cursor":  true,
+	"fields":  true,
+	"summary": true,
+}
+
+// sessionFilterPrefix is the prefix for filters on any session field including the dict fields
+const sessionFilterPrefix = "filter."
+
+// sessionFields are the fields from parseConntrack that can be filtered without the prefix
+var sessionFields = map[string]bool{
+	"conntrack_id":          true,
+	"session_id":            true,
+	"family":                true,
+	"ip_protocol":           true,
+	"timeout_seconds":       true,
+	"tcp_state":             true,
+	"client_address":        true,
+	"client_port":           true,
+	"server_address":        true,
+	"server_port":           true,
+	"client_address_new":    true,
+	"client_port_new":       true,
+	"server_address_new":    true,
+	"server_port_new":       true,
+	"byte_rate":             true,
+	"client_byte_rate":      true,
+	"server_byte_rate":      true,
+	"packet_rate":           true,
+	"client_packet_rate":    true,
+	"server_packet_rate":    true,
+	"bytes":                 true,
+	"client_bytes":          true,
+	"server_bytes":          true,
+	"packets":               true,
+	"client_packets":        true,
+	"server_packets":        true,
+	"timestamp_start":       true,
+	"age_milliseconds":      true,
+	"mark":                  true,
+	"client_interface_id":   true,
+	"client_interface_type": true,
+	"server_interface_id":   true,
+	"server_interface_type": true,
+	"priority":              true,
+}
+
+// sessionFieldAliases maps the short sort names to the session fields
+var sessionFieldAliases = map[string]string{
+	"age":     "age_milliseconds",
+	"rate":    "byte_rate",
+	"bytes":   "bytes",
+	"packets": "packets",
+}
+
+// sessionFilter holds the values to match for a single session field
+type sessionFilter struct {
+	field   string
+	matches []sessionMatcher
+}
+
+// sessionMatcher returns true if the session value matches
+type sessionMatcher func(value interface{}) bool
+
+// sessionCursor holds the position of the last session returned in a page
+type sessionCursor struct {
+	Key  interface{} `json:"k"`
+	Ctid uint32      `json:"c"`
+}
+
+// sessionQuery holds the parsed query parameters for the sessions handler
+type sessionQuery struct {
+	filters   []sessionFilter
+	sortField string
+	sortDesc  bool
+	offset    int
+	limit     int
+	cursor    *sessionCursor
+	fields    []string
+	summary   string
+}
+
+// parseSessionQuery parses the query parameters for the sessions handler
+func parseSessionQuery(params url.Values) (*sessionQuery, error) {
+	var err error
+	query := new(sessionQuery)
+
+	for param, values := range params {
+		if reservedSessionParams[param] {
+			continue
+		}
+		field := strings.TrimPrefix(param, sessionFilterPrefix)
+		if field == "" || (field == param && !sessionFields[field]) {
+			return nil, fmt.Errorf("unknown filter: %s", param)
+		}
+		filter := sessionFilter{field: field}
+		for _, value := range values {
+			filter.matches = append(filter.matches, parseSessionMatcher(value))
+		}
+		query.filters = append(query.filters, filter)
+	}
+
+	query.sortField = params.Get("sort")
+	if alias, ok := sessionFieldAliases[query.sortField]; ok {
+		query.sortField = alias
+	}
+
+	switch strings.ToLower(params.Get("order")) {
+	case "", "asc":
+	case "desc":
+		query.sortDesc = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	query.offset, err = parseSessionInt(params, "offset")
+	if err != nil {
+		return nil, err
+	}
+	query.limit, err = parseSessionInt(params, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	if str := params.Get("cursor"); str != "" {
+		query.cursor, err = decodeSessionCursor(str)
+		if err != nil {
+			return nil, err
+		}
+		if query.offset != 0 {
+			return nil, errors.New("offset and cursor can not be combined")
+		}
+	}
+
+	if str := params.Get("fields"); str != "" {
+		query.fields = RemoveEmptyStrings(strings.Split(str, ","))
+	}
+
+	query.summary = params.Get("summary")
+
+	return query, nil
+}
+
+// parseSessionInt parses a non-negative integer query parameter
+// returns 0 if the parameter is not present
+func parseSessionInt(params url.Values, name string) (int, error) {
+	str := params.Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, str)
+	}
+	return value, nil
+}
+
+// parseSessionMatcher returns the matcher for a single filter value
+func parseSessionMatcher(value string) sessionMatcher {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err == nil {
+			return func(v interface{}) bool {
+				ip := toIP(v)
+				return ip != nil && network.Contains(ip)
+			}
+		}
+	}
+
+	if parts := strings.SplitN(value, "-", 2); len(parts) == 2 {
+		low, lowErr := strconv.ParseFloat(parts[0], 64)
+		high, highErr := strconv.ParseFloat(parts[1], 64)
+		if lowErr == nil && highErr == nil {
+			return func(v interface{}) bool {
+				number, ok := toFloat(v)
+				return ok && number >= low && number <= high
+			}
+		}
+	}
+
+	return func(v interface{}) bool {
+		if v == nil {
+			return false
+		}
+		if number, ok := toFloat(v); ok {
+			match, err := strconv.ParseFloat(value, 64)
+			return err == nil && number == match
+		}
+		if ip := toIP(v); ip != nil {
+			return ip.Equal(net.ParseIP(value))
+		}
+		return strings.EqualFold(fmt.Sprintf("%v", v), value)
+	}
+}
+
+// filter returns the sessions that match all the filters
+func (q *sessionQuery) filter(sessions []map[string]interface{}) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(sessions))
+
+	for _, session := range sessions {
+		if q.matches(session) {
+			result = append(result, session)
+		}
+	}
+
+	return result
+}
+
+// matches returns true if the session matches all the filters
+func (q *sessionQuery) matches(session map[string]interface{}) bool {
+	for _, filter := range q.filters {
+		value, found := session[filter.field]
+		if !found {
+			return false
+		}
+		matched := false
+		for _, match := range filter.matches {
+			if match(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// sort sorts the sessions by the sort field
+// the conntrack_id is used as the tie breaker so the order is stable for cursors
+func (q *sessionQuery) sort(sessions []map[string]interface{}) []map[string]interface{} {
+	if q.sortField == "" && q.cursor == nil && q.limit == 0 && q.offset == 0 {
+		return sessions
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return q.before(sessions[i][q.sortField], sessionCtid(sessions[i]), sessions[j][q.sortField], sessionCtid(sessions[j]))
+	})
+
+	return sessions
+}
+
+// before returns true if the first key and ctid sort before the second
+func (q *sessionQuery) before(key1 interface{}, ctid1 uint32, key2 interface{}, ctid2 uint32) bool {
+	cmp := 0
+	if q.sortField != "" {
+		cmp = compareValues(key1, key2)
+	}
+	if cmp == 0 {
+		if ctid1 == ctid2 {
+			return false
+		}
+		cmp = -1
+		if ctid1 > ctid2 {
+			cmp = 1
+		}
+	}
+	if q.sortDesc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// paginate returns the requested page of sessions
+// and the cursor for the next page if there are more sessions
+func (q *sessionQuery) paginate(sessions []map[string]interface{}) ([]map[string]interface{}, string) {
+	start := q.offset
+
+	if q.cursor != nil {
+		start = sort.Search(len(sessions), func(i int) bool {
+			return q.before(q.cursor.Key, q.cursor.Ctid, sessions[i][q.sortField], sessionCtid(sessions[i]))
+		})
+	}
+
+	if start > len(sessions) {
+		start = len(sessions)
+	}
+	sessions = sessions[start:]
+
+	if q.limit == 0 || q.limit >= len(sessions) {
+		return sessions, ""
+	}
+
+	sessions = sessions[:q.limit]
+	last := sessions[len(sessions)-1]
+	return sessions, encodeSessionCursor(last[q.sortField], sessionCtid(last))
+}
+
+// project returns the sessions with only the requested fields
+func (q *sessionQuery) project(sessions []map[string]interface{}) []map[string]interface{} {
+	if len(q.fields) == 0 {
+		return sessions
+	}
+
+	result := make([]map[string]interface{}, len(sessions))
+	for i, session := range sessions {
+		m := make(map[string]interface{})
+		for _, field := range q.fields {
+			if value, found := session[field]; found {
+				m[field] = value
+			}
+		}
+		result[i] = m
+	}
+
+	return result
+}
+
+// summarizeSessions returns the number of sessions for each value of the field
+// sorted by the count in descending order
+func summarizeSessions(sessions []map[string]interface{}, field string) []map[string]interface{} {
+	counts := make(map[string]int)
+
+	for _, session := range sessions {
+		var key string
+		if value := session[field]; value != nil {
+			key = fmt.Sprintf("%v", value)
+		}
+		counts[key]++
+	}
+
+	summary := make([]map[string]interface{}, 0, len(counts))
+	for key, count := range counts {
+		summary = append(summary, map[string]interface{}{"value": key, "count": count})
+	}
+
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i]["count"].(int) == summary[j]["count"].(int) {
+			return summary[i]["value"].(string) < summary[j]["value"].(string)
+		}
+		return summary[i]["count"].(int) > summary[j]["count"].(int)
+	})
+
+	return summary
+}
+
+// encodeSessionCursor creates the cursor token for the argumented sort key and ctid
+func encodeSessionCursor(key interface{}, ctid uint32) string {
+	if ip, ok := key.(net.IP); ok {
+		key = ip.String()
+	}
+	data, err := json.Marshal(sessionCursor{Key: key, Ctid: ctid})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeSessionCursor parses a cursor token created by encodeSessionCursor
+func decodeSessionCursor(token string) (*sessionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	cursor := new(sessionCursor)
+	err = json.Unmarshal(data, cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// sessionCtid returns the conntrack_id of a session map
+func sessionCtid(session map[string]interface{}) uint32 {
+	ctid, _ := session["conntrack_id"].(uint32)
+	return ctid
+}
+
+// compareValues compares two session values of possibly different types
+// numbers are compared numerically, addresses bytewise and everything else as strings
+// nil values sort before everything else
+func compareValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	fa, aok := toFloat(a)
+	fb, bok := toFloat(b)
+	if aok && bok {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	ipa := toIP(a)
+	ipb := toIP(b)
+	if ipa != nil && ipb != nil {
+		return bytes.Compare(ipa.To16(), ipb.To16())
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+// toFloat converts a numeric session value to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// toIP converts an address session value to a net.IP
+// returns nil if the value is not an address
+func toIP(value interface{}) net.IP {
+	switch v := value.(type) {
+	case net.IP:
+		return v
+	case string:
+		return net.ParseIP(v)
+	}
+	return nil
+}
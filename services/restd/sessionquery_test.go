@@ -0,0 +1,181 @@
+package restd
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/untangle/packetd/services/dispatch"
+)
+
+func TestParseSessionQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+		filters []string
+		sort    string
+		desc    bool
+		offset  int
+		limit   int
+		fields  []string
+	}{
+		{name: "empty", query: ""},
+		{name: "conntrack field", query: "server_port=1-1024", filters: []string{"server_port"}},
+		{name: "prefixed dict field", query: "filter.application_name=Facebook", filters: []string{"application_name"}},
+		{name: "prefixed conntrack field", query: "filter.client_address=10.0.0.0/8", filters: []string{"client_address"}},
+		{name: "several filters", query: "ip_protocol=6&filter.domain=example.com&ip_protocol=17", filters: []string{"domain", "ip_protocol"}},
+		{name: "unknown field", query: "application_name=Facebook", wantErr: true},
+		{name: "typo", query: "sever_port=443", wantErr: true},
+		{name: "empty prefix", query: "filter.=x", wantErr: true},
+		{name: "sort alias", query: "sort=rate&order=DESC", sort: "byte_rate", desc: true},
+		{name: "sort field", query: "sort=client_address&order=asc", sort: "client_address"},
+		{name: "bad order", query: "order=up", wantErr: true},
+		{name: "offset and limit", query: "offset=10&limit=5", offset: 10, limit: 5},
+		{name: "negative limit", query: "limit=-1", wantErr: true},
+		{name: "bad offset", query: "offset=x", wantErr: true},
+		{name: "bad cursor", query: "cursor=***", wantErr: true},
+		{name: "offset with cursor", query: "offset=1&cursor=" + encodeSessionCursor(1, 1), wantErr: true},
+		{name: "cursor", query: "limit=2&cursor=" + encodeSessionCursor(1, 1), limit: 2},
+		{name: "fields", query: "fields=conntrack_id,,bytes", fields: []string{"conntrack_id", "bytes"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, err := parseSessionQuery(params)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error for %q", test.query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %v", test.query, err)
+			}
+
+			var filters []string
+			for _, filter := range query.filters {
+				filters = append(filters, filter.field)
+			}
+			sort.Strings(filters)
+			if !equalStrings(filters, test.filters) {
+				t.Errorf("filters = %v, want %v", filters, test.filters)
+			}
+			if query.sortField != test.sort || query.sortDesc != test.desc {
+				t.Errorf("sort = %s desc %v, want %s desc %v", query.sortField, query.sortDesc, test.sort, test.desc)
+			}
+			if query.offset != test.offset || query.limit != test.limit {
+				t.Errorf("offset %d limit %d, want offset %d limit %d", query.offset, query.limit, test.offset, test.limit)
+			}
+			if !equalStrings(query.fields, test.fields) {
+				t.Errorf("fields = %v, want %v", query.fields, test.fields)
+			}
+		})
+	}
+}
+
+// TestSessionFields checks that every field from parseConntrack can be filtered without the prefix
+func TestSessionFields(t *testing.T) {
+	ct := &dispatch.Conntrack{TimestampStart: 1}
+	for field := range parseConntrack(ct) {
+		if !sessionFields[field] {
+			t.Errorf("%s is missing from sessionFields", field)
+		}
+	}
+}
+
+func TestSessionCursorPaging(t *testing.T) {
+	// byte_rate has duplicates so the conntrack_id tie breaker is exercised
+	rates := []uint32{50, 10, 50, 30, 10, 70, 50, 20, 30}
+	addresses := []string{"10.0.0.9", "10.0.0.10", "192.168.1.1", "10.0.0.2", "::1", "10.0.0.9", "172.16.0.1", "10.0.0.1", "2001:db8::1"}
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "default order", query: "limit=2"},
+		{name: "rate asc", query: "sort=rate&limit=2"},
+		{name: "rate desc", query: "sort=rate&order=desc&limit=3"},
+		{name: "address asc", query: "sort=client_address&limit=4"},
+		{name: "address desc", query: "sort=client_address&order=desc&limit=1"},
+		{name: "missing field", query: "sort=domain&limit=2"},
+		{name: "filtered", query: "sort=rate&filter.byte_rate=20-60&limit=2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sessions []map[string]interface{}
+			for i := range rates {
+				sessions = append(sessions, map[string]interface{}{
+					"conntrack_id":   uint32(i + 1),
+					"byte_rate":      rates[i],
+					"client_address": net.ParseIP(addresses[i]),
+				})
+			}
+
+			params, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := parseSessionQuery(params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the full result without paging is the expected order
+			all := *first
+			all.limit = 0
+			expected := all.sort(all.filter(sessions))
+
+			var got []uint32
+			query := first
+			for pages := 0; ; pages++ {
+				if pages > len(sessions) {
+					t.Fatalf("cursor did not terminate")
+				}
+				page, next := query.paginate(query.sort(query.filter(sessions)))
+				if len(page) > first.limit {
+					t.Fatalf("page has %d sessions, limit is %d", len(page), first.limit)
+				}
+				for _, session := range page {
+					got = append(got, sessionCtid(session))
+				}
+				if next == "" {
+					break
+				}
+				params.Set("cursor", next)
+				query, err = parseSessionQuery(params)
+				if err != nil {
+					t.Fatalf("next cursor rejected: %v", err)
+				}
+			}
+
+			if len(got) != len(expected) {
+				t.Fatalf("paged %d sessions, want %d: %v", len(got), len(expected), got)
+			}
+			for i, session := range expected {
+				if got[i] != sessionCtid(session) {
+					t.Fatalf("paged order %v differs from the sorted order at %d", got, i)
+				}
+			}
+		})
+	}
+}
+
+// equalStrings returns true if both slices hold the same strings in the same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
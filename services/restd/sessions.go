@@ -2,6 +2,7 @@ package restd
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,16 +12,37 @@ import (
 )
 
 // statusSessions is the RESTD /api/status/sessions handler
+// The optional query parameters are described in sessionquery.go
 func statusSessions(c *gin.Context) {
 	logger.Debug("statusSession()\n")
 
+	query, err := parseSessionQuery(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	sessions, err := getSessions()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
 
-	c.JSON(http.StatusOK, sessions)
+	sessions = query.filter(sessions)
+
+	if query.summary != "" {
+		c.JSON(http.StatusOK, summarizeSessions(sessions, query.summary))
+		return
+	}
+
+	total := len(sessions)
+	sessions, next := query.paginate(query.sort(sessions))
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		c.Header("X-Next-Cursor", next)
+	}
+
+	c.JSON(http.StatusOK, query.project(sessions))
 }
 
 // getSessions returns the fully merged list of sessions
@@ -126,6 +148,13 @@ func parseConntrack(ct *dispatch.Conntrack) map[string]interface{} {
 	m["server_address_new"] = ct.ServerSideTuple.ServerAddress
 	m["server_port_new"] = ct.ServerSideTuple.ServerPort
 
+	m["byte_rate"] = ct.TotalByteRate
+	m["client_byte_rate"] = ct.ClientByteRate
+	m["server_byte_rate"] = ct.ServerByteRate
+	m["packet_rate"] = ct.TotalPacketRate
+	m["client_packet_rate"] = ct.ClientPacketRate
+	m["server_packet_rate"] = ct.ServerPacketRate
+
 	m["bytes"] = ct.TotalBytes
 	m["client_bytes"] = ct.ClientBytes
 	m["server_bytes"] = ct.ServerBytes
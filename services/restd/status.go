@@ -6,6 +6,9 @@ import (
 	"github.com/c9s/goprocinfo/linux"
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rules"
+	"github.com/untangle/packetd/services/watchdog"
 )
 
 // statusSystem is the RESTD /api/status/system handler
@@ -74,3 +77,24 @@ func statusHardware(c *gin.Context) {
 
 	c.JSON(http.StatusOK, stats)
 }
+
+// statusRules is the RESTD /api/status/rules handler
+func statusRules(c *gin.Context) {
+	logger.Debug("statusRules()\n")
+
+	c.JSON(http.StatusOK, rules.GetStatus())
+}
+
+// statusWatchdog is the RESTD /api/status/watchdog handler
+func statusWatchdog(c *gin.Context) {
+	logger.Debug("statusWatchdog()\n")
+
+	c.JSON(http.StatusOK, watchdog.GetStatus())
+}
+
+// statusQueries is the RESTD /api/status/queries handler
+func statusQueries(c *gin.Context) {
+	logger.Debug("statusQueries()\n")
+
+	c.JSON(http.StatusOK, reports.GetQueryStatus())
+}
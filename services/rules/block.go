@@ -0,0 +1,112 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The block sets are created in the packetd table along with the prerouting rules
+// that drop any traffic matching an element. The elements are created with a
+// timeout so the kernel removes them when the block expires.
+const blockHostSet = "block-hosts"
+const blockTupleSet = "block-tuples"
+
+// BlockHost blocks all traffic to and from the argumented address for the
+// argumented number of minutes
+func BlockHost(address net.IP, minutes int) error {
+	if address == nil {
+		return errors.New("Invalid address")
+	}
+
+	set := &nftables.Set{Table: newTable(), Name: blockHostSet + ipVersion(address), KeyType: nftables.TypeIPAddr, HasTimeout: true}
+	if address.To4() == nil {
+		set.KeyType = nftables.TypeIP6Addr
+	}
+
+	return addBlockElement(set, addressKey(address), address.String(), minutes)
+}
+
+// BlockTuple blocks new traffic from the client address to the server address and
+// port using the argumented protocol for the argumented number of minutes.
+// The client port is not used since a new session will almost always use a different one.
+func BlockTuple(protocol uint8, client net.IP, server net.IP, serverPort uint16, minutes int) error {
+	if client == nil || server == nil {
+		return errors.New("Invalid address")
+	}
+	if ipVersion(client) != ipVersion(server) {
+		return errors.New("Address family mismatch")
+	}
+	if protocol != 6 && protocol != 17 {
+		return fmt.Errorf("Unsupported protocol: %d", protocol)
+	}
+
+	addrType := nftables.TypeIPAddr
+	if client.To4() == nil {
+		addrType = nftables.TypeIP6Addr
+	}
+	set := &nftables.Set{
+		Table:         newTable(),
+		Name:          blockTupleSet + ipVersion(client),
+		KeyType:       nftables.MustConcatSetType(addrType, addrType, nftables.TypeInetProto, nftables.TypeInetService),
+		HasTimeout:    true,
+		Concatenation: true,
+	}
+
+	// each part of a concatenated key is padded to a multiple of four bytes
+	var key []byte
+	key = append(key, addressKey(client)...)
+	key = append(key, addressKey(server)...)
+	key = append(key, protocol, 0, 0, 0)
+	key = append(key, binaryutil.BigEndian.PutUint16(serverPort)...)
+	key = append(key, 0, 0)
+
+	element := fmt.Sprintf("%s . %s . %d . %d", client.String(), server.String(), protocol, serverPort)
+	return addBlockElement(set, key, element, minutes)
+}
+
+// addBlockElement adds an element to one of the block sets with the argumented timeout
+func addBlockElement(set *nftables.Set, key []byte, element string, minutes int) error {
+	if minutes <= 0 {
+		return errors.New("Block minutes must be greater than zero")
+	}
+
+	logger.Info("Blocking %s in %s for %d minutes\n", element, set.Name, minutes)
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	err = conn.SetAddElements(set, []nftables.SetElement{{Key: key, Timeout: time.Duration(minutes) * time.Minute}})
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		logger.Warn("Error adding %s to %s: %v\n", element, set.Name, err)
+		return err
+	}
+
+	return nil
+}
+
+// addressKey returns the address in the format used for set keys
+func addressKey(address net.IP) []byte {
+	if ip := address.To4(); ip != nil {
+		return []byte(ip)
+	}
+	return []byte(address.To16())
+}
+
+// ipVersion returns the suffix for the set that holds the argumented address
+func ipVersion(address net.IP) string {
+	if address.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
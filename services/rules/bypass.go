@@ -0,0 +1,539 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+	"golang.org/x/sys/unix"
+)
+
+// The bypass chain is jumped to from the queue chain before any traffic is queued.
+// We flush and rebuild the chain from the bypass rules in settings whenever they
+// change. Matching traffic gets the conntrack bypass bit so the remaining packets
+// in the session skip the queue.
+const bypassComment = "bypass-"
+
+// BypassSettingsPath is the location of the bypass rules in the settings
+var BypassSettingsPath = []string{"packetd", "bypassRules"}
+
+// BypassRule is a rule for traffic that should never be sent to packetd.
+// All of the non-empty fields must match. Addresses can be a single address or a
+// CIDR, ports can be a single port, a range, or a comma separated list of both.
+type BypassRule struct {
+	RuleID             int    `json:"ruleId"`
+	Enabled            bool   `json:"enabled"`
+	Description        string `json:"description"`
+	Interface          string `json:"interface"`
+	Protocol           string `json:"protocol"`
+	SourceAddress      string `json:"sourceAddress"`
+	SourcePort         string `json:"sourcePort"`
+	DestinationAddress string `json:"destinationAddress"`
+	DestinationPort    string `json:"destinationPort"`
+}
+
+// BypassRuleStatus is a bypass rule along with the hit counter from the kernel.
+// Once a rule matches the session is marked for bypass and the remaining packets
+// skip the bypass chain, so the hit counter is roughly the number of sessions.
+type BypassRuleStatus struct {
+	BypassRule
+	Hits uint64 `json:"hits"`
+}
+
+// portRange is a single port or range from a bypass rule port list
+type portRange struct {
+	low  uint16
+	high uint16
+}
+
+// portSet is an anonymous set holding the ports of a bypass rule port list
+// It must be added in the same transaction as the rule that uses it.
+type portSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+}
+
+// bypassSetID is the ID of the first anonymous port set. The IDs only need
+// to be unique within a transaction and this keeps them clear of the block sets.
+const bypassSetID = 1000
+
+var interfacePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// bypassLock serializes changes to the bypass rules in settings
+var bypassLock sync.Mutex
+
+// ErrBypassRuleNotFound is returned when no bypass rule has the requested ID
+var ErrBypassRuleNotFound = errors.New("Bypass rule not found")
+
+// BypassRuleError is returned when a bypass rule fails validation
+type BypassRuleError struct {
+	RuleID int
+	Err    error
+}
+
+func (e *BypassRuleError) Error() string {
+	return fmt.Sprintf("rule %d: %v", e.RuleID, e.Err)
+}
+
+// GetBypassRules returns the bypass rules from settings
+func GetBypassRules() ([]BypassRule, error) {
+	var list []BypassRule
+
+	value, err := settings.GetSettings(BypassSettingsPath)
+	if err != nil || value == nil {
+		// no rules configured is not an error
+		return list, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, errors.New("Invalid bypass rules in settings")
+	}
+
+	return list, nil
+}
+
+// SetBypassRules validates and saves the bypass rules to settings and applies them
+func SetBypassRules(list []BypassRule) error {
+	bypassLock.Lock()
+	defer bypassLock.Unlock()
+
+	return saveBypassRules(list)
+}
+
+// saveBypassRules validates and saves the bypass rules to settings and applies them
+// The caller must hold bypassLock.
+func saveBypassRules(list []BypassRule) error {
+	for i := range list {
+		err := list[i].Validate()
+		if err != nil {
+			return &BypassRuleError{RuleID: list[i].RuleID, Err: err}
+		}
+	}
+
+	_, err := settings.SetSettings(BypassSettingsPath, list)
+	if err != nil {
+		return err
+	}
+
+	return SyncBypassRules()
+}
+
+// GetBypassRuleStatus returns the bypass rules along with the hit counters
+func GetBypassRuleStatus() ([]BypassRuleStatus, error) {
+	list, err := GetBypassRules()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := readBypassCounters()
+	status := make([]BypassRuleStatus, len(list))
+	for i, rule := range list {
+		status[i].BypassRule = rule
+		status[i].Hits = counters[rule.RuleID]
+	}
+
+	return status, nil
+}
+
+// SyncBypassRules rebuilds the bypass chain from the rules in settings.
+// The flush and all of the rules are applied in a single netlink transaction
+// so traffic never sees a partial rule set. Nothing is done if the packetd
+// rules are not installed since the rules will be added when they are.
+func SyncBypassRules() error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	if !status.Installed {
+		return nil
+	}
+
+	list, err := GetBypassRules()
+	if err != nil {
+		logger.Warn("Unable to load bypass rules: %v\n", err)
+		return err
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	conn.FlushChain(newChain(bypassChain))
+	count := addBypassRules(conn, list)
+
+	err = conn.Flush()
+	if err != nil {
+		logger.Warn("Error applying bypass rules: %v\n", err)
+		return err
+	}
+
+	logger.Info("Applied %d bypass rules\n", count)
+	return nil
+}
+
+// addBypassRules adds the port sets and the enabled bypass rules to the bypass
+// chain in the pending transaction and returns the number of rules added
+func addBypassRules(conn *nftables.Conn, list []BypassRule) int {
+	rules, sets := bypassRules(list)
+	addPortSets(conn, sets)
+	for _, rule := range rules {
+		conn.AddRule(rule)
+	}
+	return len(rules)
+}
+
+// addPortSets adds the anonymous port sets to the pending transaction
+func addPortSets(conn *nftables.Conn, sets []portSet) {
+	for _, item := range sets {
+		err := conn.AddSet(item.set, item.elements)
+		if err != nil {
+			logger.Warn("Failed to add bypass port set: %v\n", err)
+		}
+	}
+}
+
+// bypassRules returns the nftables rule for each enabled bypass rule along
+// with the anonymous port sets the rules use
+func bypassRules(list []BypassRule) ([]*nftables.Rule, []portSet) {
+	var rules []*nftables.Rule
+	var sets []portSet
+
+	for _, rule := range list {
+		if !rule.Enabled {
+			continue
+		}
+		match, ruleSets, err := rule.Expressions(bypassSetID + uint32(len(sets)))
+		if err != nil {
+			logger.Warn("Ignoring invalid bypass rule %d: %v\n", rule.RuleID, err)
+			continue
+		}
+		sets = append(sets, ruleSets...)
+		rules = append(rules, &nftables.Rule{
+			Table:    newTable(),
+			Chain:    newChain(bypassChain),
+			Exprs:    join(match, []expr.Any{counter()}, setCtMark(bypassMark), []expr.Any{verdict(expr.VerdictAccept)}),
+			UserData: ruleComment(bypassComment + strconv.Itoa(rule.RuleID)),
+		})
+	}
+
+	return rules, sets
+}
+
+// bypassTags returns the comment of each rule we expect in the bypass chain
+func bypassTags(list []BypassRule) []string {
+	var tags []string
+
+	for _, rule := range list {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.Validate() != nil {
+			continue
+		}
+		tags = append(tags, bypassComment+strconv.Itoa(rule.RuleID))
+	}
+
+	return tags
+}
+
+// Validate checks that the rule can be converted to nftables expressions
+func (rule *BypassRule) Validate() error {
+	_, _, err := rule.Expressions(bypassSetID)
+	return err
+}
+
+// Expressions returns the match expressions for the bypass rule. A port list
+// with more than one range is matched with an anonymous interval set and those
+// sets are returned with the IDs starting at setID.
+func (rule *BypassRule) Expressions(setID uint32) ([]expr.Any, []portSet, error) {
+	var base []expr.Any
+	var family string
+
+	if rule.RuleID <= 0 {
+		return nil, nil, errors.New("ruleId must be greater than zero")
+	}
+
+	if rule.Interface != "" {
+		if !interfacePattern.MatchString(rule.Interface) || len(rule.Interface) >= unix.IFNAMSIZ {
+			return nil, nil, fmt.Errorf("invalid interface: %s", rule.Interface)
+		}
+		base = append(base, matchIifname(rule.Interface)...)
+	}
+
+	for _, item := range []struct {
+		value  string
+		source bool
+	}{{rule.SourceAddress, true}, {rule.DestinationAddress, false}} {
+		if item.value == "" {
+			continue
+		}
+		network, err := parseBypassAddress(item.value)
+		if err != nil {
+			return nil, nil, err
+		}
+		fam := ipVersion(network.IP)
+		if family != "" && family != fam {
+			return nil, nil, errors.New("source and destination address family mismatch")
+		}
+		family = fam
+		base = append(base, matchAddress(network, item.source)...)
+	}
+
+	protocol := strings.ToLower(rule.Protocol)
+	switch protocol {
+	case "":
+		if rule.SourcePort != "" || rule.DestinationPort != "" {
+			return nil, nil, errors.New("protocol is required when a port is specified")
+		}
+	case "tcp":
+		base = append(base, matchL4Proto(unix.IPPROTO_TCP)...)
+	case "udp":
+		base = append(base, matchL4Proto(unix.IPPROTO_UDP)...)
+	case "sctp":
+		base = append(base, matchL4Proto(unix.IPPROTO_SCTP)...)
+	default:
+		return nil, nil, fmt.Errorf("invalid protocol: %s", rule.Protocol)
+	}
+
+	if len(base) == 0 {
+		return nil, nil, errors.New("at least one match is required")
+	}
+
+	var sets []portSet
+	for _, item := range []struct {
+		value  string
+		source bool
+	}{{rule.SourcePort, true}, {rule.DestinationPort, false}} {
+		if item.value == "" {
+			continue
+		}
+		ports, err := parseBypassPorts(item.value)
+		if err != nil {
+			return nil, nil, err
+		}
+		ports = mergePortRanges(ports)
+		if len(ports) == 1 {
+			base = append(base, matchPort(item.source, ports[0].low, ports[0].high)...)
+			continue
+		}
+		set := newPortSet(setID+uint32(len(sets)), ports)
+		sets = append(sets, set)
+		base = append(base, lookupPortSet(set.set, item.source)...)
+	}
+
+	return base, sets, nil
+}
+
+// newPortSet returns an anonymous interval set holding the port ranges
+// The ranges must be sorted and must not overlap or touch. Like nft we start
+// with an interval end at zero and each range ends at the port after it.
+func newPortSet(id uint32, ports []portRange) portSet {
+	set := &nftables.Set{
+		Table:     newTable(),
+		ID:        id,
+		Name:      "__set%d",
+		Anonymous: true,
+		Constant:  true,
+		Interval:  true,
+		KeyType:   nftables.TypeInetService,
+	}
+
+	var elements []nftables.SetElement
+	if ports[0].low != 0 {
+		elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(0), IntervalEnd: true})
+	}
+	for _, port := range ports {
+		elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(port.low)})
+		if port.high != 65535 {
+			elements = append(elements, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(port.high + 1), IntervalEnd: true})
+		}
+	}
+
+	return portSet{set: set, elements: elements}
+}
+
+// mergePortRanges returns the ranges sorted with the overlapping and adjacent ranges combined
+func mergePortRanges(ports []portRange) []portRange {
+	sorted := append([]portRange{}, ports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].low < sorted[j].low })
+
+	merged := sorted[:1]
+	for _, port := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if uint32(port.low) <= uint32(last.high)+1 {
+			if port.high > last.high {
+				last.high = port.high
+			}
+			continue
+		}
+		merged = append(merged, port)
+	}
+	return merged
+}
+
+// parseBypassAddress returns the network for an address or CIDR
+func parseBypassAddress(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", value)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", value)
+	}
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseBypassPorts returns the ports and ranges in a port list
+func parseBypassPorts(value string) ([]portRange, error) {
+	var list []portRange
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		bounds := strings.SplitN(item, "-", 2)
+		var ports []uint16
+		for _, bound := range bounds {
+			port, err := strconv.Atoi(strings.TrimSpace(bound))
+			if err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid port: %s", item)
+			}
+			ports = append(ports, uint16(port))
+		}
+		if len(ports) == 1 {
+			ports = append(ports, ports[0])
+		}
+		if ports[0] > ports[1] {
+			return nil, fmt.Errorf("invalid port: %s", item)
+		}
+		list = append(list, portRange{low: ports[0], high: ports[1]})
+	}
+
+	return list, nil
+}
+
+// readBypassCounters returns the hit counter for each rule in the bypass chain
+func readBypassCounters() map[int]uint64 {
+	counters := make(map[int]uint64)
+
+	conn, err := nftables.New()
+	if err != nil {
+		return counters
+	}
+
+	list, err := conn.GetRules(newTable(), newChain(bypassChain))
+	if err != nil {
+		logger.Warn("Unable to read bypass counters: %v\n", err)
+		return counters
+	}
+
+	for _, rule := range list {
+		tag := ruleTag(rule)
+		if !strings.HasPrefix(tag, bypassComment) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(tag, bypassComment))
+		if err != nil {
+			continue
+		}
+		for _, item := range rule.Exprs {
+			if count, ok := item.(*expr.Counter); ok {
+				counters[id] += count.Packets
+			}
+		}
+	}
+
+	return counters
+}
+
+// nextBypassRuleID returns the next unused rule ID
+func nextBypassRuleID(list []BypassRule) int {
+	ids := make([]int, 0, len(list))
+	for _, rule := range list {
+		ids = append(ids, rule.RuleID)
+	}
+	sort.Ints(ids)
+	if len(ids) == 0 {
+		return 1
+	}
+	return ids[len(ids)-1] + 1
+}
+
+// AddBypassRule adds a rule to the bypass rules and returns the rule with the assigned ID
+func AddBypassRule(rule BypassRule) (BypassRule, error) {
+	bypassLock.Lock()
+	defer bypassLock.Unlock()
+
+	list, err := GetBypassRules()
+	if err != nil {
+		return rule, err
+	}
+
+	rule.RuleID = nextBypassRuleID(list)
+	list = append(list, rule)
+
+	return rule, saveBypassRules(list)
+}
+
+// UpdateBypassRule replaces the bypass rule with the argumented ID
+func UpdateBypassRule(ruleID int, rule BypassRule) error {
+	bypassLock.Lock()
+	defer bypassLock.Unlock()
+
+	list, err := GetBypassRules()
+	if err != nil {
+		return err
+	}
+
+	rule.RuleID = ruleID
+	for i := range list {
+		if list[i].RuleID == ruleID {
+			list[i] = rule
+			return saveBypassRules(list)
+		}
+	}
+
+	return ErrBypassRuleNotFound
+}
+
+// DeleteBypassRule removes the bypass rule with the argumented ID
+func DeleteBypassRule(ruleID int) error {
+	bypassLock.Lock()
+	defer bypassLock.Unlock()
+
+	list, err := GetBypassRules()
+	if err != nil {
+		return err
+	}
+
+	for i := range list {
+		if list[i].RuleID == ruleID {
+			list = append(list[:i], list[i+1:]...)
+			return saveBypassRules(list)
+		}
+	}
+
+	return ErrBypassRuleNotFound
+}
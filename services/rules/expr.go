@@ -0,0 +1,231 @@
+package rules
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// These functions build the netlink expressions for the nft statements we use.
+// They produce the same expressions as the nft command so the rules look
+// normal when listed with nft. Everything uses register 1 except the set
+// lookups on concatenations which need the 32 bit registers.
+
+const reg32 = 8 // NFT_REG32_00
+
+// matchFamily matches the ip or ip6 family in the inet table
+func matchFamily(family byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+}
+
+// matchL4Proto matches the layer 4 protocol (meta l4proto)
+func matchL4Proto(protocol byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protocol}},
+	}
+}
+
+// matchIifname matches the input interface name
+func matchIifname(name string) []expr.Any {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// loadAddress loads the source or destination address into the register
+// and returns the family for the address
+func loadAddress(network *net.IPNet, source bool, register uint32) (byte, []expr.Any) {
+	family, offset, length := addressPayload(network.IP, source)
+
+	exprs := matchFamily(family)
+	exprs = append(exprs, &expr.Payload{DestRegister: register, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length})
+	return family, exprs
+}
+
+// addressPayload returns the family and the network header offset and length of the address
+func addressPayload(ip net.IP, source bool) (byte, uint32, uint32) {
+	if ip.To4() != nil {
+		if source {
+			return unix.NFPROTO_IPV4, 12, 4
+		}
+		return unix.NFPROTO_IPV4, 16, 4
+	}
+	if source {
+		return unix.NFPROTO_IPV6, 8, 16
+	}
+	return unix.NFPROTO_IPV6, 24, 16
+}
+
+// matchAddress matches the source or destination address against an address or network
+func matchAddress(network *net.IPNet, source bool) []expr.Any {
+	_, exprs := loadAddress(network, source, 1)
+
+	ip := network.IP.To4()
+	if ip == nil {
+		ip = network.IP.To16()
+	}
+	mask := []byte(network.Mask)
+	if len(mask) == 16 && len(ip) == 4 {
+		mask = mask[12:]
+	}
+
+	ones, bits := network.Mask.Size()
+	if ones != bits {
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: mask, Xor: make([]byte, len(ip))})
+	}
+
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(mask)})
+}
+
+// matchPort matches the transport source or destination port against a port or range
+func matchPort(source bool, low uint16, high uint16) []expr.Any {
+	var offset uint32 = 2
+	if source {
+		offset = 0
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+	}
+	if low == high {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(low)})
+	}
+	return append(exprs,
+		&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(low)},
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(high)})
+}
+
+// matchCtState matches any of the conntrack state bits
+func matchCtState(bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// matchCtMark matches when all the bits in the conntrack mark are set
+func matchCtMark(bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(bits)},
+	}
+}
+
+// setCtMark sets the bits in the conntrack mark (ct mark set ct mark or bits)
+func setCtMark(bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(^bits), Xor: binaryutil.NativeEndian.PutUint32(bits)},
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+	}
+}
+
+// setMark sets the bits in the packet mark (mark set mark or bits)
+func setMark(bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(^bits), Xor: binaryutil.NativeEndian.PutUint32(bits)},
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+	}
+}
+
+// matchCtPacketsOver matches sessions with more than count packets
+// The counter is in host byte order so it is converted before the compare
+func matchCtPacketsOver(count uint64) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeyPKTS, Register: 1},
+		&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+		&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: binaryutil.BigEndian.PutUint64(count)},
+	}
+}
+
+// matchFibType matches the source or destination address type from the routing table
+func matchFibType(source bool, addrType uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Fib{Register: 1, ResultADDRTYPE: true, FlagSADDR: source, FlagDADDR: !source},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(addrType)},
+	}
+}
+
+// lookupAddressSet matches the source or destination address against a set of addresses
+func lookupAddressSet(set *nftables.Set, family byte, source bool) []expr.Any {
+	ip := net.IPv6zero
+	if family == unix.NFPROTO_IPV4 {
+		ip = net.IPv4zero
+	}
+	_, offset, length := addressPayload(ip, source)
+
+	exprs := matchFamily(family)
+	return append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID})
+}
+
+// lookupPortSet matches the transport source or destination port against a set of ports
+func lookupPortSet(set *nftables.Set, source bool) []expr.Any {
+	var offset uint32 = 2
+	if source {
+		offset = 0
+	}
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+// lookupTupleSet matches saddr . daddr . l4proto . dport against a set of tuples
+func lookupTupleSet(set *nftables.Set, family byte, protocol byte) []expr.Any {
+	ip := net.IPv6zero
+	if family == unix.NFPROTO_IPV4 {
+		ip = net.IPv4zero
+	}
+	_, saddrOffset, length := addressPayload(ip, true)
+	_, daddrOffset, _ := addressPayload(ip, false)
+	words := (length + 3) / 4
+
+	exprs := matchFamily(family)
+	exprs = append(exprs, matchL4Proto(protocol)...)
+	return append(exprs,
+		&expr.Payload{DestRegister: reg32, Base: expr.PayloadBaseNetworkHeader, Offset: saddrOffset, Len: length},
+		&expr.Payload{DestRegister: reg32 + words, Base: expr.PayloadBaseNetworkHeader, Offset: daddrOffset, Len: length},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: reg32 + 2*words},
+		&expr.Payload{DestRegister: reg32 + 2*words + 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Lookup{SourceRegister: reg32, SetName: set.Name, SetID: set.ID})
+}
+
+// counter returns a counter expression
+func counter() expr.Any {
+	return &expr.Counter{}
+}
+
+// verdict returns a verdict expression
+func verdict(kind expr.VerdictKind) expr.Any {
+	return &expr.Verdict{Kind: kind}
+}
+
+// jump returns a jump or goto verdict to the chain
+func jump(kind expr.VerdictKind, chain string) expr.Any {
+	return &expr.Verdict{Kind: kind, Chain: chain}
+}
+
+// join combines expressions into a single list
+func join(lists ...[]expr.Any) []expr.Any {
+	var result []expr.Any
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+	return result
+}
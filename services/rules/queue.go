@@ -0,0 +1,134 @@
+package rules
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const queueStatusFile = "/proc/net/netfilter/nfnetlink_queue"
+const netlinkStatusFile = "/proc/net/netlink"
+
+// netlinkNetfilter is the NETLINK_NETFILTER protocol number used by nfqueue sockets
+const netlinkNetfilter = 12
+
+// QueueStatus holds the details for a single nfqueue from /proc/net/netfilter/nfnetlink_queue
+type QueueStatus struct {
+	QueueNumber  uint16 `json:"queue_number"`
+	PortID       uint32 `json:"peer_portid"`
+	QueueTotal   uint32 `json:"queue_total"`
+	CopyMode     uint8  `json:"copy_mode"`
+	CopyRange    uint32 `json:"copy_range"`
+	QueueDropped uint32 `json:"queue_dropped"`
+	UserDropped  uint32 `json:"user_dropped"`
+	IDSequence   uint32 `json:"id_sequence"`
+	SocketDrops  uint64 `json:"socket_dropped"`
+}
+
+// GetQueueStatus returns the status of all the open nfqueues along with the
+// drop counter for the netlink socket bound to each queue
+func GetQueueStatus() ([]QueueStatus, error) {
+	var list []QueueStatus
+
+	file, err := os.Open(queueStatusFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		var values [8]uint64
+		for i := range values {
+			values[i], err = strconv.ParseUint(fields[i], 10, 32)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		list = append(list, QueueStatus{
+			QueueNumber:  uint16(values[0]),
+			PortID:       uint32(values[1]),
+			QueueTotal:   uint32(values[2]),
+			CopyMode:     uint8(values[3]),
+			CopyRange:    uint32(values[4]),
+			QueueDropped: uint32(values[5]),
+			UserDropped:  uint32(values[6]),
+			IDSequence:   uint32(values[7]),
+		})
+	}
+
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	drops := readSocketDrops()
+	for i := range list {
+		list[i].SocketDrops = drops[list[i].PortID]
+	}
+
+	return list, nil
+}
+
+// readSocketDrops returns the drop counter for each netfilter netlink socket
+// from /proc/net/netlink. The socket receive buffer overflows when we can not
+// read packets fast enough which the queue_dropped counter does not include.
+func readSocketDrops() map[uint32]uint64 {
+	drops := make(map[uint32]uint64)
+
+	file, err := os.Open(netlinkStatusFile)
+	if err != nil {
+		return drops
+	}
+	defer file.Close()
+
+	// sk Eth Pid Groups Rmem Wmem Dump Locks Drops Inode
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 {
+			continue
+		}
+		proto, err := strconv.Atoi(fields[1])
+		if err != nil || proto != netlinkNetfilter {
+			continue
+		}
+		portid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			continue
+		}
+		drops[uint32(portid)] += count
+	}
+
+	return drops
+}
+
+// isQueueOpen returns true if the argumented queue is open with the copy mode
+// and size we use which means it is owned by packetd
+func isQueueOpen(queue uint16) bool {
+	list, err := GetQueueStatus()
+	if err != nil {
+		return false
+	}
+
+	for _, item := range list {
+		if item.QueueNumber != queue {
+			continue
+		}
+		// NFQNL_COPY_PACKET with the 32768 byte copy size set in nfqueue.c
+		return item.CopyMode == 2 && item.CopyRange == 32768
+	}
+
+	return false
+}
@@ -0,0 +1,482 @@
+// Package rules manages the nftables rules that send traffic to packetd.
+// The table, chains, sets, and rules are built in Go and applied over netlink
+// in a single transaction. A background task verifies the rules are still
+// present and repairs them if something else in the system changes them.
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/untangle/packetd/services/logger"
+)
+
+const verifyInterval = 60
+const queueOpenTimeout = 10
+
+// Status holds the state of the packetd rules for the status API
+type Status struct {
+	Installed  bool      `json:"installed"`
+	Healthy    bool      `json:"healthy"`
+	DictRules  bool      `json:"dict_rules"`
+	FailOpen   bool      `json:"fail_open"`
+	DeepDNS    bool      `json:"deep_dns"`
+	QueueNum   uint16    `json:"queue_num"`
+	QueueTotal uint16    `json:"queue_total"`
+	LastApply  time.Time `json:"last_apply"`
+	LastCheck  time.Time `json:"last_check"`
+	LastRepair time.Time `json:"last_repair"`
+	Repairs    uint64    `json:"repairs"`
+	Drift      []string  `json:"drift"`
+	LastError  string    `json:"last_error"`
+}
+
+var shutdownChannel = make(chan bool)
+var rulesMutex sync.Mutex
+var status Status
+
+// Startup is called to start the rule verification task
+func Startup() {
+	go verifyTask()
+}
+
+// Shutdown is called to stop the rule verification task
+func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown rules verifyTask\n")
+	}
+}
+
+// InsertRules creates the packetd table and sends new traffic to the queues starting
+// at queueNum. The rules are only inserted once the first queue is open so traffic
+// is never sent to a queue without a listener.
+func InsertRules(queueNum uint16, queueTotal uint16) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	status.QueueNum = queueNum
+	status.QueueTotal = queueTotal
+
+	for i := 0; !isQueueOpen(queueNum); i++ {
+		if i == queueOpenTimeout {
+			err := fmt.Errorf("The packetd netfilter queue %d is not open", queueNum)
+			status.LastError = err.Error()
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+
+	err := applyRules()
+	if err != nil {
+		return err
+	}
+
+	status.Installed = true
+	status.Healthy = true
+	status.Drift = nil
+	logger.Info("Inserted packetd rules for queue %d-%d\n", queueNum, queueNum+queueTotal-1)
+	return nil
+}
+
+// RemoveRules removes the packetd table and everything in it
+func RemoveRules() error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	status.Installed = false
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	// adding first means the delete will not fail if the table is already gone
+	conn.AddTable(newTable())
+	conn.DelTable(newTable())
+	err = conn.Flush()
+	if err != nil {
+		logger.Warn("Failed to remove packetd rules: %v\n", err)
+		return err
+	}
+
+	logger.Info("Removed packetd rules\n")
+	return nil
+}
+
+// SetFailOpen enables or disables fail-open mode where all new sessions
+// are marked for bypass so they are never sent to the nfqueue. The state
+// is kept when the rules are rebuilt.
+func SetFailOpen(enabled bool) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	status.FailOpen = enabled
+	if !status.Installed {
+		return nil
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	conn.FlushChain(newChain(failOpenChain))
+	if enabled {
+		conn.AddRule(failOpenRule())
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		logger.Warn("Failed to update fail-open rule: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// SetDeepDNS enables or disables queueing UDP DNS sessions past the deep session
+// limit for the plugins that must see every query on a long lived socket. The
+// state is kept when the rules are rebuilt.
+func SetDeepDNS(enabled bool) error {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	if status.DeepDNS == enabled {
+		return nil
+	}
+	status.DeepDNS = enabled
+	if !status.Installed {
+		return nil
+	}
+
+	return applyRules()
+}
+
+// GetStatus returns the current state of the packetd rules
+func GetStatus() Status {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	result := status
+	result.Drift = append([]string{}, status.Drift...)
+	return result
+}
+
+// applyRules builds the complete packetd table and applies it in one transaction.
+// The table is updated in place so traffic never sees it empty. Missing sets and
+// chains are created, the block sets keep their elements, and only the chains
+// whose rules changed are flushed and rebuilt so the others keep their counters.
+// The caller must hold rulesMutex.
+func applyRules() error {
+	conn, err := nftables.New()
+	if err != nil {
+		status.LastError = err.Error()
+		return err
+	}
+
+	bypass, err := GetBypassRules()
+	if err != nil {
+		logger.Warn("Unable to load bypass rules: %v\n", err)
+	}
+
+	rs := buildRuleset(status.QueueNum, status.QueueTotal, status.DeepDNS)
+	expected := make(map[string][]*nftables.Rule)
+	for _, rule := range rs.rules {
+		expected[rule.Chain.Name] = append(expected[rule.Chain.Name], rule)
+	}
+	bypassList, bypassSets := bypassRules(bypass)
+	expected[bypassChain] = bypassList
+	if status.FailOpen {
+		expected[failOpenChain] = []*nftables.Rule{failOpenRule()}
+	}
+
+	current, err := currentChains(conn)
+	if err != nil {
+		status.LastError = err.Error()
+		return err
+	}
+	currentSets := make(map[string]bool)
+	if len(current) != 0 {
+		sets, err := conn.GetSets(rs.table)
+		if err != nil {
+			status.LastError = err.Error()
+			return err
+		}
+		for _, set := range sets {
+			currentSets[set.Name] = true
+		}
+	}
+
+	conn.AddTable(rs.table)
+	for _, set := range rs.sets {
+		if currentSets[set.Name] {
+			continue
+		}
+		err = conn.AddSet(set, nil)
+		if err != nil {
+			status.LastError = err.Error()
+			return err
+		}
+	}
+
+	// all of the chains must exist before the rules that jump to them are added
+	for _, chain := range rs.chains {
+		have, found := current[chain.Name]
+		if found && chain.Type != "" && (have.Hooknum != chain.Hooknum || have.Priority != chain.Priority) {
+			conn.FlushChain(chain)
+			conn.DelChain(chain)
+			delete(current, chain.Name)
+			found = false
+		}
+		if !found {
+			conn.AddChain(chain)
+		}
+	}
+
+	for _, chain := range rs.chains {
+		// the dict rules are replaced by loadDictRules
+		if chain.Name == dictBypassChain || chain.Name == dictFlushChain {
+			continue
+		}
+
+		if current[chain.Name] != nil {
+			rules, err := conn.GetRules(rs.table, chain)
+			if err != nil {
+				status.LastError = err.Error()
+				return err
+			}
+			if equalTags(ruleTags(rules), ruleTags(expected[chain.Name])) {
+				continue
+			}
+			conn.FlushChain(chain)
+		}
+		if chain.Name == bypassChain {
+			addPortSets(conn, bypassSets)
+		}
+		for _, rule := range expected[chain.Name] {
+			conn.AddRule(rule)
+		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		status.LastError = err.Error()
+		logger.Err("Failed to apply packetd rules: %v\n", err)
+		return err
+	}
+
+	status.DictRules = loadDictRules()
+	status.LastApply = time.Now()
+	status.LastError = ""
+	return nil
+}
+
+// currentChains returns the chains in the packetd table by name
+func currentChains(conn *nftables.Conn) (map[string]*nftables.Chain, error) {
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]*nftables.Chain)
+	for _, chain := range chains {
+		if chain.Table != nil && chain.Table.Name == tableName {
+			current[chain.Name] = chain
+		}
+	}
+	return current, nil
+}
+
+// ruleTags returns the tag of each rule
+func ruleTags(rules []*nftables.Rule) []string {
+	var tags []string
+	for _, rule := range rules {
+		tags = append(tags, ruleTag(rule))
+	}
+	return tags
+}
+
+// loadDictRules adds the rules that use the dict expression with the nft command
+// returns false if they could not be loaded which happens when the packetd kernel
+// module is not available
+func loadDictRules() bool {
+	script := strings.Join(dictRules, "\n") + "\n"
+
+	cmd := exec.Command(nftCommand(), "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Warn("Failed to load dict rules: %v %s\n", err, strings.TrimSpace(string(output)))
+		return false
+	}
+
+	return true
+}
+
+// verifyTask periodically checks the rules and repairs them if needed
+func verifyTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(verifyInterval * time.Second):
+			verifyRules()
+		}
+	}
+}
+
+// verifyRules compares the rules in the kernel with the rules we expect
+// and rebuilds the table if anything is missing or different
+func verifyRules() {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+
+	if !status.Installed {
+		return
+	}
+
+	drift, err := findDrift()
+	status.LastCheck = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		logger.Warn("Unable to verify packetd rules: %v\n", err)
+		return
+	}
+
+	status.Drift = drift
+	status.Healthy = (len(drift) == 0)
+	if status.Healthy {
+		return
+	}
+
+	logger.Warn("%OC|Repairing packetd rules: %v\n", "nftables_rules_repaired", 0, drift)
+	err = applyRules()
+	if err != nil {
+		return
+	}
+	status.Repairs++
+	status.LastRepair = time.Now()
+}
+
+// findDrift returns a description of each difference between the kernel and the expected rules
+func findDrift() ([]string, error) {
+	var drift []string
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	rs := buildRuleset(status.QueueNum, status.QueueTotal, status.DeepDNS)
+
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, table := range tables {
+		if table.Name == tableName {
+			found = true
+		}
+	}
+	if !found {
+		return []string{"table " + tableName + " missing"}, nil
+	}
+
+	current, err := currentChains(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range rs.chains {
+		have, ok := current[chain.Name]
+		if !ok {
+			drift = append(drift, "chain "+chain.Name+" missing")
+			continue
+		}
+		if chain.Type != "" && (have.Hooknum != chain.Hooknum || have.Priority != chain.Priority) {
+			drift = append(drift, "chain "+chain.Name+" hook changed")
+		}
+	}
+
+	sets, err := conn.GetSets(rs.table)
+	if err != nil {
+		return nil, err
+	}
+	currentSets := make(map[string]bool)
+	for _, set := range sets {
+		currentSets[set.Name] = true
+	}
+	for _, set := range rs.sets {
+		if !currentSets[set.Name] {
+			drift = append(drift, "set "+set.Name+" missing")
+		}
+	}
+
+	if len(drift) != 0 {
+		return drift, nil
+	}
+
+	expected := make(map[string][]string)
+	for _, rule := range rs.rules {
+		expected[rule.Chain.Name] = append(expected[rule.Chain.Name], ruleTag(rule))
+	}
+	bypass, err := GetBypassRules()
+	if err == nil {
+		expected[bypassChain] = bypassTags(bypass)
+	}
+	if status.FailOpen {
+		expected[failOpenChain] = []string{ruleTag(failOpenRule())}
+	}
+
+	for _, chain := range rs.chains {
+		rules, err := conn.GetRules(rs.table, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		if chain.Name == dictBypassChain || chain.Name == dictFlushChain {
+			if status.DictRules && len(rules) != 1 {
+				drift = append(drift, fmt.Sprintf("chain %s has %d rules", chain.Name, len(rules)))
+			}
+			continue
+		}
+
+		have := ruleTags(rules)
+		if !equalTags(have, expected[chain.Name]) {
+			drift = append(drift, fmt.Sprintf("chain %s rules changed (have %d expected %d)", chain.Name, len(have), len(expected[chain.Name])))
+		}
+	}
+
+	return drift, nil
+}
+
+// equalTags returns true if both lists of rule tags are the same
+func equalTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nftCommand returns the nft command which can be overridden with the NFT environment variable
+func nftCommand() string {
+	if nft, ok := os.LookupEnv("NFT"); ok && nft != "" {
+		return nft
+	}
+	return "nft"
+}
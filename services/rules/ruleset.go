@@ -0,0 +1,228 @@
+package rules
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const tableName = "packetd"
+const preroutingChain = "packetd-prerouting"
+const inputChain = "packetd-input"
+const outputChain = "packetd-output"
+const queueChain = "packetd-queue"
+const bypassChain = "packetd-bypass"
+const dictBypassChain = "packetd-dict-bypass"
+const dictFlushChain = "packetd-dict-flush"
+const failOpenChain = "packetd-failopen"
+
+// ruleTagPrefix is added to the comment on each rule so drift can be detected
+const ruleTagPrefix = "packetd:"
+
+const hookPriority = -145
+const deepSessionPackets = 256
+
+// The bypass bit in the conntrack mark and the new packet bit in the packet mark
+const bypassMark = 0x80000000
+const newPacketMark = 0x10000000
+
+// ruleset holds everything we create in the packetd table
+type ruleset struct {
+	table  *nftables.Table
+	chains []*nftables.Chain
+	sets   []*nftables.Set
+	rules  []*nftables.Rule
+}
+
+// newTable returns the packetd table
+func newTable() *nftables.Table {
+	return &nftables.Table{Name: tableName, Family: nftables.TableFamilyINet}
+}
+
+// newChain returns a chain in the packetd table for use in set and rule operations
+func newChain(name string) *nftables.Chain {
+	return &nftables.Chain{Name: name, Table: newTable()}
+}
+
+// buildRuleset creates the table, chains, sets, and rules that send traffic to the nfqueue
+// When deepDNS is set UDP DNS sessions are still queued after deepSessionPackets.
+func buildRuleset(queueNum uint16, queueTotal uint16, deepDNS bool) *ruleset {
+	rs := new(ruleset)
+	rs.table = newTable()
+
+	policy := nftables.ChainPolicyAccept
+	baseChain := func(name string, hook nftables.ChainHook) *nftables.Chain {
+		return &nftables.Chain{
+			Name:     name,
+			Table:    rs.table,
+			Hooknum:  hook,
+			Priority: hookPriority,
+			Type:     nftables.ChainTypeFilter,
+			Policy:   &policy,
+		}
+	}
+	regularChain := func(name string) *nftables.Chain {
+		return &nftables.Chain{Name: name, Table: rs.table}
+	}
+
+	prerouting := baseChain(preroutingChain, nftables.ChainHookPrerouting)
+	output := baseChain(outputChain, nftables.ChainHookOutput)
+	input := baseChain(inputChain, nftables.ChainHookInput)
+	queue := regularChain(queueChain)
+	rs.chains = []*nftables.Chain{queue, regularChain(bypassChain), regularChain(dictBypassChain), regularChain(dictFlushChain), regularChain(failOpenChain), prerouting, output, input}
+
+	// the sets for temporary host and session blocks
+	// elements are added with a timeout and expire on their own
+	tuple4 := nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService)
+	tuple6 := nftables.MustConcatSetType(nftables.TypeIP6Addr, nftables.TypeIP6Addr, nftables.TypeInetProto, nftables.TypeInetService)
+	hosts4 := &nftables.Set{Table: rs.table, ID: 1, Name: blockHostSet + "4", KeyType: nftables.TypeIPAddr, HasTimeout: true}
+	hosts6 := &nftables.Set{Table: rs.table, ID: 2, Name: blockHostSet + "6", KeyType: nftables.TypeIP6Addr, HasTimeout: true}
+	tuples4 := &nftables.Set{Table: rs.table, ID: 3, Name: blockTupleSet + "4", KeyType: tuple4, HasTimeout: true, Concatenation: true}
+	tuples6 := &nftables.Set{Table: rs.table, ID: 4, Name: blockTupleSet + "6", KeyType: tuple6, HasTimeout: true, Concatenation: true}
+	rs.sets = []*nftables.Set{hosts4, hosts6, tuples4, tuples6}
+
+	add := func(chain *nftables.Chain, tag string, exprs ...[]expr.Any) {
+		rs.rules = append(rs.rules, &nftables.Rule{
+			Table:    rs.table,
+			Chain:    chain,
+			Exprs:    join(exprs...),
+			UserData: ruleComment(ruleTagPrefix + tag),
+		})
+	}
+	drop := []expr.Any{counter(), verdict(expr.VerdictDrop)}
+	ret := []expr.Any{verdict(expr.VerdictReturn)}
+	countReturn := []expr.Any{counter(), verdict(expr.VerdictReturn)}
+
+	// Drop blocked traffic
+	add(prerouting, "block-hosts4-saddr", lookupAddressSet(hosts4, unix.NFPROTO_IPV4, true), drop)
+	add(prerouting, "block-hosts4-daddr", lookupAddressSet(hosts4, unix.NFPROTO_IPV4, false), drop)
+	add(prerouting, "block-hosts6-saddr", lookupAddressSet(hosts6, unix.NFPROTO_IPV6, true), drop)
+	add(prerouting, "block-hosts6-daddr", lookupAddressSet(hosts6, unix.NFPROTO_IPV6, false), drop)
+	add(prerouting, "block-tuples4-tcp", lookupTupleSet(tuples4, unix.NFPROTO_IPV4, unix.IPPROTO_TCP), drop)
+	add(prerouting, "block-tuples4-udp", lookupTupleSet(tuples4, unix.NFPROTO_IPV4, unix.IPPROTO_UDP), drop)
+	add(prerouting, "block-tuples6-tcp", lookupTupleSet(tuples6, unix.NFPROTO_IPV6, unix.IPPROTO_TCP), drop)
+	add(prerouting, "block-tuples6-udp", lookupTupleSet(tuples6, unix.NFPROTO_IPV6, unix.IPPROTO_UDP), drop)
+
+	// Catch packets in prerouting
+	add(prerouting, "prerouting-queue", []expr.Any{jump(expr.VerdictGoto, queueChain)})
+
+	// Set bypass bit on all local-outbound sessions
+	add(output, "output-bypass", matchCtState(expr.CtStateBitNEW), setCtMark(bypassMark))
+	add(output, "output-queue", []expr.Any{jump(expr.VerdictGoto, queueChain)})
+
+	// Set bypass bit on all local-inbound sessions (except DNS)
+	add(input, "input-dns-udp", matchL4Proto(unix.IPPROTO_UDP), matchPort(false, 53, 53), ret)
+	add(input, "input-dns-tcp", matchL4Proto(unix.IPPROTO_TCP), matchPort(false, 53, 53), ret)
+	add(input, "input-bypass", matchCtState(expr.CtStateBitNEW), setCtMark(bypassMark))
+
+	// Don't catch loopback traffic
+	loopback4 := &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+	loopback6 := &net.IPNet{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)}
+	add(queue, "loopback4-saddr", matchAddress(loopback4, true), ret)
+	add(queue, "loopback4-daddr", matchAddress(loopback4, false), ret)
+	add(queue, "loopback6-saddr", matchAddress(loopback6, true), ret)
+	add(queue, "loopback6-daddr", matchAddress(loopback6, false), ret)
+
+	// Do not queue invalid or untracked packets
+	// These will not have a valid conntrack ID so there is nothing for packetd to attach metadata to
+	add(queue, "invalid", matchCtState(expr.CtStateBitINVALID), ret)
+	add(queue, "untracked", matchCtState(expr.CtStateBitUNTRACKED), ret)
+
+	// Bypass new sessions while the watchdog has packetd in fail-open mode
+	add(queue, "fail-open", []expr.Any{jump(expr.VerdictJump, failOpenChain)})
+
+	// Don't catch bypassed traffic
+	// The dict expression is not available over netlink so that rule is loaded separately
+	add(queue, "dict-bypass", []expr.Any{jump(expr.VerdictJump, dictBypassChain)})
+	add(queue, "bypass-mark", matchCtMark(bypassMark), countReturn)
+
+	// Don't catch traffic matching the bypass rules
+	add(queue, "bypass-rules", []expr.Any{jump(expr.VerdictJump, bypassChain)})
+
+	// Only catch unicast traffic
+	add(queue, "anycast-saddr", matchFibType(true, unix.RTN_ANYCAST), countReturn)
+	add(queue, "anycast-daddr", matchFibType(false, unix.RTN_ANYCAST), countReturn)
+	add(queue, "broadcast-saddr", matchFibType(true, unix.RTN_BROADCAST), countReturn)
+	add(queue, "broadcast-daddr", matchFibType(false, unix.RTN_BROADCAST), countReturn)
+	add(queue, "multicast-saddr", matchFibType(true, unix.RTN_MULTICAST), countReturn)
+	add(queue, "multicast-daddr", matchFibType(false, unix.RTN_MULTICAST), countReturn)
+
+	// Keep queueing deep UDP DNS sessions when asked since forwarders send every
+	// query over one long lived socket and the sinkhole must see all of them
+	queueVerdict := []expr.Any{counter(), &expr.Queue{Num: queueNum, Total: queueTotal, Flag: expr.QueueFlagFanout | expr.QueueFlagBypass}}
+	if deepDNS {
+		add(queue, "deep-dns-dport", matchL4Proto(unix.IPPROTO_UDP), matchPort(false, 53, 53), matchCtPacketsOver(deepSessionPackets), queueVerdict)
+		add(queue, "deep-dns-sport", matchL4Proto(unix.IPPROTO_UDP), matchPort(true, 53, 53), matchCtPacketsOver(deepSessionPackets), queueVerdict)
+	}
+
+	// Don't catch deep-sessions
+	add(queue, "deep-session", matchCtPacketsOver(deepSessionPackets), countReturn)
+
+	// In case we are quickly reusing a conntrack id, flush the sessions dictionary on new connections
+	add(queue, "dict-flush", []expr.Any{jump(expr.VerdictJump, dictFlushChain)})
+
+	// Set the new packet mark
+	// We must actually set this mark so that packetd can tell this is a "new" packet
+	// If it tries to predict if its a new packet based on the tuple and/or the conntrack ID it will sometimes fail
+	// This happens when a "new" packet gets dropped before conntrack confirmation. In this case a subsequent packet
+	// that may have the same tuple, and actually may get exactly the same semi-random conntrack ID.
+	// To packetd this will look like a second packet, but netfilter considers this a new packet.
+	// The only reliable way to let packetd know this is a new packet is by setting the mark before queueing
+	add(queue, "new-mark", matchCtState(expr.CtStateBitNEW), setMark(newPacketMark))
+
+	// Queue the traffic
+	add(queue, "queue", queueVerdict)
+
+	return rs
+}
+
+// failOpenRule returns the rule that sets the bypass mark on all new sessions
+// The bypass mark rule that follows the jump then returns without queueing
+func failOpenRule() *nftables.Rule {
+	return &nftables.Rule{
+		Table:    newTable(),
+		Chain:    newChain(failOpenChain),
+		Exprs:    join(matchCtState(expr.CtStateBitNEW), []expr.Any{counter()}, setCtMark(bypassMark)),
+		UserData: ruleComment(ruleTagPrefix + "fail-open"),
+	}
+}
+
+// dictRules are the rules that use the dict expression from the packetd kernel
+// module. The netlink library can't build that expression so these are loaded
+// with nft after the netlink transaction, which never changes these chains once
+// they exist. The chains are flushed in the same nft transaction so the rules
+// are replaced atomically. They live in their own chains so the rest of the
+// ruleset does not depend on them.
+var dictRules = []string{
+	"flush chain inet " + tableName + " " + dictBypassChain,
+	"add rule inet " + tableName + " " + dictBypassChain + " dict sessions ct id bypass_packetd bool true counter accept",
+	"flush chain inet " + tableName + " " + dictFlushChain,
+	"add rule inet " + tableName + " " + dictFlushChain + " ct state new counter dict sessions ct id flush",
+}
+
+// The rule comment is stored in the rule userdata the same way nft does it,
+// as a type, length, value attribute holding a null terminated string
+const userdataComment = 0
+
+// ruleComment returns the rule userdata for the comment
+func ruleComment(comment string) []byte {
+	data := []byte{userdataComment, byte(len(comment) + 1)}
+	data = append(data, comment...)
+	return append(data, 0)
+}
+
+// ruleTag returns the tag stored in the rule comment
+func ruleTag(rule *nftables.Rule) string {
+	data := rule.UserData
+	for len(data) >= 2 && len(data) >= 2+int(data[1]) {
+		value := data[2 : 2+int(data[1])]
+		if data[0] == userdataComment {
+			return strings.TrimRight(string(value), "\x00")
+		}
+		data = data[2+int(data[1]):]
+	}
+	return ""
+}
@@ -0,0 +1,296 @@
+// Package watchdog monitors the nfqueue and puts packetd in fail-open mode when
+// packets are not being processed fast enough. Without this a stalled plugin or
+// a busy Go runtime causes the kernel queue to fill up and stops forwarding
+// for the whole network.
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rules"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const checkInterval = 2
+
+// Fail-open modes. The bypass flag makes the nfqueue threads accept every packet
+// without passing it to Go. The mark mode sets the conntrack bypass mark on all
+// new sessions so they are never queued, while existing sessions are still handled.
+const modeFlag = "flag"
+const modeMark = "mark"
+
+// SettingsPath is the location of the watchdog configuration in the settings
+var SettingsPath = []string{"packetd", "watchdog"}
+
+// Config holds the watchdog thresholds
+type Config struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode"`
+	// MaxBacklog is the number of packets waiting in all queues
+	MaxBacklog uint64 `json:"maxBacklog"`
+	// MaxDrops is the number of packets dropped between checks
+	MaxDrops uint64 `json:"maxDrops"`
+	// MaxVerdictDelay is the seconds since the last verdict while packets are pending
+	MaxVerdictDelay int `json:"maxVerdictDelay"`
+	// RestoreDelay is the seconds the queue must be healthy before restoring
+	RestoreDelay int `json:"restoreDelay"`
+}
+
+// Status holds the current watchdog state
+type Status struct {
+	FailOpen     bool      `json:"fail_open"`
+	Mode         string    `json:"mode"`
+	Reason       string    `json:"reason"`
+	Since        time.Time `json:"since"`
+	Backlog      uint64    `json:"backlog"`
+	Drops        uint64    `json:"drops"`
+	Pending      uint64    `json:"pending"`
+	VerdictDelay int64     `json:"verdict_delay"`
+	Transitions  uint64    `json:"transitions"`
+}
+
+var shutdownChannel = make(chan bool)
+var statusMutex sync.Mutex
+var status Status
+var startTime time.Time
+var lastDrops uint64
+var healthySince time.Time
+
+// savedBypassFlag is the bypass flag before we failed open so a bypass set
+// by the operator is still in place when we restore
+var savedBypassFlag int
+
+// Startup starts the watchdog task
+func Startup() {
+	startTime = time.Now()
+	lastDrops = ^uint64(0)
+	go watchdogTask()
+}
+
+// Shutdown stops the watchdog task and restores normal processing
+func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown watchdogTask\n")
+	}
+}
+
+// GetStatus returns the current watchdog state
+func GetStatus() Status {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return status
+}
+
+// defaultConfig returns the thresholds used when nothing is in settings. The
+// watchdog is disabled until it is turned on in the settings, and a few drops
+// from a short burst are not enough to fail open.
+func defaultConfig() Config {
+	return Config{
+		Enabled:         false,
+		Mode:            modeFlag,
+		MaxBacklog:      4096,
+		MaxDrops:        1000,
+		MaxVerdictDelay: 5,
+		RestoreDelay:    30,
+	}
+}
+
+// getConfig returns the watchdog config from settings merged with the defaults
+func getConfig() Config {
+	config := defaultConfig()
+
+	value, err := settings.GetSettings(SettingsPath)
+	if err != nil || value == nil {
+		return config
+	}
+
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		logger.Warn("Invalid watchdog settings: %v\n", err)
+		return defaultConfig()
+	}
+	if config.Mode != modeFlag && config.Mode != modeMark {
+		logger.Warn("Invalid watchdog mode: %s\n", config.Mode)
+		config.Mode = modeFlag
+	}
+
+	return config
+}
+
+// watchdogTask checks the queue every few seconds
+func watchdogTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			statusMutex.Lock()
+			if status.FailOpen {
+				restore("shutdown")
+			}
+			statusMutex.Unlock()
+			shutdownChannel <- true
+			return
+		case <-time.After(checkInterval * time.Second):
+			check()
+		}
+	}
+}
+
+// check compares the queue counters with the thresholds and changes state when needed
+func check() {
+	config := getConfig()
+
+	queues, err := rules.GetQueueStatus()
+	if err != nil {
+		logger.Debug("Unable to read queue status: %v\n", err)
+		return
+	}
+
+	var backlog uint64
+	var drops uint64
+	for _, queue := range queues {
+		backlog += uint64(queue.QueueTotal)
+		drops += uint64(queue.QueueDropped) + uint64(queue.UserDropped) + queue.SocketDrops
+	}
+
+	// the counters start over if a queue is closed and opened again
+	var newDrops uint64
+	if lastDrops != ^uint64(0) && drops > lastDrops {
+		newDrops = drops - lastDrops
+	}
+	lastDrops = drops
+
+	stats := kernel.GetNfqueueStats()
+	pending := stats.Received - stats.Verdicts
+	last := stats.LastVerdict
+	if last.IsZero() {
+		last = startTime
+	}
+	delay := time.Since(last)
+
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	status.Backlog = backlog
+	status.Drops = newDrops
+	status.Pending = pending
+	status.VerdictDelay = int64(delay / time.Millisecond)
+
+	if !config.Enabled {
+		if status.FailOpen {
+			restore("watchdog disabled")
+		}
+		return
+	}
+
+	var reason string
+	switch {
+	case config.MaxBacklog > 0 && backlog >= config.MaxBacklog:
+		reason = fmt.Sprintf("queue backlog %d", backlog)
+	case config.MaxDrops > 0 && newDrops >= config.MaxDrops:
+		reason = fmt.Sprintf("%d packets dropped", newDrops)
+	case config.MaxVerdictDelay > 0 && pending > 0 && delay >= time.Duration(config.MaxVerdictDelay)*time.Second:
+		reason = fmt.Sprintf("no verdict for %v with %d packets pending", delay.Round(time.Second), pending)
+	}
+
+	if reason != "" {
+		healthySince = time.Time{}
+		if !status.FailOpen {
+			failOpen(config.Mode, reason)
+		}
+		return
+	}
+
+	if !status.FailOpen {
+		return
+	}
+
+	// in flag mode the packets in the queue never reach Go, so we wait for the
+	// callbacks that were already running to finish before restoring
+	if status.Mode == modeFlag && pending > 0 {
+		healthySince = time.Time{}
+		return
+	}
+
+	if healthySince.IsZero() {
+		healthySince = time.Now()
+	}
+	if time.Since(healthySince) >= time.Duration(config.RestoreDelay)*time.Second {
+		restore("queue healthy")
+	}
+}
+
+// failOpen stops sending traffic through packetd. The caller must hold statusMutex.
+func failOpen(mode string, reason string) {
+	var err error
+
+	switch mode {
+	case modeMark:
+		err = rules.SetFailOpen(true)
+	default:
+		savedBypassFlag = kernel.GetBypassFlag()
+		kernel.SetBypassFlag(1)
+	}
+
+	status.FailOpen = true
+	status.Mode = mode
+	status.Reason = reason
+	status.Since = time.Now()
+	status.Transitions++
+
+	logger.Warn("%OC|Watchdog enabled fail-open (%s): %s\n", "watchdog_fail_open", 0, mode, reason)
+	logEvent("fail_open", reason, err)
+}
+
+// restore returns to normal processing. The caller must hold statusMutex.
+func restore(reason string) {
+	var err error
+
+	switch status.Mode {
+	case modeMark:
+		err = rules.SetFailOpen(false)
+	default:
+		kernel.SetBypassFlag(savedBypassFlag)
+	}
+
+	logger.Notice("%OC|Watchdog restored normal processing after %v: %s\n", "watchdog_restore", 0, time.Since(status.Since).Round(time.Second), reason)
+	logEvent("restore", reason, err)
+
+	status.FailOpen = false
+	status.Reason = reason
+	status.Since = time.Now()
+	status.Transitions++
+	healthySince = time.Time{}
+}
+
+// logEvent logs a watchdog transition to the watchdog_events table
+func logEvent(action string, reason string, err error) {
+	result := "success"
+	if err != nil {
+		result = err.Error()
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp":    time.Now(),
+		"action":        action,
+		"mode":          status.Mode,
+		"reason":        reason,
+		"backlog":       status.Backlog,
+		"dropped":       status.Drops,
+		"pending":       status.Pending,
+		"verdict_delay": status.VerdictDelay,
+		"result":        result,
+	}
+	reports.LogEvent(reports.CreateEvent("watchdog_"+action, "watchdog_events", 1, columns, nil))
+}